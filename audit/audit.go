@@ -0,0 +1,287 @@
+// Package audit records the guest pull decisions of the snapshotter.
+//
+// Every record is a JSON object on its own line of an append-only file, kept
+// apart from the debug log so that it can be shipped and retained on its own.
+// With hash chaining, each record carries the SHA-256 hash of the previous
+// one and its own, so that removed, reordered or altered records are detected
+// by Verify. The chain continues across rotated files and restarts, but the
+// files rotation drops, all of them with no backups kept, take the start of
+// the chain along: the oldest file kept is verified from the prev_hash of its
+// first record.
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/ChengyuZhu6/guest-pull-snapshotter/config"
+)
+
+// Decisions recorded for an operation
+const (
+	// DecisionGuestPull is an image or layer left to the guest to pull
+	DecisionGuestPull = "guest-pull"
+	// DecisionHost is a snapshot mounted on the host
+	DecisionHost = "host"
+	// DecisionRemoved is a removed snapshot
+	DecisionRemoved = "removed"
+	// DecisionRefused is an operation that failed
+	DecisionRefused = "refused"
+	// DecisionDenied is a call the caller is not authorized to make
+	DecisionDenied = "denied"
+)
+
+// Audited snapshotter operations
+const (
+	OperationPrepare = "Prepare"
+	OperationView    = "View"
+	OperationMounts  = "Mounts"
+	OperationRemove  = "Remove"
+)
+
+// Record is one audited decision
+type Record struct {
+	Time      time.Time `json:"time"`
+	Namespace string    `json:"namespace,omitempty"`
+	Operation string    `json:"operation"`
+	Key       string    `json:"key"`
+	Parent    string    `json:"parent,omitempty"`
+	ImageRef  string    `json:"image_ref,omitempty"`
+	Decision  string    `json:"decision"`
+	// VolumeHash is the SHA-256 hash of the encoded Kata virtual volume
+	// passed to the runtime
+	VolumeHash string `json:"volume_hash,omitempty"`
+	Error      string `json:"error,omitempty"`
+	// Caller is the process that made a denied call
+	Caller *Caller `json:"caller,omitempty"`
+
+	PrevHash string `json:"prev_hash,omitempty"`
+	Hash     string `json:"hash,omitempty"`
+}
+
+// Caller identifies the process at the other end of a unix socket
+type Caller struct {
+	UID uint32 `json:"uid"`
+	GID uint32 `json:"gid"`
+	PID int32  `json:"pid"`
+}
+
+// Logger appends records to the audit file
+type Logger struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+	chain      bool
+
+	mu       sync.Mutex
+	f        *os.File
+	size     int64
+	lastHash string
+}
+
+// Open opens the audit file configured by cfg for appending, resuming the
+// hash chain from its last record
+func Open(cfg config.AuditConfig) (*Logger, error) {
+	maxSize, err := config.ParseSize(cfg.MaxSize)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &Logger{
+		path:       cfg.Path,
+		maxSize:    int64(maxSize),
+		maxBackups: cfg.MaxBackups,
+		chain:      cfg.HashChain,
+	}
+
+	if l.chain {
+		if l.lastHash, err = lastHash(cfg.Path); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Log appends r to the audit file, filling in its time and hashes
+func (l *Logger) Log(r Record) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.f == nil {
+		return errors.New("audit log is closed")
+	}
+
+	if r.Time.IsZero() {
+		r.Time = time.Now()
+	}
+	r.Time = r.Time.UTC()
+
+	if l.chain {
+		r.PrevHash = l.lastHash
+		hash, err := recordHash(r)
+		if err != nil {
+			return err
+		}
+		r.Hash = hash
+	}
+
+	line, err := json.Marshal(r)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal audit record")
+	}
+	line = append(line, '\n')
+
+	if l.maxSize > 0 && l.size > 0 && l.size+int64(len(line)) > l.maxSize {
+		if err := l.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := l.f.Write(line)
+	l.size += int64(n)
+	if err != nil {
+		return errors.Wrapf(err, "failed to write audit record to %s", l.path)
+	}
+
+	l.lastHash = r.Hash
+	return nil
+}
+
+// Close closes the audit file
+func (l *Logger) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.f == nil {
+		return nil
+	}
+	err := l.f.Close()
+	l.f = nil
+	return err
+}
+
+func (l *Logger) open() error {
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return errors.Wrapf(err, "failed to open audit log %s", l.path)
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return errors.Wrapf(err, "failed to stat audit log %s", l.path)
+	}
+
+	l.f = f
+	l.size = st.Size()
+	return nil
+}
+
+// rotate renames the audit file to <path>.1, shifting the older files and
+// dropping those beyond the backups to keep, and starts a new file
+func (l *Logger) rotate() error {
+	if err := l.f.Close(); err != nil {
+		return errors.Wrapf(err, "failed to close audit log %s", l.path)
+	}
+	l.f = nil
+
+	if l.maxBackups == 0 {
+		if err := os.Remove(l.path); err != nil {
+			return errors.Wrapf(err, "failed to remove audit log %s", l.path)
+		}
+		return l.open()
+	}
+
+	if err := os.Remove(backupPath(l.path, l.maxBackups)); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "failed to remove oldest audit log")
+	}
+	for i := l.maxBackups - 1; i >= 1; i-- {
+		if err := os.Rename(backupPath(l.path, i), backupPath(l.path, i+1)); err != nil && !os.IsNotExist(err) {
+			return errors.Wrap(err, "failed to rotate audit log")
+		}
+	}
+	if err := os.Rename(l.path, backupPath(l.path, 1)); err != nil {
+		return errors.Wrapf(err, "failed to rotate audit log %s", l.path)
+	}
+
+	return l.open()
+}
+
+func backupPath(path string, i int) string {
+	return fmt.Sprintf("%s.%d", path, i)
+}
+
+// recordHash returns the hash of r, computed over its JSON encoding without
+// the hash itself
+func recordHash(r Record) (string, error) {
+	r.Hash = ""
+	data, err := json.Marshal(r)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to marshal audit record")
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// lastHash returns the hash of the last record in the file at path, empty if
+// there is none
+func lastHash(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", errors.Wrapf(err, "failed to read audit log %s", path)
+	}
+
+	lines := bytes.Split(bytes.TrimSpace(data), []byte("\n"))
+	last := lines[len(lines)-1]
+	if len(last) == 0 {
+		return "", nil
+	}
+
+	var r Record
+	if err := json.Unmarshal(last, &r); err != nil {
+		return "", errors.Wrapf(err, "failed to parse last record of audit log %s", path)
+	}
+	return r.Hash, nil
+}
+
+// Verify checks the hash chain of the records read from r, the first of which
+// must follow the record hashed prevHash. It returns the hash of the last
+// record, to verify the next file with.
+func Verify(r io.Reader, prevHash string) (string, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+	for n := 1; scanner.Scan(); n++ {
+		var rec Record
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return "", errors.Wrapf(err, "record %d", n)
+		}
+		if rec.PrevHash != prevHash {
+			return "", errors.Errorf("record %d doesn't follow the previous record", n)
+		}
+		hash, err := recordHash(rec)
+		if err != nil {
+			return "", err
+		}
+		if hash != rec.Hash {
+			return "", errors.Errorf("record %d was altered", n)
+		}
+		prevHash = rec.Hash
+	}
+	return prevHash, scanner.Err()
+}
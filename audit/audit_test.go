@@ -0,0 +1,78 @@
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ChengyuZhu6/guest-pull-snapshotter/config"
+)
+
+func TestHashChain(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	cfg := config.AuditConfig{Path: path, HashChain: true}
+
+	l, err := Open(cfg)
+	require.NoError(t, err)
+	require.NoError(t, l.Log(Record{Operation: OperationPrepare, Key: "a", Decision: DecisionGuestPull}))
+	require.NoError(t, l.Close())
+
+	// The chain continues after a restart
+	l, err = Open(cfg)
+	require.NoError(t, err)
+	require.NoError(t, l.Log(Record{Operation: OperationMounts, Key: "b", Decision: DecisionHost}))
+	require.NoError(t, l.Close())
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	last, err := Verify(bytes.NewReader(data), "")
+	require.NoError(t, err)
+	assert.NotEmpty(t, last)
+
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	require.Len(t, lines, 2)
+
+	altered := strings.Replace(string(data), `"decision":"host"`, `"decision":"guest-pull"`, 1)
+	_, err = Verify(strings.NewReader(altered), "")
+	assert.ErrorContains(t, err, "record 2 was altered")
+
+	_, err = Verify(strings.NewReader(lines[1]+"\n"), "")
+	assert.ErrorContains(t, err, "record 1 doesn't follow")
+}
+
+func TestRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	l, err := Open(config.AuditConfig{Path: path, MaxSize: "512", MaxBackups: 2, HashChain: true})
+	require.NoError(t, err)
+	defer l.Close()
+
+	for i := 0; i < 20; i++ {
+		require.NoError(t, l.Log(Record{Operation: OperationRemove, Key: strings.Repeat("k", 50), Decision: DecisionRemoved}))
+	}
+
+	assert.FileExists(t, path+".1")
+	assert.FileExists(t, path+".2")
+	assert.NoFileExists(t, path+".3")
+
+	// The chain links the rotated files
+	var prev string
+	for _, p := range []string{path + ".1", path} {
+		data, err := os.ReadFile(p)
+		require.NoError(t, err)
+		assert.LessOrEqual(t, len(data), 512)
+
+		var first Record
+		require.NoError(t, json.Unmarshal(bytes.SplitN(data, []byte("\n"), 2)[0], &first))
+		if prev == "" {
+			prev = first.PrevHash
+		}
+		prev, err = Verify(bytes.NewReader(data), prev)
+		require.NoError(t, err)
+	}
+}
@@ -0,0 +1,115 @@
+// Package authz authorizes the calls made to the snapshots API of the gRPC
+// server
+package authz
+
+import (
+	"context"
+	"strings"
+
+	snapshotsapi "github.com/containerd/containerd/api/services/snapshots/v1"
+	"github.com/containerd/containerd/v2/pkg/namespaces"
+	"github.com/containerd/log"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/ChengyuZhu6/guest-pull-snapshotter/audit"
+)
+
+// snapshotsService is the prefix of the full method names of the snapshots API
+const snapshotsService = "/containerd.services.snapshots.v1.Snapshots/"
+
+// readOnlyMethods are the snapshots API methods that don't change snapshots
+var readOnlyMethods = map[string]bool{
+	"Stat":   true,
+	"List":   true,
+	"Mounts": true,
+	"Usage":  true,
+}
+
+// Method returns the snapshots API method name of a full gRPC method name,
+// such as "Prepare" for "/containerd.services.snapshots.v1.Snapshots/Prepare"
+func Method(fullMethod string) string {
+	return strings.TrimPrefix(fullMethod, snapshotsService)
+}
+
+// Authorizer decides whether a call to a snapshots API method is allowed
+type Authorizer interface {
+	// Authorize returns a PermissionDenied error if the call to fullMethod
+	// with req, nil for streaming calls, made with ctx is not allowed
+	Authorize(ctx context.Context, fullMethod string, req interface{}) error
+}
+
+// ReadOnly allows only the methods that don't change snapshots
+type ReadOnly struct{}
+
+// Authorize implements Authorizer
+func (ReadOnly) Authorize(_ context.Context, fullMethod string, _ interface{}) error {
+	if !strings.HasPrefix(fullMethod, snapshotsService) || !readOnlyMethods[Method(fullMethod)] {
+		return status.Errorf(codes.PermissionDenied, "%s is not allowed on a read-only listener", fullMethod)
+	}
+	return nil
+}
+
+// UnaryServerInterceptor rejects the unary calls denied by a, recording them
+// in auditLog if it is not nil
+func UnaryServerInterceptor(a Authorizer, auditLog *audit.Logger) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if err := a.Authorize(ctx, info.FullMethod, req); err != nil {
+			auditDenied(ctx, auditLog, info.FullMethod, req, err)
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// StreamServerInterceptor rejects the streaming calls denied by a, recording
+// them in auditLog if it is not nil
+func StreamServerInterceptor(a Authorizer, auditLog *audit.Logger) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if err := a.Authorize(ss.Context(), info.FullMethod, nil); err != nil {
+			auditDenied(ss.Context(), auditLog, info.FullMethod, nil, err)
+			return err
+		}
+		return handler(srv, ss)
+	}
+}
+
+// auditDenied records a denied call
+func auditDenied(ctx context.Context, auditLog *audit.Logger, fullMethod string, req interface{}, err error) {
+	r := audit.Record{
+		Operation: Method(fullMethod),
+		Key:       requestKey(req),
+		Decision:  audit.DecisionDenied,
+		Error:     err.Error(),
+	}
+	r.Namespace, _ = namespaces.Namespace(ctx)
+	if c, ok := CallerFromContext(ctx); ok {
+		r.Caller = &audit.Caller{UID: c.UID, GID: c.GID, PID: c.PID}
+	}
+
+	log.G(ctx).WithFields(log.Fields{
+		"method":    fullMethod,
+		"namespace": r.Namespace,
+		"key":       r.Key,
+		"caller":    r.Caller,
+	}).Warn("denied snapshots API call")
+
+	if auditLog == nil {
+		return
+	}
+	if err := auditLog.Log(r); err != nil {
+		log.G(ctx).WithError(err).Error("failed to write audit record")
+	}
+}
+
+// requestKey returns the snapshot key a request is about, if any
+func requestKey(req interface{}) string {
+	switch r := req.(type) {
+	case interface{ GetKey() string }:
+		return r.GetKey()
+	case interface{ GetInfo() *snapshotsapi.Info }:
+		return r.GetInfo().GetName()
+	}
+	return ""
+}
@@ -0,0 +1,137 @@
+package authz
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	snapshotsapi "github.com/containerd/containerd/api/services/snapshots/v1"
+	"github.com/containerd/containerd/v2/pkg/namespaces"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	"github.com/ChengyuZhu6/guest-pull-snapshotter/audit"
+	"github.com/ChengyuZhu6/guest-pull-snapshotter/config"
+)
+
+func TestReadOnly(t *testing.T) {
+	for method, allowed := range map[string]bool{
+		"Stat":    true,
+		"List":    true,
+		"Mounts":  true,
+		"Usage":   true,
+		"Prepare": false,
+		"View":    false,
+		"Commit":  false,
+		"Remove":  false,
+		"Update":  false,
+		"Cleanup": false,
+	} {
+		err := ReadOnly{}.Authorize(context.Background(), snapshotsService+method, nil)
+		if allowed {
+			assert.NoError(t, err, method)
+		} else {
+			assert.Equal(t, codes.PermissionDenied, status.Code(err), method)
+		}
+	}
+
+	err := ReadOnly{}.Authorize(context.Background(), "/grpc.health.v1.Health/Check", nil)
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+}
+
+func TestInterceptors(t *testing.T) {
+	auditPath := filepath.Join(t.TempDir(), "audit.log")
+	auditLog, err := audit.Open(config.AuditConfig{Path: auditPath})
+	require.NoError(t, err)
+	defer auditLog.Close()
+
+	called := false
+	unary := UnaryServerInterceptor(ReadOnly{}, auditLog)
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		called = true
+		return req, nil
+	}
+
+	ctx := namespaces.WithNamespace(context.Background(), "k8s.io")
+	ctx = peer.NewContext(ctx, &peer.Peer{AuthInfo: AuthInfo{Caller: Caller{UID: 1000, GID: 1000, PID: 42}}})
+	req := &snapshotsapi.RemoveSnapshotRequest{Snapshotter: "guest-pull", Key: "sha256:layer"}
+	_, err = unary(ctx, req, &grpc.UnaryServerInfo{FullMethod: snapshotsService + "Remove"}, handler)
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	assert.False(t, called)
+
+	data, err := os.ReadFile(auditPath)
+	require.NoError(t, err)
+	var r audit.Record
+	require.NoError(t, json.Unmarshal(data, &r))
+	assert.Equal(t, "Remove", r.Operation)
+	assert.Equal(t, "sha256:layer", r.Key)
+	assert.Equal(t, "k8s.io", r.Namespace)
+	assert.Equal(t, audit.DecisionDenied, r.Decision)
+	assert.Equal(t, &audit.Caller{UID: 1000, GID: 1000, PID: 42}, r.Caller)
+
+	_, err = unary(context.Background(), nil, &grpc.UnaryServerInfo{FullMethod: snapshotsService + "Stat"}, handler)
+	require.NoError(t, err)
+	assert.True(t, called)
+}
+
+func TestPolicy(t *testing.T) {
+	policy := NewPolicy(config.AuthorizationConfig{Rules: []config.AuthorizationRule{
+		{UIDs: []uint32{0}, Methods: []string{"*"}},
+		{GIDs: []uint32{100}, Methods: []string{"Stat", "List", "Usage"}, Namespaces: []string{"k8s.io"}},
+	}})
+
+	call := func(caller *Caller, namespace, method string) error {
+		ctx := context.Background()
+		if namespace != "" {
+			ctx = namespaces.WithNamespace(ctx, namespace)
+		}
+		if caller != nil {
+			ctx = peer.NewContext(ctx, &peer.Peer{AuthInfo: AuthInfo{Caller: *caller}})
+		}
+		return policy.Authorize(ctx, snapshotsService+method, nil)
+	}
+	root := &Caller{UID: 0, GID: 0}
+	monitor := &Caller{UID: 1000, GID: 100}
+	other := &Caller{UID: 1001, GID: 1001}
+
+	assert.NoError(t, call(root, "default", "Remove"))
+	assert.NoError(t, call(monitor, "k8s.io", "Stat"))
+	assert.Equal(t, codes.PermissionDenied, status.Code(call(monitor, "k8s.io", "Remove")))
+	assert.Equal(t, codes.PermissionDenied, status.Code(call(monitor, "default", "Stat")))
+	assert.Equal(t, codes.PermissionDenied, status.Code(call(other, "k8s.io", "Stat")))
+	// Rules with uids or gids don't match callers without peer credentials
+	assert.Equal(t, codes.PermissionDenied, status.Code(call(nil, "k8s.io", "Stat")))
+
+	// Without rules every call is allowed
+	policy.Update(config.AuthorizationConfig{})
+	assert.NoError(t, call(other, "default", "Remove"))
+}
+
+func TestPeerCredentials(t *testing.T) {
+	l, err := net.Listen("unix", filepath.Join(t.TempDir(), "grpc.sock"))
+	require.NoError(t, err)
+	defer l.Close()
+
+	client, err := net.Dial("unix", l.Addr().String())
+	require.NoError(t, err)
+	defer client.Close()
+	conn, err := l.Accept()
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, info, err := PeerCredentials().ServerHandshake(conn)
+	require.NoError(t, err)
+	ctx := peer.NewContext(context.Background(), &peer.Peer{AuthInfo: info})
+	caller, ok := CallerFromContext(ctx)
+	require.True(t, ok)
+	assert.Equal(t, uint32(os.Getuid()), caller.UID)
+	assert.Equal(t, uint32(os.Getgid()), caller.GID)
+	assert.Equal(t, int32(os.Getpid()), caller.PID)
+}
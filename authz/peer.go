@@ -0,0 +1,98 @@
+package authz
+
+import (
+	"context"
+	"net"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+)
+
+// peerCredAuthType is the AuthType of the callers identified by SO_PEERCRED
+const peerCredAuthType = "peercred"
+
+// Caller is the process at the other end of a unix socket, as seen when it
+// connected
+type Caller struct {
+	UID uint32
+	GID uint32
+	PID int32
+}
+
+// AuthInfo is the credentials.AuthInfo of the connections of unix sockets
+// served with PeerCredentials
+type AuthInfo struct {
+	credentials.CommonAuthInfo
+	Caller Caller
+}
+
+// AuthType implements credentials.AuthInfo
+func (AuthInfo) AuthType() string {
+	return peerCredAuthType
+}
+
+// CallerFromContext returns the caller of a gRPC call made on a unix socket
+// served with PeerCredentials
+func CallerFromContext(ctx context.Context) (Caller, bool) {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return Caller{}, false
+	}
+	info, ok := p.AuthInfo.(AuthInfo)
+	return info.Caller, ok
+}
+
+// peerCredentials identifies the callers on unix sockets by the SO_PEERCRED
+// of their connection, without securing it
+type peerCredentials struct{}
+
+// PeerCredentials returns the transport credentials of a gRPC server on a
+// unix socket that identify callers with SO_PEERCRED
+func PeerCredentials() credentials.TransportCredentials {
+	return peerCredentials{}
+}
+
+func (peerCredentials) ServerHandshake(conn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return nil, nil, errors.Errorf("peer credentials require a unix socket, got %s", conn.RemoteAddr().Network())
+	}
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to get raw connection")
+	}
+
+	var cred *unix.Ucred
+	var credErr error
+	if err := raw.Control(func(fd uintptr) {
+		cred, credErr = unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	}); err != nil {
+		return nil, nil, errors.Wrap(err, "failed to control connection")
+	}
+	if credErr != nil {
+		return nil, nil, errors.Wrap(credErr, "failed to get peer credentials")
+	}
+
+	return conn, AuthInfo{
+		CommonAuthInfo: credentials.CommonAuthInfo{SecurityLevel: credentials.NoSecurity},
+		Caller:         Caller{UID: cred.Uid, GID: cred.Gid, PID: cred.Pid},
+	}, nil
+}
+
+func (peerCredentials) ClientHandshake(_ context.Context, _ string, conn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	return nil, nil, errors.New("peer credentials only apply to servers")
+}
+
+func (peerCredentials) Info() credentials.ProtocolInfo {
+	return credentials.ProtocolInfo{SecurityProtocol: peerCredAuthType}
+}
+
+func (c peerCredentials) Clone() credentials.TransportCredentials {
+	return c
+}
+
+func (peerCredentials) OverrideServerName(string) error {
+	return nil
+}
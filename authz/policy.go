@@ -0,0 +1,69 @@
+package authz
+
+import (
+	"context"
+	"slices"
+	"sync/atomic"
+
+	"github.com/containerd/containerd/v2/pkg/namespaces"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/ChengyuZhu6/guest-pull-snapshotter/config"
+)
+
+// Policy allows the calls matched by one of the authorization rules of the
+// configuration, or every call without rules
+type Policy struct {
+	rules atomic.Pointer[[]config.AuthorizationRule]
+}
+
+// NewPolicy returns the policy of cfg
+func NewPolicy(cfg config.AuthorizationConfig) *Policy {
+	p := &Policy{}
+	p.Update(cfg)
+	return p
+}
+
+// Update replaces the rules of the policy with those of cfg. Calls already
+// authorized are not checked again.
+func (p *Policy) Update(cfg config.AuthorizationConfig) {
+	rules := slices.Clone(cfg.Rules)
+	p.rules.Store(&rules)
+}
+
+// Authorize implements Authorizer
+func (p *Policy) Authorize(ctx context.Context, fullMethod string, _ interface{}) error {
+	rules := *p.rules.Load()
+	if len(rules) == 0 {
+		return nil
+	}
+
+	caller, identified := CallerFromContext(ctx)
+	method := Method(fullMethod)
+	namespace, _ := namespaces.Namespace(ctx)
+
+	for _, r := range rules {
+		if matchCaller(r, caller, identified) && matchMethod(r, method) &&
+			(len(r.Namespaces) == 0 || slices.Contains(r.Namespaces, namespace)) {
+			return nil
+		}
+	}
+
+	if identified {
+		return status.Errorf(codes.PermissionDenied, "%s in namespace %q is not allowed for uid %d gid %d",
+			method, namespace, caller.UID, caller.GID)
+	}
+	return status.Errorf(codes.PermissionDenied, "%s in namespace %q is not allowed", method, namespace)
+}
+
+func matchCaller(r config.AuthorizationRule, caller Caller, identified bool) bool {
+	if len(r.UIDs) == 0 && len(r.GIDs) == 0 {
+		return true
+	}
+	return identified && (slices.Contains(r.UIDs, caller.UID) || slices.Contains(r.GIDs, caller.GID))
+}
+
+func matchMethod(r config.AuthorizationRule, method string) bool {
+	return slices.Contains(r.Methods, "*") || slices.Contains(r.Methods, method)
+}
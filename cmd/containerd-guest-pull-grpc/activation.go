@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/coreos/go-systemd/v22/activation"
+)
+
+// grpcListenerName is the FileDescriptorName of the socket unit serving the
+// snapshots API
+const grpcListenerName = "grpc"
+
+// inheritedListeners returns the listeners passed by systemd socket
+// activation by name, if any. The sockets belong to systemd: closing them
+// does not remove them.
+func inheritedListeners() (map[string][]net.Listener, error) {
+	listeners, err := activation.ListenersWithNames()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get activation listeners: %w", err)
+	}
+	return listeners, nil
+}
+
+// takeListener removes and returns the inherited listener named name, or
+// else the one listening on addr
+func takeListener(listeners map[string][]net.Listener, name, network, addr string) (net.Listener, bool) {
+	if name != "" && len(listeners[name]) > 0 {
+		return removeListener(listeners, name, 0), true
+	}
+	for n, ls := range listeners {
+		for i, l := range ls {
+			if l.Addr().Network() == network && l.Addr().String() == addr {
+				return removeListener(listeners, n, i), true
+			}
+		}
+	}
+	return nil, false
+}
+
+// takeSoleListener removes and returns the inherited listener if only one is
+// left, whatever its name
+func takeSoleListener(listeners map[string][]net.Listener) (net.Listener, bool) {
+	if len(listeners) != 1 {
+		return nil, false
+	}
+	for n, ls := range listeners {
+		if len(ls) == 1 {
+			return removeListener(listeners, n, 0), true
+		}
+	}
+	return nil, false
+}
+
+// removeListener removes and returns the i-th listener named name
+func removeListener(listeners map[string][]net.Listener, name string, i int) net.Listener {
+	l := listeners[name][i]
+	listeners[name] = append(listeners[name][:i:i], listeners[name][i+1:]...)
+	if len(listeners[name]) == 0 {
+		delete(listeners, name)
+	}
+	return l
+}
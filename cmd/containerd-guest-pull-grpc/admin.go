@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/containerd/log"
+
+	"github.com/ChengyuZhu6/guest-pull-snapshotter/logging"
+	"github.com/ChengyuZhu6/guest-pull-snapshotter/metadata"
+	"github.com/ChengyuZhu6/guest-pull-snapshotter/snapshot"
+)
+
+// versionResponse is the reply of the admin endpoint to /metadata/version
+type versionResponse struct {
+	Version   int `json:"version"`
+	Supported int `json:"supported"`
+}
+
+// levelResponse is the reply of the admin endpoint to /log/level
+type levelResponse struct {
+	Level string `json:"level"`
+}
+
+// serveAdmin serves the admin endpoint on the unix socket addr until ctx is
+// done. It lets the maintenance commands reach the metadata stores, which the
+// running snapshotters hold locked, and change the log level. stores are
+// keyed by the name of their snapshotter, empty for the default one.
+func serveAdmin(ctx context.Context, addr string, stores map[string]snapshot.MetadataStore) error {
+	l, err := listenUnix(addr, socketOptions{uid: -1, gid: -1, mode: 0600, setMode: true})
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /log/level", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(levelResponse{Level: log.GetLevel().String()})
+	})
+	mux.HandleFunc("PUT /log/level", func(w http.ResponseWriter, r *http.Request) {
+		level, err := io.ReadAll(io.LimitReader(r.Body, 64))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := logging.SetLevel(strings.TrimSpace(string(level))); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.G(ctx).Warnf("log level set to %s through the admin endpoint", log.GetLevel())
+		json.NewEncoder(w).Encode(levelResponse{Level: log.GetLevel().String()})
+	})
+	if len(stores) > 0 {
+		serveMetadata(ctx, mux, stores)
+	}
+
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	go func() {
+		if err := srv.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.G(ctx).WithError(err).Error("admin server error")
+		}
+	}()
+
+	log.G(ctx).Infof("serving admin endpoint on %q", addr)
+	return nil
+}
+
+// serveMetadata adds the routes of the metadata stores to mux, which select
+// a store with the snapshotter query parameter
+func serveMetadata(ctx context.Context, mux *http.ServeMux, stores map[string]snapshot.MetadataStore) {
+	lookup := func(w http.ResponseWriter, r *http.Request) (snapshot.MetadataStore, bool) {
+		name := r.URL.Query().Get("snapshotter")
+		store, ok := stores[name]
+		if !ok {
+			http.Error(w, fmt.Sprintf("unknown snapshotter %q", name), http.StatusNotFound)
+		}
+		return store, ok
+	}
+
+	mux.HandleFunc("GET /metadata/snapshotters", func(w http.ResponseWriter, r *http.Request) {
+		names := make([]string, 0, len(stores))
+		for name := range stores {
+			names = append(names, name)
+		}
+		slices.Sort(names)
+		json.NewEncoder(w).Encode(names)
+	})
+	mux.HandleFunc("GET /metadata/backup", func(w http.ResponseWriter, r *http.Request) {
+		store, ok := lookup(w, r)
+		if !ok {
+			return
+		}
+		n, err := store.BackupMetadata(r.Context(), w, func(size int64) {
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+		})
+		if err != nil {
+			log.G(ctx).WithError(err).Error("failed to back up metadata store")
+			// Once the copy started, the client sees it end short of its
+			// length instead
+			if n == 0 {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+			}
+		}
+	})
+	mux.HandleFunc("GET /metadata/version", func(w http.ResponseWriter, r *http.Request) {
+		store, ok := lookup(w, r)
+		if !ok {
+			return
+		}
+		version, err := store.MetadataVersion(r.Context())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(versionResponse{Version: version, Supported: metadata.SchemaVersion})
+	})
+}
+
+// adminClient returns a client of the admin endpoint at addr, and false if no
+// snapshotter serves it
+func adminClient(ctx context.Context, addr string) (*http.Client, bool) {
+	if addr == "" {
+		return nil, false
+	}
+	dial := func(ctx context.Context, _, _ string) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, "unix", addr)
+	}
+
+	conn, err := dial(ctx, "", "")
+	if err != nil {
+		return nil, false
+	}
+	conn.Close()
+
+	return &http.Client{Transport: &http.Transport{DialContext: dial}}, true
+}
+
+// metadataPath returns the path of the admin endpoint serving route of the
+// metadata store of snapshotter, empty for the default one
+func metadataPath(route, snapshotter string) string {
+	if snapshotter == "" {
+		return route
+	}
+	return route + "?" + url.Values{"snapshotter": {snapshotter}}.Encode()
+}
+
+// adminGet fetches path from the admin endpoint
+func adminGet(ctx context.Context, client *http.Client, path string) (io.ReadCloser, error) {
+	return adminDo(ctx, client, http.MethodGet, path, nil)
+}
+
+// adminDo sends a request with body to path on the admin endpoint
+func adminDo(ctx context.Context, client *http.Client, method, path string, body io.Reader) (io.ReadCloser, error) {
+	resp, err := adminRequest(ctx, client, method, path, body)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// adminRequest sends a request with body to path on the admin endpoint and
+// returns its successful response
+func adminRequest(ctx context.Context, client *http.Client, method, path string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, "http://admin"+path, body)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		resp.Body.Close()
+		return nil, fmt.Errorf("admin endpoint: %s: %s", resp.Status, msg)
+	}
+	return resp, nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/ChengyuZhu6/guest-pull-snapshotter/config"
+	"github.com/ChengyuZhu6/guest-pull-snapshotter/containerdconfig"
+)
+
+const configUsage = `usage: containerd-guest-pull-grpc [flags] config <command> [args]
+
+Commands:
+  generate-containerd  print the containerd settings of the snapshotter, or
+                       patch them into a containerd config with --merge
+`
+
+// runConfig runs the configuration command args
+func runConfig(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, configUsage)
+		return fmt.Errorf("missing config command")
+	}
+	switch args[0] {
+	case "generate-containerd":
+		return runGenerateContainerd(ctx, args[1:])
+	default:
+		fmt.Fprint(os.Stderr, configUsage)
+		return fmt.Errorf("unknown config command %q", args[0])
+	}
+}
+
+// runGenerateContainerd prints the containerd settings that register the
+// snapshotter on --address and map the runtime handlers to it. The runtime
+// handlers of the volume section of the configuration file are mapped to their
+// own snapshotters instead.
+func runGenerateContainerd(_ context.Context, args []string) error {
+	fs := flag.NewFlagSet("generate-containerd", flag.ContinueOnError)
+	containerdVersion := fs.String("containerd-version", "",
+		"containerd version the settings are for, such as 1.7 or 2.0 (default 2.0, or the version of the merged file)")
+	handlers := fs.String("runtime-handlers", "kata-qemu-coco-dev",
+		"comma separated runtime handlers whose containers use the snapshotter")
+	proxyPlugin := fs.String("proxy-plugin", containerdconfig.DefaultProxyPlugin, "name of the snapshotter in containerd")
+	merge := fs.String("merge", "",
+		"containerd config file to patch in place instead of printing the settings")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("unexpected arguments %q", fs.Args())
+	}
+
+	s := containerdconfig.Settings{
+		Version:     3,
+		ProxyPlugin: *proxyPlugin,
+		Address:     *config.Address,
+	}
+	for _, h := range strings.Split(*handlers, ",") {
+		if h = strings.TrimSpace(h); h != "" {
+			s.Handlers = append(s.Handlers, h)
+		}
+	}
+
+	cfg, err := config.LoadConfig(*config.ConfigPath)
+	if err != nil {
+		return err
+	}
+	s.HandlerPlugins = cfg.Volume.HandlerSnapshotters()
+	for _, h := range cfg.Volume.RuntimeHandlers {
+		if !slices.Contains(s.Handlers, h.Name) {
+			s.Handlers = append(s.Handlers, h.Name)
+		}
+	}
+	if *containerdVersion != "" {
+		v, err := containerdconfig.FormatVersion(*containerdVersion)
+		if err != nil {
+			return err
+		}
+		s.Version = v
+	}
+
+	if *merge == "" {
+		data, err := containerdconfig.Generate(s)
+		if err != nil {
+			return err
+		}
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+
+	data, err := containerdconfig.Merge(*merge, s)
+	if err != nil {
+		return err
+	}
+	if err := containerdconfig.WriteFile(*merge, data); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Patched %s\n", *merge)
+	return nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/ChengyuZhu6/guest-pull-snapshotter/config"
+	"github.com/ChengyuZhu6/guest-pull-snapshotter/containerdconfig"
+	"github.com/ChengyuZhu6/guest-pull-snapshotter/doctor"
+	"github.com/ChengyuZhu6/guest-pull-snapshotter/snapshot"
+	"github.com/ChengyuZhu6/guest-pull-snapshotter/version"
+)
+
+// runDoctor checks that containerd, Kata and the host are set up for the
+// snapshotter, failing if one of the checks does
+func runDoctor(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("doctor", flag.ContinueOnError)
+	containerdConfig := fs.String("containerd-config", containerdconfig.DefaultPath,
+		"containerd configuration file to check")
+	proxyPlugin := fs.String("proxy-plugin", containerdconfig.DefaultProxyPlugin, "name of the snapshotter in containerd")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: containerd-guest-pull-grpc [flags] doctor [--containerd-config file] [--proxy-plugin name]")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	cfg, err := config.LoadConfig(*config.ConfigPath)
+	if err != nil {
+		return err
+	}
+	mountType := cfg.Mount.Type
+	if mountType == "" {
+		mountType = snapshot.MountType(cfg.Mount.Helper)
+	}
+
+	findings := doctor.Run(ctx, doctor.Options{
+		ContainerdConfig: *containerdConfig,
+		ProxyPlugin:      *proxyPlugin,
+		HandlerPlugins:   cfg.Volume.HandlerSnapshotters(),
+		Address:          *config.Address,
+		Root:             *config.RootDir,
+		Helper:           snapshot.MountHelper(mountType),
+		MountType:        mountType,
+		Version:          version.Version,
+		ShimDirs:         []string{"/opt/kata/bin"},
+	})
+	doctor.Print(os.Stdout, findings)
+	if doctor.HasErrors(findings) {
+		return fmt.Errorf("the setup has problems, see the fixes above")
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// instanceLockFile is the file under the root directory locked by the
+// snapshotter for as long as it runs, holding its PID
+const instanceLockFile = "instance.lock"
+
+// instanceLock is the lock of a snapshotter on its root directory
+type instanceLock struct {
+	f *os.File
+}
+
+// lockInstance locks the root directory, failing with the PID of the process
+// holding it if another snapshotter runs on it
+func lockInstance(root string) (*instanceLock, error) {
+	if err := os.MkdirAll(root, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create root directory %q: %w", root, err)
+	}
+
+	path := filepath.Join(root, instanceLockFile)
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open instance lock %q: %w", path, err)
+	}
+
+	if err := unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB); err != nil {
+		defer f.Close()
+		if errors.Is(err, unix.EWOULDBLOCK) {
+			pid := "unknown"
+			if data, err := os.ReadFile(path); err == nil && len(strings.TrimSpace(string(data))) > 0 {
+				pid = strings.TrimSpace(string(data))
+			}
+			return nil, fmt.Errorf("another snapshotter (pid %s) is running on %q, it holds %q", pid, root, path)
+		}
+		return nil, fmt.Errorf("failed to lock %q: %w", path, err)
+	}
+
+	if err := f.Truncate(0); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to write pid to %q: %w", path, err)
+	}
+	if _, err := f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to write pid to %q: %w", path, err)
+	}
+
+	return &instanceLock{f: f}, nil
+}
+
+// Close releases the lock, leaving the file in place as removing it would let
+// another process lock a new file while a third one still waits on this one
+func (l *instanceLock) Close() error {
+	return l.f.Close()
+}
+
+// socketOptions sets the owner and mode of a socket
+type socketOptions struct {
+	uid, gid int
+	mode     os.FileMode
+	setMode  bool
+}
+
+// listenUnix listens on the unix socket addr. A socket left by an instance
+// that is gone is replaced, but never one that another process serves.
+func listenUnix(addr string, opts socketOptions) (net.Listener, error) {
+	socketDir := filepath.Dir(addr)
+	if err := os.MkdirAll(socketDir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create directory %q: %w", socketDir, err)
+	}
+
+	if err := removeStaleSocket(addr); err != nil {
+		return nil, err
+	}
+
+	l, err := net.Listen("unix", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on socket %q: %w", addr, err)
+	}
+
+	if opts.uid != -1 || opts.gid != -1 {
+		if err := os.Chown(addr, opts.uid, opts.gid); err != nil {
+			l.Close()
+			return nil, fmt.Errorf("failed to chown socket %q: %w", addr, err)
+		}
+	}
+	if opts.setMode {
+		if err := os.Chmod(addr, opts.mode); err != nil {
+			l.Close()
+			return nil, fmt.Errorf("failed to chmod socket %q: %w", addr, err)
+		}
+	}
+
+	return l, nil
+}
+
+// removeStaleSocket removes the socket at addr unless a process accepts
+// connections on it
+func removeStaleSocket(addr string) error {
+	st, err := os.Lstat(addr)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to stat %q: %w", addr, err)
+	}
+	if st.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%q exists and is not a socket", addr)
+	}
+
+	conn, err := net.DialTimeout("unix", addr, time.Second)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("socket %q is served by another process", addr)
+	}
+
+	if err := os.Remove(addr); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove stale socket %q: %w", addr, err)
+	}
+	return nil
+}
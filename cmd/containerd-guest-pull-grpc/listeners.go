@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/containerd/log"
+	"google.golang.org/grpc/credentials"
+
+	"github.com/ChengyuZhu6/guest-pull-snapshotter/authz"
+	"github.com/ChengyuZhu6/guest-pull-snapshotter/config"
+)
+
+// endpoint is a listener of the gRPC server and the calls it allows
+type endpoint struct {
+	listener net.Listener
+
+	// authorizers deny calls, none allows every call
+	authorizers []authz.Authorizer
+
+	// creds identifies the callers on unix sockets and authenticates the
+	// clients of tcp listeners
+	creds credentials.TransportCredentials
+
+	// activated is set when the listener belongs to systemd
+	activated bool
+}
+
+// openEndpoints listens on the --address socket, which allows every call, and
+// on the configured listeners, all of them subject to policy. Listeners
+// inherited from systemd socket activation are used in place of the sockets
+// they listen on.
+func openEndpoints(ctx context.Context, addr string, cfg *config.Config, policy *authz.Policy) (_ []endpoint, err error) {
+	var endpoints, extra []endpoint
+	defer func() {
+		if err != nil {
+			for _, e := range append(endpoints, extra...) {
+				if e.listener != nil {
+					e.listener.Close()
+				}
+			}
+		}
+	}()
+
+	inherited, err := inheritedListeners()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		for name, ls := range inherited {
+			for _, l := range ls {
+				log.G(ctx).Warnf("ignoring inherited listener %q on %s", name, l.Addr())
+				l.Close()
+			}
+		}
+	}()
+
+	primary, activated := takeListener(inherited, grpcListenerName, config.NetworkUnix, addr)
+	extra = make([]endpoint, len(cfg.Listeners))
+	for i, lc := range cfg.Listeners {
+		if l, ok := takeListener(inherited, "", lc.Network, lc.Address); ok {
+			extra[i] = endpoint{listener: l, activated: true}
+		}
+	}
+	if !activated {
+		primary, activated = takeSoleListener(inherited)
+	}
+
+	if !activated {
+		mode, setMode, err := cfg.GRPC.FileMode()
+		if err != nil {
+			return nil, err
+		}
+		primary, err = listenUnix(addr, socketOptions{uid: cfg.GRPC.UID, gid: cfg.GRPC.GID, mode: mode, setMode: setMode})
+		if err != nil {
+			return nil, err
+		}
+	}
+	endpoints = append(endpoints, endpoint{
+		listener:    primary,
+		authorizers: []authz.Authorizer{policy},
+		creds:       authz.PeerCredentials(),
+		activated:   activated,
+	})
+
+	for i, lc := range cfg.Listeners {
+		e := extra[i]
+		if lc.Access == config.AccessReadOnly {
+			e.authorizers = append(e.authorizers, authz.ReadOnly{})
+		}
+		e.authorizers = append(e.authorizers, policy)
+		if lc.Network == config.NetworkTCP {
+			tlsConfig, err := serverTLSConfig(lc)
+			if err != nil {
+				return nil, err
+			}
+			e.creds = credentials.NewTLS(tlsConfig)
+		} else {
+			e.creds = authz.PeerCredentials()
+		}
+		if e.listener == nil {
+			e.listener, err = listen(lc)
+			if err != nil {
+				return nil, err
+			}
+		}
+		endpoints = append(endpoints, e)
+		extra[i].listener = nil
+	}
+
+	return endpoints, nil
+}
+
+// listen listens on a configured listener
+func listen(lc config.ListenerConfig) (net.Listener, error) {
+	if lc.Network == config.NetworkTCP {
+		l, err := net.Listen("tcp", lc.Address)
+		if err != nil {
+			return nil, fmt.Errorf("failed to listen on %q: %w", lc.Address, err)
+		}
+		return l, nil
+	}
+
+	opts := socketOptions{uid: -1, gid: -1}
+	if lc.UID != nil {
+		opts.uid = *lc.UID
+	}
+	if lc.GID != nil {
+		opts.gid = *lc.GID
+	}
+	mode, setMode, err := lc.FileMode()
+	if err != nil {
+		return nil, err
+	}
+	opts.mode, opts.setMode = mode, setMode
+	return listenUnix(lc.Address, opts)
+}
+
+// serverTLSConfig returns the TLS configuration of a tcp listener, which
+// requires client certificates signed by its CA
+func serverTLSConfig(lc config.ListenerConfig) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(lc.Cert, lc.Key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load certificate of listener %q: %w", lc.Address, err)
+	}
+
+	pem, err := os.ReadFile(lc.CA)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA of listener %q: %w", lc.Address, err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificate found in CA %q of listener %q", lc.CA, lc.Address)
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ChengyuZhu6/guest-pull-snapshotter/config"
+)
+
+// writeCert writes a certificate and its key signed by parent, or
+// self-signed if parent is nil, and returns them
+func writeCert(t *testing.T, dir, name string, parent *tls.Certificate) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	signer, signerKey := template, any(key)
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+	} else {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	require.NoError(t, os.WriteFile(filepath.Join(dir, name+".pem"), certPEM, 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, name+"-key.pem"), keyPEM, 0600))
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	require.NoError(t, err)
+	return cert
+}
+
+func TestServerTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	ca := writeCert(t, dir, "ca", nil)
+	writeCert(t, dir, "server", &ca)
+	client := writeCert(t, dir, "client", &ca)
+	rogueCA := writeCert(t, dir, "rogue-ca", nil)
+	rogue := writeCert(t, dir, "rogue", &rogueCA)
+
+	tlsConfig, err := serverTLSConfig(config.ListenerConfig{
+		Network: config.NetworkTCP,
+		Address: "127.0.0.1:0",
+		CA:      filepath.Join(dir, "ca.pem"),
+		Cert:    filepath.Join(dir, "server.pem"),
+		Key:     filepath.Join(dir, "server-key.pem"),
+	})
+	require.NoError(t, err)
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", tlsConfig)
+	require.NoError(t, err)
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.(*tls.Conn).Handshake()
+			conn.Write([]byte("ok"))
+			conn.Close()
+		}
+	}()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Leaf)
+	dial := func(certs ...tls.Certificate) error {
+		conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{RootCAs: roots, Certificates: certs})
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		// TLS 1.3 servers report rejected client certificates on the first read
+		_, err = conn.Read(make([]byte, 2))
+		return err
+	}
+
+	assert.NoError(t, dial(client))
+	assert.Error(t, dial(), "client without certificate")
+	assert.Error(t, dial(rogue), "client certificate from another CA")
+}
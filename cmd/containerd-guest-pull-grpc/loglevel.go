@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/ChengyuZhu6/guest-pull-snapshotter/config"
+)
+
+// runLogLevel prints the log level of the running snapshotter, or sets it to
+// args[0]
+func runLogLevel(ctx context.Context, args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("usage: containerd-guest-pull-grpc [flags] log-level [level]")
+	}
+	client, ok := adminClient(ctx, *config.AdminAddress)
+	if !ok {
+		return fmt.Errorf("no snapshotter serves the admin endpoint %q", *config.AdminAddress)
+	}
+
+	method, body := http.MethodGet, ""
+	if len(args) == 1 {
+		method, body = http.MethodPut, args[0]
+	}
+	resp, err := adminDo(ctx, client, method, "/log/level", strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Close()
+
+	var level levelResponse
+	if err := json.NewDecoder(resp).Decode(&level); err != nil {
+		return fmt.Errorf("failed to decode log level: %w", err)
+	}
+	fmt.Println(level.Level)
+	return nil
+}
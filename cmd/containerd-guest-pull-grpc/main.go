@@ -2,37 +2,54 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"net"
 	"os"
 	"os/signal"
 	"path/filepath"
 	"syscall"
+	"time"
 
 	snapshotsapi "github.com/containerd/containerd/api/services/snapshots/v1"
-	"github.com/containerd/containerd/v2/contrib/snapshotservice"
+	"github.com/containerd/containerd/v2/core/content"
+	contentproxy "github.com/containerd/containerd/v2/core/content/proxy"
 	"github.com/containerd/containerd/v2/core/snapshots"
 	"github.com/containerd/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
 
+	"github.com/ChengyuZhu6/guest-pull-snapshotter/audit"
+	"github.com/ChengyuZhu6/guest-pull-snapshotter/authz"
 	"github.com/ChengyuZhu6/guest-pull-snapshotter/config"
+	"github.com/ChengyuZhu6/guest-pull-snapshotter/containerdconfig"
+	guestpull "github.com/ChengyuZhu6/guest-pull-snapshotter/guest-pull"
+	"github.com/ChengyuZhu6/guest-pull-snapshotter/logging"
+	"github.com/ChengyuZhu6/guest-pull-snapshotter/metrics"
 	"github.com/ChengyuZhu6/guest-pull-snapshotter/snapshot"
+	"github.com/ChengyuZhu6/guest-pull-snapshotter/tracing"
 	"github.com/ChengyuZhu6/guest-pull-snapshotter/version"
 )
 
 func main() {
 	flag.Parse()
 
-	if err := log.SetFormat(log.JSONFormat); err != nil {
-		fmt.Fprintf(os.Stderr, "failed to set log format: %v\n", err)
-		os.Exit(1)
-	}
-
-	if err := log.SetLevel(*config.LogLevel); err != nil {
-		fmt.Fprintf(os.Stderr, "failed to set log level: %v\n", err)
+	logFile, err := logging.Setup(logging.Options{
+		Level:      *config.LogLevel,
+		Format:     *config.LogFormat,
+		File:       *config.LogFile,
+		MaxSize:    *config.LogMaxSize,
+		MaxBackups: *config.LogMaxBackups,
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to set up logging: %v\n", err)
 		os.Exit(1)
 	}
+	defer logFile.Close()
 
 	if *config.PrintVersion {
 		fmt.Printf("containerd-guest-pull-grpc %s %s (built %s)\n",
@@ -46,73 +63,341 @@ func main() {
 	defer cancel()
 	ctx = log.WithLogger(ctx, log.L)
 
+	if flag.NArg() > 0 {
+		if err := runCommand(ctx, flag.Args()); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	signalCh := make(chan os.Signal, 1)
-	signal.Notify(signalCh, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(signalCh, syscall.SIGINT, syscall.SIGTERM, syscall.SIGUSR1, syscall.SIGHUP)
 
+	// A reload requested while one runs or before the snapshotter is up is
+	// applied once it can be
+	reloadCh := make(chan struct{}, 1)
 	go func() {
-		sig := <-signalCh
-		log.G(ctx).Infof("Received signal %s, shutting down...", sig)
-		cancel()
+		for sig := range signalCh {
+			switch sig {
+			case syscall.SIGUSR1:
+				log.G(ctx).Warnf("Received signal %s, log level set to %s", sig, logging.CycleLevel())
+			case syscall.SIGHUP:
+				log.G(ctx).Infof("Received signal %s, reloading config", sig)
+				select {
+				case reloadCh <- struct{}{}:
+				default:
+				}
+			default:
+				log.G(ctx).Infof("Received signal %s, shutting down...", sig)
+				cancel()
+				return
+			}
+		}
 	}()
 
-	snapshotter, err := createSnapshotter(ctx, *config.RootDir)
+	cfg, err := config.LoadConfig(*config.ConfigPath)
+	if err != nil {
+		log.G(ctx).WithError(err).Fatal("failed to load config")
+	}
+
+	lock, err := lockInstance(*config.RootDir)
+	if err != nil {
+		log.G(ctx).WithError(err).Fatal("failed to lock root directory")
+	}
+	defer lock.Close()
+
+	shutdownTracing, err := tracing.Setup(ctx, cfg.Tracing)
+	if err != nil {
+		log.G(ctx).WithError(err).Fatal("failed to set up tracing")
+	}
+	defer func() {
+		// ctx is canceled by then, flushing the spans needs its own deadline
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := shutdownTracing(shutdownCtx); err != nil {
+			log.G(ctx).WithError(err).Warn("failed to flush traces")
+		}
+	}()
+
+	var auditLog *audit.Logger
+	if cfg.Audit.Path != "" {
+		auditLog, err = audit.Open(cfg.Audit)
+		if err != nil {
+			log.G(ctx).WithError(err).Fatal("failed to open audit log")
+		}
+		defer auditLog.Close()
+	}
+
+	registry := metrics.NewRegistry()
+	sns, closers, err := createSnapshotter(ctx, *config.RootDir, cfg, registry, auditLog)
 	if err != nil {
 		log.G(ctx).WithError(err).Fatal("failed to create snapshotter")
 	}
-	defer snapshotter.Close()
+	defer sns.Close()
+	for _, c := range closers {
+		defer c.Close()
+	}
+
+	if *config.AdminAddress != "" {
+		if err := serveAdmin(ctx, *config.AdminAddress, sns.metadataStores()); err != nil {
+			log.G(ctx).WithError(err).Fatal("failed to serve admin endpoint")
+		}
+	}
+
+	if cfg.Metrics.Address != "" {
+		if err := metrics.Serve(ctx, cfg.Metrics.Address, registry); err != nil {
+			log.G(ctx).WithError(err).Fatal("failed to serve metrics")
+		}
+	}
 
-	rpc := grpc.NewServer()
-	if err := startServer(ctx, rpc, *config.Address, snapshotter, cancel); err != nil {
+	policy := authz.NewPolicy(cfg.Authorization)
+	var reloadable reloadAll
+	for _, sn := range sns.all() {
+		if rl, ok := sn.(snapshot.Reloadable); ok {
+			reloadable = append(reloadable, rl)
+		}
+	}
+	r, err := newReloader(*config.ConfigPath, cfg, reloadable, policy, registry)
+	if err != nil {
+		log.G(ctx).WithError(err).Fatal("failed to set up config reload")
+	}
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-reloadCh:
+				r.reload(ctx)
+			}
+		}
+	}()
+
+	endpoints, err := openEndpoints(ctx, *config.Address, cfg, policy)
+	if err != nil {
+		log.G(ctx).WithError(err).Fatal("failed to listen")
+	}
+	if err := startServer(ctx, endpoints, sns, auditLog, cancel); err != nil {
 		log.G(ctx).WithError(err).Fatal("server error")
 	}
 
 	log.G(ctx).Info("service exited successfully")
 }
 
-// createSnapshotter creates and initializes a snapshotter
-func createSnapshotter(ctx context.Context, rootDir string) (snapshots.Snapshotter, error) {
+// runCommand runs the maintenance command args instead of the daemon
+func runCommand(ctx context.Context, args []string) error {
+	switch args[0] {
+	case "metadata":
+		return runMetadata(ctx, args[1:])
+	case "log-level":
+		return runLogLevel(ctx, args[1:])
+	case "doctor":
+		return runDoctor(ctx, args[1:])
+	case "config":
+		return runConfig(ctx, args[1:])
+	default:
+		return fmt.Errorf("unknown command %q", args[0])
+	}
+}
+
+// snapshotters are the default snapshotter and those of the runtime handlers,
+// by their name in containerd
+type snapshotters struct {
+	fallback snapshots.Snapshotter
+	handlers map[string]snapshots.Snapshotter
+}
+
+// all returns every snapshotter, the default one first
+func (s *snapshotters) all() []snapshots.Snapshotter {
+	all := []snapshots.Snapshotter{s.fallback}
+	for _, sn := range s.handlers {
+		all = append(all, sn)
+	}
+	return all
+}
+
+// metadataStores returns the metadata stores of the snapshotters by name, the
+// one of the default snapshotter under the empty name
+func (s *snapshotters) metadataStores() map[string]snapshot.MetadataStore {
+	stores := map[string]snapshot.MetadataStore{}
+	if store, ok := s.fallback.(snapshot.MetadataStore); ok {
+		stores[""] = store
+	}
+	for name, sn := range s.handlers {
+		if store, ok := sn.(snapshot.MetadataStore); ok {
+			stores[name] = store
+		}
+	}
+	return stores
+}
+
+// Close closes every snapshotter
+func (s *snapshotters) Close() error {
+	var errs []error
+	for _, sn := range s.all() {
+		if err := sn.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// createSnapshotter creates and initializes the default snapshotter and one
+// per configured runtime handler, along with the connections they use that
+// must be closed after them. The snapshotters of runtime handlers keep their
+// snapshots under <root>/snapshotters/<name>, and the metrics of each one are
+// labelled with its name.
+func createSnapshotter(ctx context.Context, rootDir string, cfg *config.Config, registry prometheus.Registerer, auditLog *audit.Logger) (*snapshotters, []io.Closer, error) {
+	var closers []io.Closer
 	opts := []snapshot.Opt{
-		snapshot.WithRootDirectory(rootDir),
+		snapshot.WithMountHelper(cfg.Mount.Helper),
+		snapshot.WithMountType(cfg.Mount.Type),
+		snapshot.WithMountSource(cfg.Mount.Source),
+	}
+	if *config.Rootless {
+		opts = append(opts, snapshot.WithRootless())
 	}
 
-	snapshotter, err := snapshot.NewSnapshotter(ctx, opts...)
+	reloadable, err := reloadableOpts(cfg)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create snapshotter: %w", err)
+		return nil, nil, err
 	}
-	return snapshotter, nil
-}
+	opts = append(opts, reloadable...)
 
-// startServer starts the gRPC server and handles signals
-func startServer(ctx context.Context, rpc *grpc.Server, addr string, snapshotter snapshots.Snapshotter, cancel context.CancelFunc) error {
-	snsvc := snapshotservice.FromSnapshotter(snapshotter)
-	snapshotsapi.RegisterSnapshotsServer(rpc, snsvc)
+	var store content.Store
+	if cfg.NeedsContainerd() {
+		conn, err := grpc.NewClient("unix://"+cfg.Containerd.Address,
+			grpc.WithTransportCredentials(insecure.NewCredentials()),
+			grpc.WithStatsHandler(otelgrpc.NewClientHandler()))
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to connect to containerd at %q: %w", cfg.Containerd.Address, err)
+		}
+		closers = append(closers, conn)
+		store = contentproxy.NewContentStore(conn)
+	}
 
-	// Prepare socket directory
-	socketDir := filepath.Dir(addr)
-	if err := os.MkdirAll(socketDir, 0700); err != nil {
-		return fmt.Errorf("failed to create directory %q: %w", socketDir, err)
+	if cfg.Usage.Report != config.UsageReportHost {
+		opts = append(opts,
+			snapshot.WithLayerUsage(snapshot.LayerUsage(cfg.Usage.Report)),
+			snapshot.WithContentStore(store))
 	}
 
-	// Clean up existing socket
-	os.RemoveAll(addr) // Ignore error as it might not exist
+	if cfg.IdentityStub.Enable {
+		var sources []snapshot.IdentitySource
+		if cfg.IdentityStub.SourceDir != "" {
+			sources = append(sources, snapshot.NewLocalIdentitySource(cfg.IdentityStub.SourceDir))
+		}
+		if cfg.IdentityStub.ContentStore {
+			sources = append(sources, snapshot.NewContentIdentitySource(store))
+		}
+		opts = append(opts, snapshot.WithIdentityStub(sources...))
+	}
+
+	if auditLog != nil {
+		opts = append(opts, snapshot.WithAuditLog(auditLog))
+	}
+
+	s := &snapshotters{handlers: map[string]snapshots.Snapshotter{}}
+	fail := func(err error) (*snapshotters, []io.Closer, error) {
+		for _, sn := range s.handlers {
+			sn.Close()
+		}
+		if s.fallback != nil {
+			s.fallback.Close()
+		}
+		for _, c := range closers {
+			c.Close()
+		}
+		return nil, nil, err
+	}
 
-	listener, err := net.Listen("unix", addr)
+	encoder, err := guestpull.NewEncoder(cfg.Volume.Encoder, cfg.Volume.Profile)
+	if err != nil {
+		return fail(err)
+	}
+	s.fallback, err = snapshot.NewSnapshotter(ctx, append(opts,
+		snapshot.WithRootDirectory(rootDir),
+		snapshot.WithMetrics(snapshotterRegisterer(registry, containerdconfig.DefaultProxyPlugin)),
+		snapshot.WithVolumeEncoder(encoder))...)
 	if err != nil {
-		return fmt.Errorf("failed to listen on socket %q: %w", addr, err)
+		return fail(fmt.Errorf("failed to create snapshotter: %w", err))
 	}
 
-	// Start server
-	log.G(ctx).Infof("starting gRPC server on %q", addr)
-	go func() {
-		if err := rpc.Serve(listener); err != nil && ctx.Err() == nil {
-			log.G(ctx).WithError(err).Error("server error")
-			cancel()
+	for _, h := range cfg.Volume.RuntimeHandlers {
+		h = h.Resolve(cfg.Volume)
+		encoder, err := guestpull.NewEncoder(h.Encoder, h.Profile)
+		if err != nil {
+			return fail(err)
 		}
-	}()
+		sn, err := snapshot.NewSnapshotter(ctx, append(opts,
+			snapshot.WithRootDirectory(handlerRootDir(rootDir, h.Snapshotter)),
+			snapshot.WithMetrics(snapshotterRegisterer(registry, h.Snapshotter)),
+			snapshot.WithVolumeEncoder(encoder))...)
+		if err != nil {
+			return fail(fmt.Errorf("failed to create snapshotter %s of runtime handler %s: %w", h.Snapshotter, h.Name, err))
+		}
+		s.handlers[h.Snapshotter] = sn
+		log.G(ctx).WithFields(log.Fields{
+			"runtime_handler": h.Name,
+			"snapshotter":     h.Snapshotter,
+			"encoder":         h.Encoder,
+			"profile":         h.Profile,
+		}).Info("created snapshotter of runtime handler")
+	}
+	return s, closers, nil
+}
+
+// handlerRootDir returns the root directory of the snapshotter of a runtime
+// handler named name
+func handlerRootDir(rootDir, name string) string {
+	return filepath.Join(rootDir, "snapshotters", name)
+}
+
+// snapshotterRegisterer labels the metrics registered with registry by the
+// snapshotter named name
+func snapshotterRegisterer(registry prometheus.Registerer, name string) prometheus.Registerer {
+	return prometheus.WrapRegistererWith(prometheus.Labels{"snapshotter": name}, registry)
+}
+
+// startServer serves the snapshots API on endpoints until ctx is done,
+// recording denied calls in auditLog. Activated listeners belong to systemd
+// and outlive the server.
+func startServer(ctx context.Context, endpoints []endpoint, sns *snapshotters, auditLog *audit.Logger, cancel context.CancelFunc) error {
+	snsvc := newRouter(sns.fallback, sns.handlers)
+
+	var servers []*grpc.Server
+	for _, e := range endpoints {
+		opts := []grpc.ServerOption{grpc.StatsHandler(otelgrpc.NewServerHandler())}
+		if e.creds != nil {
+			opts = append(opts, grpc.Creds(e.creds))
+		}
+		for _, a := range e.authorizers {
+			opts = append(opts,
+				grpc.ChainUnaryInterceptor(authz.UnaryServerInterceptor(a, auditLog)),
+				grpc.ChainStreamInterceptor(authz.StreamServerInterceptor(a, auditLog)))
+		}
+		rpc := grpc.NewServer(opts...)
+		snapshotsapi.RegisterSnapshotsServer(rpc, snsvc)
+		servers = append(servers, rpc)
+
+		if e.activated {
+			log.G(ctx).Infof("starting gRPC server on socket-activated %s %q", e.listener.Addr().Network(), e.listener.Addr())
+		} else {
+			log.G(ctx).Infof("starting gRPC server on %s %q", e.listener.Addr().Network(), e.listener.Addr())
+		}
+		go func(l net.Listener) {
+			if err := rpc.Serve(l); err != nil && ctx.Err() == nil {
+				log.G(ctx).WithError(err).Error("server error")
+				cancel()
+			}
+		}(e.listener)
+	}
 
 	<-ctx.Done()
 	log.G(ctx).Info("context canceled")
-	rpc.Stop()
+	for _, rpc := range servers {
+		rpc.Stop()
+	}
 
 	return nil
 }
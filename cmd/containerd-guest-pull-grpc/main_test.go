@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/containerd/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ChengyuZhu6/guest-pull-snapshotter/metadata"
+	"github.com/ChengyuZhu6/guest-pull-snapshotter/snapshot"
+)
+
+func TestLockInstance(t *testing.T) {
+	root := t.TempDir()
+
+	lock, err := lockInstance(root)
+	require.NoError(t, err)
+
+	_, err = lockInstance(root)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), fmt.Sprintf("pid %d", os.Getpid()))
+
+	require.NoError(t, lock.Close())
+	lock, err = lockInstance(root)
+	require.NoError(t, err)
+	require.NoError(t, lock.Close())
+}
+
+func TestListenUnix(t *testing.T) {
+	dir := t.TempDir()
+	addr := filepath.Join(dir, "sub", "grpc.sock")
+	opts := socketOptions{uid: -1, gid: -1, mode: 0660, setMode: true}
+
+	l, err := listenUnix(addr, opts)
+	require.NoError(t, err)
+
+	st, err := os.Stat(addr)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0660), st.Mode().Perm())
+
+	// A served socket is never taken over
+	_, err = listenUnix(addr, opts)
+	assert.ErrorContains(t, err, "served by another process")
+
+	// A stale socket is
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	require.NoError(t, l.Close())
+	l, err = listenUnix(addr, opts)
+	require.NoError(t, err)
+	require.NoError(t, l.Close())
+
+	file := filepath.Join(dir, "file")
+	require.NoError(t, os.WriteFile(file, nil, 0600))
+	_, err = listenUnix(file, opts)
+	assert.ErrorContains(t, err, "not a socket")
+	assert.FileExists(t, file)
+}
+
+func TestTakeListener(t *testing.T) {
+	dir := t.TempDir()
+	listen := func(name string) net.Listener {
+		l, err := net.Listen("unix", filepath.Join(dir, name))
+		require.NoError(t, err)
+		t.Cleanup(func() { l.Close() })
+		return l
+	}
+	grpcListener := listen("grpc.sock")
+	other := listen("other.sock")
+
+	listeners := map[string][]net.Listener{"grpc": {grpcListener}, "other": {other}}
+	l, ok := takeListener(listeners, grpcListenerName, "unix", "")
+	require.True(t, ok)
+	assert.Equal(t, grpcListener, l)
+	assert.NotContains(t, listeners, "grpc")
+
+	// Unnamed sockets are named after their unit
+	listeners = map[string][]net.Listener{"guest-pull-snapshotter.socket": {other, grpcListener}}
+	l, ok = takeListener(listeners, grpcListenerName, "unix", filepath.Join(dir, "grpc.sock"))
+	require.True(t, ok)
+	assert.Equal(t, grpcListener, l)
+	assert.Equal(t, []net.Listener{other}, listeners["guest-pull-snapshotter.socket"])
+
+	_, ok = takeListener(listeners, grpcListenerName, "unix", filepath.Join(dir, "missing.sock"))
+	assert.False(t, ok)
+	l, ok = takeSoleListener(listeners)
+	require.True(t, ok)
+	assert.Equal(t, other, l)
+	assert.Empty(t, listeners)
+
+	_, ok = takeSoleListener(listeners)
+	assert.False(t, ok)
+}
+
+func TestAdminLogLevel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	defer log.SetLevel(log.GetLevel().String())
+
+	addr := filepath.Join(t.TempDir(), "admin.sock")
+	require.NoError(t, serveAdmin(ctx, addr, nil))
+	client, ok := adminClient(ctx, addr)
+	require.True(t, ok)
+
+	level := func(method, body string) (string, error) {
+		resp, err := adminDo(ctx, client, method, "/log/level", strings.NewReader(body))
+		if err != nil {
+			return "", err
+		}
+		defer resp.Close()
+		var l levelResponse
+		err = json.NewDecoder(resp).Decode(&l)
+		return l.Level, err
+	}
+
+	l, err := level(http.MethodPut, "debug\n")
+	require.NoError(t, err)
+	assert.Equal(t, "debug", l)
+	assert.Equal(t, log.DebugLevel, log.GetLevel())
+
+	l, err = level(http.MethodGet, "")
+	require.NoError(t, err)
+	assert.Equal(t, "debug", l)
+
+	_, err = level(http.MethodPut, "loud")
+	assert.ErrorContains(t, err, "400")
+
+	_, err = adminGet(ctx, client, "/metadata/version")
+	assert.ErrorContains(t, err, "404")
+}
+
+// fakeMetadataStore reports a fixed schema version
+type fakeMetadataStore int
+
+func (s fakeMetadataStore) BackupMetadata(ctx context.Context, w io.Writer, size func(int64)) (int64, error) {
+	backup := fmt.Sprintf("store %d", s)
+	size(int64(len(backup)))
+	n, err := io.WriteString(w, backup)
+	return int64(n), err
+}
+
+func (s fakeMetadataStore) MetadataVersion(ctx context.Context) (int, error) {
+	return int(s), nil
+}
+
+// failingMetadataStore fails its backups after writing half of them
+type failingMetadataStore struct {
+	fakeMetadataStore
+}
+
+func (s failingMetadataStore) BackupMetadata(ctx context.Context, w io.Writer, size func(int64)) (int64, error) {
+	size(1 << 20)
+	n, err := w.Write(make([]byte, 1<<19))
+	if err != nil {
+		return int64(n), err
+	}
+	return int64(n), errors.New("simulated bolt failure")
+}
+
+func TestAdminMetadataStores(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	root := t.TempDir()
+	addr := filepath.Join(root, "admin.sock")
+	require.NoError(t, serveAdmin(ctx, addr, map[string]snapshot.MetadataStore{
+		"":                fakeMetadataStore(1),
+		"guest-pull-kata": fakeMetadataStore(2),
+	}))
+	client, ok := adminClient(ctx, addr)
+	require.True(t, ok)
+
+	stores, err := servedMetadataStores(ctx, client, root, "")
+	require.NoError(t, err)
+	assert.Equal(t, []metadataStore{
+		{path: metadata.Path(root)},
+		{snapshotter: "guest-pull-kata", path: metadata.Path(filepath.Join(root, "snapshotters", "guest-pull-kata"))},
+	}, stores)
+
+	dest := filepath.Join(root, "backup.db")
+	for _, store := range stores {
+		require.NoError(t, backupMetadata(ctx, client, store, dest+"."+store.snapshotter, 0))
+	}
+	b, err := os.ReadFile(dest + ".guest-pull-kata")
+	require.NoError(t, err)
+	assert.Equal(t, "store 2", string(b))
+
+	_, err = servedMetadataStores(ctx, client, root, "guest-pull-runc")
+	assert.Error(t, err)
+	_, err = adminGet(ctx, client, metadataPath("/metadata/version", "guest-pull-runc"))
+	assert.ErrorContains(t, err, "404")
+}
+
+func TestAdminMetadataBackupFailure(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	root := t.TempDir()
+	addr := filepath.Join(root, "admin.sock")
+	require.NoError(t, serveAdmin(ctx, addr, map[string]snapshot.MetadataStore{
+		"": failingMetadataStore{},
+	}))
+	client, ok := adminClient(ctx, addr)
+	require.True(t, ok)
+
+	// A backup failing partway through leaves no file behind
+	dest := filepath.Join(root, "backup.db")
+	err := backupMetadata(ctx, client, metadataStore{path: metadata.Path(root)}, dest, 0)
+	assert.Error(t, err)
+	assert.NoFileExists(t, dest)
+}
+
+func TestMetadataStores(t *testing.T) {
+	root := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "snapshotters", "guest-pull-kata"), 0700))
+	require.NoError(t, os.WriteFile(metadata.Path(filepath.Join(root, "snapshotters", "guest-pull-kata")), nil, 0600))
+	// Directories without a store are skipped
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "snapshotters", "empty"), 0700))
+
+	stores, err := metadataStores(root, "")
+	require.NoError(t, err)
+	assert.Equal(t, []metadataStore{
+		{path: metadata.Path(root)},
+		{snapshotter: "guest-pull-kata", path: metadata.Path(filepath.Join(root, "snapshotters", "guest-pull-kata"))},
+	}, stores)
+
+	stores, err = metadataStores(root, "guest-pull-kata")
+	require.NoError(t, err)
+	assert.Len(t, stores, 1)
+
+	_, err = metadataStores(root, "empty")
+	assert.Error(t, err)
+	_, err = metadataStores(root, "..")
+	assert.Error(t, err)
+}
+
+func TestSnapshotterMetrics(t *testing.T) {
+	ctx := context.Background()
+	registry := prometheus.NewRegistry()
+	for _, name := range []string{"guest-pull", "guest-pull-kata"} {
+		sn, err := snapshot.NewSnapshotter(ctx, snapshot.WithRootDirectory(t.TempDir()),
+			snapshot.WithMetrics(snapshotterRegisterer(registry, name)))
+		require.NoError(t, err)
+		defer sn.Close()
+	}
+
+	families, err := registry.Gather()
+	require.NoError(t, err)
+	snapshotters := map[string]bool{}
+	for _, f := range families {
+		for _, m := range f.GetMetric() {
+			for _, l := range m.GetLabel() {
+				if l.GetName() == "snapshotter" {
+					snapshotters[l.GetValue()] = true
+				}
+			}
+		}
+	}
+	assert.Equal(t, map[string]bool{"guest-pull": true, "guest-pull-kata": true}, snapshotters)
+}
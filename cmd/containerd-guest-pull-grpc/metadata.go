@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/ChengyuZhu6/guest-pull-snapshotter/config"
+	"github.com/ChengyuZhu6/guest-pull-snapshotter/metadata"
+)
+
+const metadataUsage = `usage: containerd-guest-pull-grpc [flags] metadata <command> [args]
+
+Commands:
+  backup <file>  write a consistent copy of the metadata store to file
+  compact        rewrite the metadata store without its free pages
+  version        print the schema version of the metadata store
+  migrate        upgrade the schema of the metadata store
+
+The commands cover the store of the default snapshotter and those of the
+snapshotters of runtime handlers, or only the store of -snapshotter. backup
+writes the stores of runtime handlers to <file>.<snapshotter>.
+
+backup and version go through the admin endpoint of a running snapshotter.
+compact and migrate need the snapshotter to be stopped.
+`
+
+// metadataStore is the metadata store of a snapshotter
+type metadataStore struct {
+	// snapshotter is the name of the snapshotter of a runtime handler, empty
+	// for the default snapshotter
+	snapshotter string
+	path        string
+}
+
+// String returns the name of the store in the output of the commands
+func (s metadataStore) String() string {
+	if s.snapshotter == "" {
+		return s.path
+	}
+	return fmt.Sprintf("%s (snapshotter %s)", s.path, s.snapshotter)
+}
+
+// runMetadata runs the metadata maintenance command args
+func runMetadata(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("metadata", flag.ContinueOnError)
+	lockTimeout := fs.Duration("lock-timeout", metadata.DefaultLockTimeout,
+		"how long to wait for another process holding the metadata store")
+	snapshotter := fs.String("snapshotter", "",
+		"snapshotter of a runtime handler whose store to use, every store if empty")
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), metadataUsage)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return fmt.Errorf("missing metadata command")
+	}
+
+	cmd, args := fs.Arg(0), fs.Args()[1:]
+
+	// Rewriting the store under a starting snapshotter would lose its writes
+	if cmd == "compact" || cmd == "migrate" {
+		lock, err := lockInstance(*config.RootDir)
+		if err != nil {
+			return err
+		}
+		defer lock.Close()
+	}
+
+	client, online := adminClient(ctx, *config.AdminAddress)
+	var stores []metadataStore
+	var err error
+	if online {
+		stores, err = servedMetadataStores(ctx, client, *config.RootDir, *snapshotter)
+	} else {
+		stores, err = metadataStores(*config.RootDir, *snapshotter)
+	}
+	if err != nil {
+		return err
+	}
+
+	switch cmd {
+	case "backup":
+		if len(args) != 1 {
+			return fmt.Errorf("usage: metadata backup <file>")
+		}
+		for _, store := range stores {
+			dest := args[0]
+			if store.snapshotter != "" && *snapshotter == "" {
+				dest += "." + store.snapshotter
+			}
+			if err := backupMetadata(ctx, client, store, dest, *lockTimeout); err != nil {
+				return fmt.Errorf("%s: %w", store, err)
+			}
+		}
+		return nil
+	case "compact":
+		for _, store := range stores {
+			before, after, err := metadata.Compact(store.path, *lockTimeout)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("compacted %s from %d to %d bytes\n", store, before, after)
+		}
+		return nil
+	case "version":
+		for _, store := range stores {
+			if err := printMetadataVersion(ctx, client, store, *lockTimeout); err != nil {
+				return fmt.Errorf("%s: %w", store, err)
+			}
+		}
+		return nil
+	case "migrate":
+		for _, store := range stores {
+			if err := migrateMetadata(store, *lockTimeout); err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		fs.Usage()
+		return fmt.Errorf("unknown metadata command %q", cmd)
+	}
+}
+
+// metadataStores returns the metadata stores below rootDir, the one of the
+// default snapshotter first, or only the store of snapshotter if it is set
+func metadataStores(rootDir, snapshotter string) ([]metadataStore, error) {
+	if snapshotter != "" {
+		if !filepath.IsLocal(snapshotter) || strings.ContainsRune(snapshotter, '/') {
+			return nil, fmt.Errorf("invalid snapshotter %q", snapshotter)
+		}
+		path := metadata.Path(handlerRootDir(rootDir, snapshotter))
+		if _, err := os.Stat(path); err != nil {
+			return nil, err
+		}
+		return []metadataStore{{snapshotter: snapshotter, path: path}}, nil
+	}
+
+	stores := []metadataStore{{path: metadata.Path(rootDir)}}
+	entries, err := os.ReadDir(handlerRootDir(rootDir, ""))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, e := range entries {
+		path := metadata.Path(handlerRootDir(rootDir, e.Name()))
+		if _, err := os.Stat(path); err == nil {
+			stores = append(stores, metadataStore{snapshotter: e.Name(), path: path})
+		}
+	}
+	return stores, nil
+}
+
+// servedMetadataStores returns the metadata stores the running snapshotter
+// serves on its admin endpoint, or only the store of snapshotter if it is set
+func servedMetadataStores(ctx context.Context, client *http.Client, rootDir, snapshotter string) ([]metadataStore, error) {
+	body, err := adminGet(ctx, client, "/metadata/snapshotters")
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	var names []string
+	if err := json.NewDecoder(body).Decode(&names); err != nil {
+		return nil, fmt.Errorf("failed to decode snapshotters: %w", err)
+	}
+
+	var stores []metadataStore
+	for _, name := range names {
+		if snapshotter != "" && name != snapshotter {
+			continue
+		}
+		path := metadata.Path(rootDir)
+		if name != "" {
+			path = metadata.Path(handlerRootDir(rootDir, name))
+		}
+		stores = append(stores, metadataStore{snapshotter: name, path: path})
+	}
+	if len(stores) == 0 {
+		return nil, fmt.Errorf("no metadata store of snapshotter %q is served", snapshotter)
+	}
+	return stores, nil
+}
+
+// migrateMetadata upgrades the schema of store
+func migrateMetadata(store metadataStore, lockTimeout time.Duration) error {
+	db, err := metadata.Open(store.path, lockTimeout, false)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	from, err := metadata.Migrate(db)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("migrated %s from schema version %d to %d\n", store, from, metadata.SchemaVersion)
+	return nil
+}
+
+// backupMetadata copies store to dest, through the admin endpoint of the
+// running snapshotter if client is not nil
+func backupMetadata(ctx context.Context, client *http.Client, store metadataStore, dest string, lockTimeout time.Duration) error {
+	if client != nil {
+		resp, err := adminRequest(ctx, client, http.MethodGet, metadataPath("/metadata/backup", store.snapshotter), nil)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		return metadata.WriteFile(dest, func(w io.Writer) error {
+			n, err := io.Copy(w, resp.Body)
+			if err != nil {
+				return fmt.Errorf("failed to copy backup: %w", err)
+			}
+			// A backup failing partway through ends short of its length
+			if n != resp.ContentLength {
+				return fmt.Errorf("backup has %d bytes, expected %d", n, resp.ContentLength)
+			}
+			return nil
+		})
+	}
+
+	db, err := metadata.Open(store.path, lockTimeout, true)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.View(func(tx *bolt.Tx) error {
+		return metadata.WriteFile(dest, func(w io.Writer) error {
+			_, err := metadata.Backup(tx, w)
+			return err
+		})
+	})
+}
+
+// printMetadataVersion prints the schema version of store, through the admin
+// endpoint of the running snapshotter if client is not nil
+func printMetadataVersion(ctx context.Context, client *http.Client, store metadataStore, lockTimeout time.Duration) error {
+	v := versionResponse{Supported: metadata.SchemaVersion}
+	if client != nil {
+		body, err := adminGet(ctx, client, metadataPath("/metadata/version", store.snapshotter))
+		if err != nil {
+			return err
+		}
+		defer body.Close()
+		if err := json.NewDecoder(body).Decode(&v); err != nil {
+			return fmt.Errorf("failed to decode version: %w", err)
+		}
+	} else {
+		if _, err := os.Stat(store.path); err != nil {
+			return err
+		}
+		db, err := metadata.Open(store.path, lockTimeout, true)
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+		if err := db.View(func(tx *bolt.Tx) error {
+			v.Version = metadata.Version(tx)
+			return nil
+		}); err != nil {
+			return fmt.Errorf("failed to read schema version: %w", err)
+		}
+	}
+
+	if store.snapshotter != "" {
+		fmt.Printf("snapshotter %s: ", store.snapshotter)
+	}
+	fmt.Printf("schema version %d, supported %d\n", v.Version, v.Supported)
+	return nil
+}
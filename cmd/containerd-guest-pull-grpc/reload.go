@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+
+	"github.com/containerd/log"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/ChengyuZhu6/guest-pull-snapshotter/authz"
+	"github.com/ChengyuZhu6/guest-pull-snapshotter/config"
+	"github.com/ChengyuZhu6/guest-pull-snapshotter/snapshot"
+)
+
+// reloadableOpts returns the snapshotter options of cfg that can change while
+// the snapshotter runs
+func reloadableOpts(cfg *config.Config) ([]snapshot.Opt, error) {
+	queueTimeout, err := config.ParseDuration(cfg.Limits.QueueTimeout)
+	if err != nil {
+		return nil, err
+	}
+	usageCacheTTL, err := config.ParseDuration(cfg.Limits.UsageCacheTTL)
+	if err != nil {
+		return nil, err
+	}
+	defaultQuota, err := cfg.Quota.DefaultSizeBytes()
+	if err != nil {
+		return nil, err
+	}
+
+	return []snapshot.Opt{
+		snapshot.WithConcurrencyLimit(snapshot.OperationCommit, cfg.Limits.CommitConcurrency),
+		snapshot.WithConcurrencyLimit(snapshot.OperationUsage, cfg.Limits.UsageConcurrency),
+		snapshot.WithQueueTimeout(queueTimeout),
+		snapshot.WithUsageCacheTTL(usageCacheTTL),
+		snapshot.WithDefaultQuota(defaultQuota),
+	}, nil
+}
+
+// reloadAll reloads several snapshotters with the same options
+type reloadAll []snapshot.Reloadable
+
+// Reload implements snapshot.Reloadable
+func (r reloadAll) Reload(ctx context.Context, opts ...snapshot.Opt) {
+	for _, sn := range r {
+		sn.Reload(ctx, opts...)
+	}
+}
+
+// restartSections returns the sections of the configuration that differ
+// between prev and next and only apply on restart
+func restartSections(prev, next *config.Config) []string {
+	var changed []string
+	for _, s := range []struct {
+		name       string
+		prev, next interface{}
+	}{
+		{"grpc", prev.GRPC, next.GRPC},
+		{"containerd", prev.Containerd, next.Containerd},
+		{"mount", prev.Mount, next.Mount},
+		{"volume", prev.Volume, next.Volume},
+		{"usage", prev.Usage, next.Usage},
+		{"identity_stub", prev.IdentityStub, next.IdentityStub},
+		{"tracing", prev.Tracing, next.Tracing},
+		{"audit", prev.Audit, next.Audit},
+		{"metrics", prev.Metrics, next.Metrics},
+		{"listeners", prev.Listeners, next.Listeners},
+	} {
+		if !reflect.DeepEqual(s.prev, s.next) {
+			changed = append(changed, s.name)
+		}
+	}
+	return changed
+}
+
+// reloader re-reads the configuration file and applies its limits, default
+// quota and authorization rules to the running snapshotter
+type reloader struct {
+	path        string
+	cfg         *config.Config
+	snapshotter snapshot.Reloadable
+	policy      *authz.Policy
+
+	reloads     *prometheus.CounterVec
+	lastSuccess prometheus.Gauge
+}
+
+func newReloader(path string, cfg *config.Config, snapshotter snapshot.Reloadable, policy *authz.Policy, registry prometheus.Registerer) (*reloader, error) {
+	r := &reloader{
+		path:        path,
+		cfg:         cfg,
+		snapshotter: snapshotter,
+		policy:      policy,
+		reloads: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "guest_pull_snapshotter_config_reloads_total",
+			Help: "Number of configuration reloads by result",
+		}, []string{"result"}),
+		lastSuccess: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "guest_pull_snapshotter_config_last_reload_success_timestamp_seconds",
+			Help: "Time of the last successful configuration reload or of the start",
+		}),
+	}
+	r.lastSuccess.SetToCurrentTime()
+
+	for _, c := range []prometheus.Collector{r.reloads, r.lastSuccess} {
+		if err := registry.Register(c); err != nil {
+			return nil, fmt.Errorf("failed to register reload metrics: %w", err)
+		}
+	}
+	return r, nil
+}
+
+// reload applies the configuration file if it is valid, and otherwise keeps
+// the current configuration
+func (r *reloader) reload(ctx context.Context) error {
+	cfg, opts, err := r.load()
+	if err != nil {
+		r.reloads.WithLabelValues("failure").Inc()
+		log.G(ctx).WithError(err).Error("rejected config reload, keeping the current config")
+		return err
+	}
+
+	if changed := restartSections(r.cfg, cfg); len(changed) > 0 {
+		log.G(ctx).Warnf("config sections %s changed and apply on restart only", strings.Join(changed, ", "))
+	}
+
+	if r.snapshotter != nil {
+		r.snapshotter.Reload(ctx, opts...)
+	}
+	r.policy.Update(cfg.Authorization)
+	r.cfg = cfg
+
+	r.reloads.WithLabelValues("success").Inc()
+	r.lastSuccess.SetToCurrentTime()
+	log.G(ctx).WithField("path", r.path).Info("reloaded config")
+	return nil
+}
+
+// load reads and validates the configuration file before anything of it is
+// applied. Unlike on start, a missing file is an error rather than the
+// default configuration, which would drop the authorization rules.
+func (r *reloader) load() (*config.Config, []snapshot.Opt, error) {
+	if _, err := os.Stat(r.path); err != nil {
+		return nil, nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+	cfg, err := config.LoadConfig(r.path)
+	if err != nil {
+		return nil, nil, err
+	}
+	opts, err := reloadableOpts(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cfg, opts, nil
+}
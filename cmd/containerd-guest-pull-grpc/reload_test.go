@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containerd/containerd/v2/pkg/namespaces"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ChengyuZhu6/guest-pull-snapshotter/authz"
+	"github.com/ChengyuZhu6/guest-pull-snapshotter/config"
+	"github.com/ChengyuZhu6/guest-pull-snapshotter/snapshot"
+)
+
+// fakeReloadable records the options of the last reload
+type fakeReloadable struct {
+	opts []snapshot.Opt
+}
+
+func (f *fakeReloadable) Reload(_ context.Context, opts ...snapshot.Opt) {
+	f.opts = opts
+}
+
+func TestReloader(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "config.toml")
+	cfg := config.DefaultConfig()
+	policy := authz.NewPolicy(cfg.Authorization)
+	sn := &fakeReloadable{}
+	registry := prometheus.NewRegistry()
+
+	r, err := newReloader(path, cfg, sn, policy, registry)
+	require.NoError(t, err)
+
+	remove := namespaces.WithNamespace(ctx, "default")
+	const method = "/containerd.services.snapshots.v1.Snapshots/Remove"
+
+	require.NoError(t, os.WriteFile(path, []byte(`
+[limits]
+  usage_concurrency = 2
+[[authorization.rules]]
+  methods = ["Stat"]
+`), 0600))
+	require.NoError(t, r.reload(ctx))
+	assert.NotEmpty(t, sn.opts)
+	assert.Error(t, policy.Authorize(remove, method, nil))
+	assert.Equal(t, 2, r.cfg.Limits.UsageConcurrency)
+
+	// Invalid configs are rejected as a whole
+	sn.opts = nil
+	require.NoError(t, os.WriteFile(path, []byte(`
+[limits]
+  usage_concurrency = 4
+  queue_timeout = "soon"
+`), 0600))
+	assert.Error(t, r.reload(ctx))
+	assert.Nil(t, sn.opts)
+	assert.Equal(t, 2, r.cfg.Limits.UsageConcurrency)
+	assert.Error(t, policy.Authorize(remove, method, nil))
+
+	require.NoError(t, os.Remove(path))
+	assert.Error(t, r.reload(ctx))
+
+	assert.Equal(t, 1.0, testutil.ToFloat64(r.reloads.WithLabelValues("success")))
+	assert.Equal(t, 2.0, testutil.ToFloat64(r.reloads.WithLabelValues("failure")))
+}
+
+func TestRestartSections(t *testing.T) {
+	prev := config.DefaultConfig()
+	next := config.DefaultConfig()
+	next.Limits.CommitConcurrency = 1
+	next.Authorization.Rules = []config.AuthorizationRule{{Methods: []string{"*"}}}
+	assert.Empty(t, restartSections(prev, next))
+
+	next.Metrics.Address = ":9090"
+	next.Listeners = []config.ListenerConfig{{Network: config.NetworkUnix, Address: "/run/ro.sock", Access: config.AccessReadOnly}}
+	assert.Equal(t, []string{"metrics", "listeners"}, restartSections(prev, next))
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+
+	snapshotsapi "github.com/containerd/containerd/api/services/snapshots/v1"
+	"github.com/containerd/containerd/v2/contrib/snapshotservice"
+	"github.com/containerd/containerd/v2/core/snapshots"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+// router serves several snapshotters on one socket. containerd sends the name
+// of the proxy plugin in every request, which selects the snapshotter of a
+// runtime handler, and the other names go to the default snapshotter.
+type router struct {
+	snapshotsapi.UnimplementedSnapshotsServer
+
+	fallback snapshotsapi.SnapshotsServer
+	named    map[string]snapshotsapi.SnapshotsServer
+}
+
+func newRouter(fallback snapshots.Snapshotter, named map[string]snapshots.Snapshotter) *router {
+	r := &router{
+		fallback: snapshotservice.FromSnapshotter(fallback),
+		named:    map[string]snapshotsapi.SnapshotsServer{},
+	}
+	for name, sn := range named {
+		r.named[name] = snapshotservice.FromSnapshotter(sn)
+	}
+	return r
+}
+
+// route returns the server of the snapshotter named in req
+func (r *router) route(req interface{ GetSnapshotter() string }) snapshotsapi.SnapshotsServer {
+	if s, ok := r.named[req.GetSnapshotter()]; ok {
+		return s
+	}
+	return r.fallback
+}
+
+func (r *router) Prepare(ctx context.Context, req *snapshotsapi.PrepareSnapshotRequest) (*snapshotsapi.PrepareSnapshotResponse, error) {
+	return r.route(req).Prepare(ctx, req)
+}
+
+func (r *router) View(ctx context.Context, req *snapshotsapi.ViewSnapshotRequest) (*snapshotsapi.ViewSnapshotResponse, error) {
+	return r.route(req).View(ctx, req)
+}
+
+func (r *router) Mounts(ctx context.Context, req *snapshotsapi.MountsRequest) (*snapshotsapi.MountsResponse, error) {
+	return r.route(req).Mounts(ctx, req)
+}
+
+func (r *router) Commit(ctx context.Context, req *snapshotsapi.CommitSnapshotRequest) (*emptypb.Empty, error) {
+	return r.route(req).Commit(ctx, req)
+}
+
+func (r *router) Remove(ctx context.Context, req *snapshotsapi.RemoveSnapshotRequest) (*emptypb.Empty, error) {
+	return r.route(req).Remove(ctx, req)
+}
+
+func (r *router) Stat(ctx context.Context, req *snapshotsapi.StatSnapshotRequest) (*snapshotsapi.StatSnapshotResponse, error) {
+	return r.route(req).Stat(ctx, req)
+}
+
+func (r *router) Update(ctx context.Context, req *snapshotsapi.UpdateSnapshotRequest) (*snapshotsapi.UpdateSnapshotResponse, error) {
+	return r.route(req).Update(ctx, req)
+}
+
+func (r *router) List(req *snapshotsapi.ListSnapshotsRequest, stream snapshotsapi.Snapshots_ListServer) error {
+	return r.route(req).List(req, stream)
+}
+
+func (r *router) Usage(ctx context.Context, req *snapshotsapi.UsageRequest) (*snapshotsapi.UsageResponse, error) {
+	return r.route(req).Usage(ctx, req)
+}
+
+func (r *router) Cleanup(ctx context.Context, req *snapshotsapi.CleanupRequest) (*emptypb.Empty, error) {
+	return r.route(req).Cleanup(ctx, req)
+}
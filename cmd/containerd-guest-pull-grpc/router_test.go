@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	snapshotsapi "github.com/containerd/containerd/api/services/snapshots/v1"
+	"github.com/containerd/containerd/v2/pkg/namespaces"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ChengyuZhu6/guest-pull-snapshotter/config"
+)
+
+func TestRouter(t *testing.T) {
+	ctx := namespaces.WithNamespace(context.Background(), "default")
+	root := t.TempDir()
+	cfg := config.DefaultConfig()
+	cfg.Volume.RuntimeHandlers = []config.RuntimeHandlerConfig{
+		{Name: "kata-qemu-coco-dev", Encoder: "nydus"},
+	}
+
+	sns, closers, err := createSnapshotter(ctx, root, cfg, nil, nil)
+	require.NoError(t, err)
+	defer sns.Close()
+	assert.Empty(t, closers)
+	require.Contains(t, sns.handlers, "guest-pull-kata-qemu-coco-dev")
+	_, err = os.Stat(filepath.Join(root, "snapshotters", "guest-pull-kata-qemu-coco-dev", "snapshots"))
+	require.NoError(t, err)
+
+	r := newRouter(sns.fallback, sns.handlers)
+	_, err = r.Prepare(ctx, &snapshotsapi.PrepareSnapshotRequest{Snapshotter: "guest-pull-kata-qemu-coco-dev", Key: "handler"})
+	require.NoError(t, err)
+	_, err = r.Prepare(ctx, &snapshotsapi.PrepareSnapshotRequest{Snapshotter: "guest-pull", Key: "default"})
+	require.NoError(t, err)
+
+	// Each snapshot is only known to the snapshotter it was prepared on
+	_, err = sns.handlers["guest-pull-kata-qemu-coco-dev"].Stat(ctx, "handler")
+	assert.NoError(t, err)
+	_, err = sns.fallback.Stat(ctx, "handler")
+	assert.Error(t, err)
+	_, err = r.Stat(ctx, &snapshotsapi.StatSnapshotRequest{Snapshotter: "guest-pull", Key: "handler"})
+	assert.Error(t, err)
+
+	// Unknown names go to the default snapshotter
+	_, err = r.Stat(ctx, &snapshotsapi.StatSnapshotRequest{Snapshotter: "other", Key: "default"})
+	assert.NoError(t, err)
+}
+
+func TestReloadAll(t *testing.T) {
+	a, b := &fakeReloadable{}, &fakeReloadable{}
+	opts, err := reloadableOpts(config.DefaultConfig())
+	require.NoError(t, err)
+
+	reloadAll{a, b}.Reload(context.Background(), opts...)
+	assert.Len(t, a.opts, len(opts))
+	assert.Len(t, b.opts, len(opts))
+}
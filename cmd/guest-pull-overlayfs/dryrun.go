@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	guestpull "github.com/ChengyuZhu6/guest-pull-snapshotter/guest-pull"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// mountFlagNames maps the MS_* flags produced by parseOptions to their names,
+// in the order they are printed.
+var mountFlagNames = []struct {
+	flag int
+	name string
+}{
+	{unix.MS_RDONLY, "MS_RDONLY"},
+	{unix.MS_NOSUID, "MS_NOSUID"},
+	{unix.MS_NODEV, "MS_NODEV"},
+	{unix.MS_NOEXEC, "MS_NOEXEC"},
+	{unix.MS_SYNCHRONOUS, "MS_SYNCHRONOUS"},
+	{unix.MS_REMOUNT, "MS_REMOUNT"},
+	{unix.MS_MANDLOCK, "MS_MANDLOCK"},
+	{unix.MS_DIRSYNC, "MS_DIRSYNC"},
+	{unix.MS_NOATIME, "MS_NOATIME"},
+	{unix.MS_NODIRATIME, "MS_NODIRATIME"},
+	{unix.MS_BIND, "MS_BIND"},
+	{unix.MS_REC, "MS_REC"},
+	{unix.MS_RELATIME, "MS_RELATIME"},
+	{unix.MS_STRICTATIME, "MS_STRICTATIME"},
+}
+
+// formatMountFlags renders mount flags as "0x<hex> (MS_A|MS_B)"
+func formatMountFlags(flags int) string {
+	var names []string
+	for _, f := range mountFlagNames {
+		if flags&f.flag == f.flag {
+			names = append(names, f.name)
+		}
+	}
+	if len(names) == 0 {
+		return fmt.Sprintf("%#x", flags)
+	}
+	return fmt.Sprintf("%#x (%s)", flags, strings.Join(names, "|"))
+}
+
+// printDryRun writes the parameters run would pass to mount(2), together with
+// the decoded Kata virtual volume, without mounting anything.
+func printDryRun(w io.Writer, margs *mountArgs) error {
+	flags, data := parseOptions(margs.options)
+
+	fmt.Fprintf(w, "source: %s\n", margs.source)
+	fmt.Fprintf(w, "fsType: overlay\n")
+	fmt.Fprintf(w, "target: %s\n", margs.target)
+	fmt.Fprintf(w, "flags:  %s\n", formatMountFlags(flags))
+	fmt.Fprintf(w, "data:   %s\n", data)
+
+	if margs.volume == "" {
+		fmt.Fprintf(w, "volume: <none>\n")
+		return nil
+	}
+
+	volume, err := guestpull.DecodeVolumeOption(margs.volume)
+	if err != nil {
+		return errors.Wrap(err, "failed to decode kata volume")
+	}
+
+	volumeJSON, err := json.MarshalIndent(volume, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal kata volume")
+	}
+	fmt.Fprintf(w, "volume: %s\n", volumeJSON)
+
+	return nil
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// dirCheck is the outcome of checking one overlay option before mounting
+type dirCheck struct {
+	option string
+	path   string
+	// errno is what the kernel would return for this option, zero if it is fine
+	errno  unix.Errno
+	reason string
+}
+
+func (c dirCheck) ok() bool {
+	return c.errno == 0
+}
+
+func (c dirCheck) String() string {
+	if c.path == "" {
+		return c.option
+	}
+	return c.option + "=" + c.path
+}
+
+// overlayDirs holds the directory options of an overlay mount
+type overlayDirs struct {
+	lower []string
+	upper string
+	work  string
+}
+
+func parseOverlayDirs(options []string) overlayDirs {
+	var dirs overlayDirs
+	for _, opt := range options {
+		key, value, _ := strings.Cut(opt, "=")
+		switch key {
+		case "lowerdir":
+			dirs.lower = append(dirs.lower, strings.Split(value, ":")...)
+		case "upperdir":
+			dirs.upper = value
+		case "workdir":
+			dirs.work = value
+		}
+	}
+	return dirs
+}
+
+// checkDir verifies that path exists, is a directory and grants the access
+// described by mode to the calling process.
+func checkDir(option, path string, mode uint32) (dirCheck, os.FileInfo) {
+	c := dirCheck{option: option, path: path}
+
+	if path == "" {
+		c.errno, c.reason = unix.EINVAL, "empty path"
+		return c, nil
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		c.errno, c.reason = unix.ENOENT, err.Error()
+		var errno unix.Errno
+		if errors.As(err, &errno) {
+			c.errno = errno
+		}
+		return c, nil
+	}
+
+	if !fi.IsDir() {
+		c.errno, c.reason = unix.ENOTDIR, "not a directory"
+		return c, fi
+	}
+
+	if err := unix.Access(path, mode); err != nil {
+		c.errno, c.reason = unix.EACCES, fmt.Sprintf("insufficient permissions: %v", err)
+		return c, fi
+	}
+
+	return c, fi
+}
+
+// explainMount checks each lowerdir, upperdir and workdir the way the kernel
+// does when mounting overlayfs, and returns one result per check in the order
+// the kernel would evaluate them.
+func explainMount(margs *mountArgs) []dirCheck {
+	var checks []dirCheck
+
+	_, data := parseOptions(margs.options)
+	if len(data) >= os.Getpagesize() {
+		checks = append(checks, dirCheck{
+			option: "data",
+			errno:  unix.EINVAL,
+			reason: fmt.Sprintf("mount data is %d bytes, the kernel truncates it at %d", len(data), os.Getpagesize()-1),
+		})
+	}
+
+	dirs := parseOverlayDirs(margs.options)
+
+	if len(dirs.lower) == 0 {
+		checks = append(checks, dirCheck{option: "lowerdir", errno: unix.EINVAL, reason: "missing 'lowerdir'"})
+	}
+	for _, lower := range dirs.lower {
+		c, _ := checkDir("lowerdir", lower, unix.R_OK|unix.X_OK)
+		checks = append(checks, c)
+	}
+
+	if dirs.upper == "" && dirs.work == "" {
+		return checks
+	}
+	if dirs.upper == "" {
+		return append(checks, dirCheck{option: "workdir", path: dirs.work, errno: unix.EINVAL, reason: "'workdir' given without 'upperdir'"})
+	}
+	if dirs.work == "" {
+		return append(checks, dirCheck{option: "upperdir", path: dirs.upper, errno: unix.EINVAL, reason: "missing 'workdir'"})
+	}
+
+	upper, upperInfo := checkDir("upperdir", dirs.upper, unix.R_OK|unix.W_OK|unix.X_OK)
+	checks = append(checks, upper)
+	work, workInfo := checkDir("workdir", dirs.work, unix.R_OK|unix.W_OK|unix.X_OK)
+	checks = append(checks, work)
+	if !upper.ok() || !work.ok() {
+		return checks
+	}
+
+	if upperInfo.Sys().(*syscall.Stat_t).Dev != workInfo.Sys().(*syscall.Stat_t).Dev {
+		return append(checks, dirCheck{option: "workdir", path: dirs.work, errno: unix.EINVAL,
+			reason: fmt.Sprintf("workdir and upperdir %q must reside under the same mount", dirs.upper)})
+	}
+
+	if isSubdir(dirs.upper, dirs.work) || isSubdir(dirs.work, dirs.upper) {
+		return append(checks, dirCheck{option: "workdir", path: dirs.work, errno: unix.EINVAL,
+			reason: fmt.Sprintf("workdir and upperdir %q must be separate subtrees", dirs.upper)})
+	}
+
+	var st unix.Statfs_t
+	if err := unix.Statfs(dirs.upper, &st); err == nil && st.Type == unix.OVERLAYFS_SUPER_MAGIC {
+		return append(checks, dirCheck{option: "upperdir", path: dirs.upper, errno: unix.EINVAL,
+			reason: "filesystem on upperdir is overlayfs, which is not supported as upperdir"})
+	}
+
+	return checks
+}
+
+// isSubdir reports whether dir is parent or a descendant of parent
+func isSubdir(parent, dir string) bool {
+	rel, err := filepath.Rel(filepath.Clean(parent), filepath.Clean(dir))
+	if err != nil {
+		return false
+	}
+	return rel == "." || (rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)))
+}
+
+// printExplain writes the result of every check and returns an error naming
+// the first option that would make the mount fail.
+func printExplain(w io.Writer, margs *mountArgs) error {
+	checks := explainMount(margs)
+
+	var failed *dirCheck
+	for i, c := range checks {
+		if c.ok() {
+			fmt.Fprintf(w, "ok    %s\n", c)
+			continue
+		}
+		fmt.Fprintf(w, "FAIL  %s: %s (%s)\n", c, c.reason, unix.ErrnoName(c.errno))
+		if failed == nil {
+			failed = &checks[i]
+		}
+	}
+
+	if failed != nil {
+		return errors.Errorf("mount would fail with %s because of %s: %s",
+			unix.ErrnoName(failed.errno), failed, failed.reason)
+	}
+
+	fmt.Fprintf(w, "no problems found\n")
+	return nil
+}
@@ -4,37 +4,40 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"path/filepath"
 	"strings"
 
+	guestpull "github.com/ChengyuZhu6/guest-pull-snapshotter/guest-pull"
+	"github.com/ChengyuZhu6/guest-pull-snapshotter/logging"
 	"github.com/ChengyuZhu6/guest-pull-snapshotter/version"
 	"github.com/containerd/log"
 	"github.com/pkg/errors"
 	"golang.org/x/sys/unix"
 )
 
-// Kata virtual volume information passed from snapshotter to runtime through containerd.
-// Please refer to `KataVirtualVolume` in https://github.com/kata-containers/kata-containers/blob/main/src/libs/kata-types/src/mount.rs
-const kataVolumeOptionKey = "io.katacontainers.volume="
-
 type mountArgs struct {
-	fsType  string
+	// source is the source of the mount, which containerd passes first
+	source  string
 	target  string
 	options []string
+	// volume is the option passing the volume to the runtime, stripped from
+	// the options
+	volume string
 }
 
 // parseArgs parses command line arguments into mountArgs structure
 func parseArgs(args []string) (*mountArgs, error) {
 	if len(args) < 2 {
-		return nil, errors.New("insufficient arguments for mount, expected: overlay <target> -o <options>")
+		return nil, errors.New("insufficient arguments for mount, expected: <source> <target> -o <options>")
 	}
 
 	margs := &mountArgs{
-		fsType: args[0],
+		source: args[0],
 		target: args[1],
 	}
 
-	if margs.fsType != "overlay" {
-		return nil, errors.Errorf("invalid filesystem type %q, expected 'overlay'", margs.fsType)
+	if margs.source == "" {
+		return nil, errors.New("empty overlayfs mount source")
 	}
 
 	if margs.target == "" {
@@ -43,7 +46,11 @@ func parseArgs(args []string) (*mountArgs, error) {
 
 	if len(args) > 3 && args[2] == "-o" && args[3] != "" {
 		for _, opt := range strings.Split(args[3], ",") {
-			if opt == "" || strings.HasPrefix(opt, kataVolumeOptionKey) {
+			if opt == "" {
+				continue
+			}
+			if guestpull.IsVolumeOption(opt) {
+				margs.volume = opt
 				continue
 			}
 			margs.options = append(margs.options, opt)
@@ -112,39 +119,118 @@ func parseOptions(options []string) (int, string) {
 	return flags, data
 }
 
-func run(args []string) error {
+// runMode selects what run does with the parsed mount arguments
+type runMode int
+
+const (
+	modeMount runMode = iota
+	modeDryRun
+	modeExplain
+)
+
+func run(args []string, mode runMode) error {
 	margs, err := parseArgs(args)
 	if err != nil {
 		return errors.Wrap(err, "failed to parse mount arguments")
 	}
 
+	switch mode {
+	case modeDryRun:
+		return printDryRun(os.Stdout, margs)
+	case modeExplain:
+		return printExplain(os.Stdout, margs)
+	}
+
+	if err := createLayerDirs(margs.options); err != nil {
+		return err
+	}
+
 	flags, data := parseOptions(margs.options)
 
-	if err := unix.Mount(margs.fsType, margs.target, margs.fsType, uintptr(flags), data); err != nil {
-		return errors.Wrapf(err, "failed to mount overlayfs at %q", margs.target)
+	if err := mountOverlay(margs, flags, data); err != nil {
+		return err
 	}
 
 	log.L.WithField("target", margs.target).Info("successfully mounted overlayfs")
 	return nil
 }
 
-func main() {
-	if err := log.SetFormat(log.JSONFormat); err != nil {
-		fmt.Fprintf(os.Stderr, "failed to set log format: %v\n", err)
-		os.Exit(1)
+// createLayerDirs creates the missing lower directories of guest pulled
+// layers, which the snapshotter only records in its metadata store until a
+// container using them is mounted on the host. Such a directory is the empty
+// fs directory of a snapshot in <root>/snapshots.
+func createLayerDirs(options []string) error {
+	for _, opt := range options {
+		lowers, ok := strings.CutPrefix(opt, "lowerdir=")
+		if !ok {
+			continue
+		}
+		for _, lower := range strings.Split(lowers, ":") {
+			snapshotDir := filepath.Dir(lower)
+			if filepath.Base(lower) != "fs" || filepath.Base(filepath.Dir(snapshotDir)) != "snapshots" {
+				continue
+			}
+			if _, err := os.Stat(filepath.Dir(snapshotDir)); err != nil {
+				continue
+			}
+			for _, dir := range []struct {
+				path string
+				perm os.FileMode
+			}{
+				{snapshotDir, 0700},
+				{lower, 0755},
+			} {
+				if err := os.Mkdir(dir.path, dir.perm); err != nil && !os.IsExist(err) {
+					return errors.Wrapf(err, "failed to create layer directory %s", dir.path)
+				}
+			}
+		}
 	}
+	return nil
+}
 
-	logLevel := flag.String("log-level", "info", "Set the logging level [trace, debug, info, warn, error, fatal, panic]")
+// envOrDefault returns the value of the environment variable if set,
+// otherwise the default value. containerd runs the mount helper with its own
+// environment, which is the only way to configure it then.
+func envOrDefault(envVar, defaultValue string) string {
+	if val, ok := os.LookupEnv(envVar); ok {
+		return val
+	}
+	return defaultValue
+}
+
+func main() {
+	logLevel := flag.String("log-level", envOrDefault("GUEST_PULL_OVERLAYFS_LOG_LEVEL", "info"), "Set the logging level [trace, debug, info, warn, error, fatal, panic]")
+	logFormat := flag.String("log-format", envOrDefault("GUEST_PULL_OVERLAYFS_LOG_FORMAT", "json"), "Set the log format [json, text]")
+	logFile := flag.String("log-file", envOrDefault("GUEST_PULL_OVERLAYFS_LOG_FILE", ""), "File logs are appended to instead of stderr")
+	logMaxSize := flag.String("log-max-size", envOrDefault("GUEST_PULL_OVERLAYFS_LOG_MAX_SIZE", "10MiB"), "Size past which the log file is rotated, empty to disable rotation")
 	printVersion := flag.Bool("version", false, "Print version information and exit")
+	dryRun := flag.Bool("dry-run", false, "Print the resolved mount parameters without mounting")
+	explain := flag.Bool("explain", false, "Check the overlay directories and report which one would make the mount fail, without mounting")
 	flag.Parse()
 
-	if err := log.SetLevel(*logLevel); err != nil {
-		fmt.Fprintf(os.Stderr, "failed to set log level: %v\n", err)
+	// The helper may be installed under another name, such as for a variant
+	// or another snapshotter instance
+	name := filepath.Base(os.Args[0])
+
+	// The log file is written unbuffered and closed on exit
+	_, err := logging.Setup(logging.Options{
+		Level:      *logLevel,
+		Format:     *logFormat,
+		File:       *logFile,
+		MaxSize:    *logMaxSize,
+		MaxBackups: 1,
+		// containerd reports the errors of the mount helper from its output
+		Stderr: true,
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to set up logging: %v\n", err)
 		os.Exit(1)
 	}
 
 	if *printVersion {
-		fmt.Printf("guest-pull-overlayfs %s %s (built %s)\n",
+		fmt.Printf("%s %s %s (built %s)\n",
+			name,
 			version.Version,
 			version.Revision,
 			version.BuildTimestamp)
@@ -153,13 +239,24 @@ func main() {
 
 	args := flag.Args()
 	if len(args) < 4 {
-		fmt.Fprintf(os.Stderr, "Usage: guest-pull-overlayfs overlay <target> -o <options>\n")
+		fmt.Fprintf(os.Stderr, "Usage: %s <source> <target> -o <options>\n", name)
+		os.Exit(1)
+	}
+
+	mode := modeMount
+	switch {
+	case *dryRun && *explain:
+		fmt.Fprintf(os.Stderr, "--dry-run and --explain are mutually exclusive\n")
 		os.Exit(1)
+	case *dryRun:
+		mode = modeDryRun
+	case *explain:
+		mode = modeExplain
 	}
 
-	err := run(args)
+	err = run(args, mode)
 	if err != nil {
-		log.L.WithError(err).Fatal("failed to run guest-pull-overlayfs")
+		log.L.WithError(err).Fatalf("failed to run %s", name)
 	}
 
 	os.Exit(0)
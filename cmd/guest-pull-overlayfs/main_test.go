@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	guestpull "github.com/ChengyuZhu6/guest-pull-snapshotter/guest-pull"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestParseArgsStripsVolume(t *testing.T) {
+	volumeOptions, err := guestpull.PrepareGuestPullMounts(context.Background(), "", []string{"lowerdir=/l"}, map[string]string{})
+	require.NoError(t, err)
+
+	margs, err := parseArgs([]string{"overlay", "/target", "-o", "ro,lowerdir=/l," + volumeOptions[0]})
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"ro", "lowerdir=/l"}, margs.options)
+	assert.NotEmpty(t, margs.volume)
+}
+
+func TestParseArgsStripsEncodedVolumes(t *testing.T) {
+	volume := guestpull.NewGuestPullVolume("", []string{"lowerdir=/l"}, map[string]string{})
+	for _, e := range []guestpull.Encoder{guestpull.CCInitDataEncoder{}, guestpull.NydusEncoder{}} {
+		volumeOptions, err := e.Encode(context.Background(), volume)
+		require.NoError(t, err)
+
+		margs, err := parseArgs([]string{"overlay", "/target", "-o", "lowerdir=/l," + volumeOptions[0]})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"lowerdir=/l"}, margs.options)
+		assert.Equal(t, volumeOptions[0], margs.volume)
+	}
+}
+
+func TestParseArgsSource(t *testing.T) {
+	margs, err := parseArgs([]string{"guest-pull-1", "/target", "-o", "lowerdir=/l"})
+	require.NoError(t, err)
+	assert.Equal(t, "guest-pull-1", margs.source)
+
+	_, err = parseArgs([]string{"", "/target", "-o", "lowerdir=/l"})
+	assert.Error(t, err)
+}
+
+func TestPrintDryRun(t *testing.T) {
+	volumeOptions, err := guestpull.PrepareGuestPullMounts(context.Background(), "", []string{"lowerdir=/l"}, map[string]string{})
+	require.NoError(t, err)
+
+	margs, err := parseArgs([]string{"overlay", "/target", "-o", "ro,nodev,lowerdir=/l," + volumeOptions[0]})
+	require.NoError(t, err)
+
+	var out bytes.Buffer
+	require.NoError(t, printDryRun(&out, margs))
+
+	assert.Contains(t, out.String(), "source: overlay\n")
+	assert.Contains(t, out.String(), "fsType: overlay\n")
+	assert.Contains(t, out.String(), "target: /target\n")
+	assert.Contains(t, out.String(), "MS_RDONLY|MS_NODEV")
+	assert.Contains(t, out.String(), "data:   lowerdir=/l\n")
+	assert.Contains(t, out.String(), `"volume_type": "image_guest_pull"`)
+}
+
+func TestExplainMount(t *testing.T) {
+	root := t.TempDir()
+	for _, dir := range []string{"lower", "upper", "work", "upper/nested"} {
+		require.NoError(t, os.Mkdir(filepath.Join(root, dir), 0755))
+	}
+	lower := filepath.Join(root, "lower")
+	upper := filepath.Join(root, "upper")
+	work := filepath.Join(root, "work")
+
+	testCases := []struct {
+		name    string
+		options []string
+		option  string
+		errno   unix.Errno
+	}{
+		{
+			name:    "valid directories",
+			options: []string{"lowerdir=" + lower, "upperdir=" + upper, "workdir=" + work},
+		},
+		{
+			name:    "missing lowerdir",
+			options: []string{"lowerdir=" + lower + ":" + filepath.Join(root, "missing")},
+			option:  "lowerdir",
+			errno:   unix.ENOENT,
+		},
+		{
+			name:    "upperdir without workdir",
+			options: []string{"lowerdir=" + lower, "upperdir=" + upper},
+			option:  "upperdir",
+			errno:   unix.EINVAL,
+		},
+		{
+			name:    "workdir inside upperdir",
+			options: []string{"lowerdir=" + lower, "upperdir=" + upper, "workdir=" + filepath.Join(upper, "nested")},
+			option:  "workdir",
+			errno:   unix.EINVAL,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var failed []dirCheck
+			for _, c := range explainMount(&mountArgs{source: "overlay", target: root, options: tc.options}) {
+				if !c.ok() {
+					failed = append(failed, c)
+				}
+			}
+
+			if tc.errno == 0 {
+				assert.Empty(t, failed)
+				return
+			}
+			require.Len(t, failed, 1)
+			assert.Equal(t, tc.option, failed[0].option)
+			assert.Equal(t, tc.errno, failed[0].errno)
+		})
+	}
+}
+
+func TestWithOption(t *testing.T) {
+	assert.Equal(t, "userxattr", withOption("", "userxattr"))
+	assert.Equal(t, "lowerdir=/l,userxattr", withOption("lowerdir=/l", "userxattr"))
+	assert.Equal(t, "userxattr,lowerdir=/l", withOption("userxattr,lowerdir=/l", "userxattr"))
+}
+
+func TestCreateLayerDirs(t *testing.T) {
+	root := t.TempDir()
+	snapshots := filepath.Join(root, "snapshots")
+	require.NoError(t, os.MkdirAll(filepath.Join(snapshots, "1", "fs"), 0755))
+
+	layer := filepath.Join(snapshots, "2", "fs")
+	other := filepath.Join(root, "other", "3", "fs")
+	require.NoError(t, createLayerDirs([]string{
+		"ro",
+		"lowerdir=" + filepath.Join(snapshots, "1", "fs") + ":" + layer + ":" + other,
+	}))
+
+	// Only the layers of a snapshots directory are placeholders
+	assert.DirExists(t, layer)
+	assert.NoDirExists(t, filepath.Join(root, "other"))
+}
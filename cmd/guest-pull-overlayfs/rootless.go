@@ -0,0 +1,107 @@
+package main
+
+import (
+	"os/exec"
+	"strings"
+
+	"github.com/containerd/log"
+	"github.com/moby/sys/userns"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// fuseOverlayfsBinary is the userspace overlay implementation used when the
+// kernel overlay cannot be mounted by the calling process.
+const fuseOverlayfsBinary = "fuse-overlayfs"
+
+// hasCapSysAdmin reports whether CAP_SYS_ADMIN is in the effective set of the
+// calling process, in whatever user namespace the process runs in.
+func hasCapSysAdmin() (bool, error) {
+	hdr := unix.CapUserHeader{Version: unix.LINUX_CAPABILITY_VERSION_3}
+	var data [2]unix.CapUserData
+	if err := unix.Capget(&hdr, &data[0]); err != nil {
+		return false, errors.Wrap(err, "failed to get process capabilities")
+	}
+	return data[0].Effective&(1<<unix.CAP_SYS_ADMIN) != 0, nil
+}
+
+// withOption appends opt to the comma separated mount data unless present
+func withOption(data, opt string) string {
+	for _, o := range strings.Split(data, ",") {
+		if o == opt {
+			return data
+		}
+	}
+	if data == "" {
+		return opt
+	}
+	return data + "," + opt
+}
+
+// mountOverlay mounts the overlay with the kernel driver when the process is
+// allowed to, using "userxattr" inside a user namespace, and falls back to
+// fuse-overlayfs otherwise.
+func mountOverlay(margs *mountArgs, flags int, data string) error {
+	privileged, err := hasCapSysAdmin()
+	if err != nil {
+		return err
+	}
+
+	if privileged {
+		inUserNS := userns.RunningInUserNS()
+		if inUserNS {
+			// Unprivileged overlay mounts can't use trusted.* xattrs
+			data = withOption(data, "userxattr")
+		}
+
+		err := unix.Mount(margs.source, margs.target, "overlay", uintptr(flags), data)
+		if err == nil {
+			return nil
+		}
+		if !inUserNS {
+			return errors.Wrapf(err, "failed to mount overlayfs at %q", margs.target)
+		}
+		log.L.WithError(err).Warn("kernel overlay mount in user namespace failed, falling back to fuse-overlayfs")
+	} else {
+		log.L.Info("CAP_SYS_ADMIN is not available, falling back to fuse-overlayfs")
+	}
+
+	return fuseOverlayfsMount(margs, flags, data)
+}
+
+// fuseOverlayfsMount execs fuse-overlayfs with the same lower, upper and work
+// directories as the kernel mount would have used.
+func fuseOverlayfsMount(margs *mountArgs, flags int, data string) error {
+	binary, err := exec.LookPath(fuseOverlayfsBinary)
+	if err != nil {
+		return errors.Wrapf(err, "CAP_SYS_ADMIN is required to mount overlayfs at %q and %s is not available", margs.target, fuseOverlayfsBinary)
+	}
+
+	var options []string
+	for _, opt := range strings.Split(data, ",") {
+		// fuse-overlayfs always stores its metadata in user xattrs
+		if opt != "" && opt != "userxattr" {
+			options = append(options, opt)
+		}
+	}
+	for _, f := range []struct {
+		flag int
+		name string
+	}{
+		{unix.MS_RDONLY, "ro"},
+		{unix.MS_NOSUID, "nosuid"},
+		{unix.MS_NODEV, "nodev"},
+		{unix.MS_NOEXEC, "noexec"},
+	} {
+		if flags&f.flag != 0 {
+			options = append(options, f.name)
+		}
+	}
+
+	out, err := exec.Command(binary, "-o", strings.Join(options, ","), margs.target).CombinedOutput()
+	if err != nil {
+		return errors.Wrapf(err, "failed to mount fuse-overlayfs at %q: %s", margs.target, strings.TrimSpace(string(out)))
+	}
+
+	return nil
+}
@@ -5,8 +5,10 @@ import (
 	"flag"
 	"os"
 	"path/filepath"
+	"strconv"
 
 	"github.com/containerd/log"
+	"github.com/moby/sys/userns"
 	"github.com/pkg/errors"
 )
 
@@ -15,17 +17,29 @@ const (
 	// DefaultAddress is the default socket path for the snapshotter's GRPC server
 	DefaultAddress = "/run/containerd-guest-pull-grpc/containerd-guest-pull-grpc.sock"
 
+	// DefaultAdminAddress is the default socket path of the admin endpoint
+	DefaultAdminAddress = "/run/containerd-guest-pull-grpc/admin.sock"
+
 	// DefaultConfigPath is the default path to the configuration file
 	DefaultConfigPath = "/etc/containerd-guest-pull-grpc/config.toml"
 
 	// DefaultLogLevel is the default logging level
 	DefaultLogLevel = log.InfoLevel
 
+	// DefaultLogFormat is the default log format
+	DefaultLogFormat = log.JSONFormat
+
 	// DefaultRootDir is the default root directory for the snapshotter
 	DefaultRootDir = "/var/lib/containerd/io.containerd.snapshotter.v1.guest-pull"
 
 	// DefaultImageServiceAddress is the default address for the containerd image service
 	DefaultImageServiceAddress = "/run/containerd/containerd.sock"
+
+	// DefaultMountHelper is the default mount helper binary
+	DefaultMountHelper = "guest-pull-overlayfs"
+
+	// DefaultMountSource is the default source of the mounts
+	DefaultMountSource = "overlay"
 )
 
 // Command line flags
@@ -34,6 +48,11 @@ var (
 	Address = flag.String("address", getEnvOrDefault("GUEST_PULL_ADDRESS", DefaultAddress),
 		"address for the snapshotter's GRPC server")
 
+	// AdminAddress specifies the socket path of the admin endpoint used by
+	// the maintenance commands
+	AdminAddress = flag.String("admin-address", getEnvOrDefault("GUEST_PULL_ADMIN_ADDRESS", DefaultAdminAddress),
+		"address of the admin endpoint used by maintenance commands, empty to disable it")
+
 	// ConfigPath specifies the path to the configuration file
 	ConfigPath = flag.String("config", getEnvOrDefault("GUEST_PULL_CONFIG", DefaultConfigPath),
 		"path to the configuration file")
@@ -42,10 +61,30 @@ var (
 	LogLevel = flag.String("log-level", getEnvOrDefault("GUEST_PULL_LOG_LEVEL", DefaultLogLevel.String()),
 		"set the logging level [trace, debug, info, warn, error, fatal, panic]")
 
+	// LogFormat specifies the log format
+	LogFormat = flag.String("log-format", getEnvOrDefault("GUEST_PULL_LOG_FORMAT", string(DefaultLogFormat)),
+		"set the log format [json, text]")
+
+	// LogFile specifies the file logs are written to instead of stderr
+	LogFile = flag.String("log-file", getEnvOrDefault("GUEST_PULL_LOG_FILE", ""),
+		"file logs are appended to instead of stderr")
+
+	// LogMaxSize specifies the size past which the log file is rotated
+	LogMaxSize = flag.String("log-max-size", getEnvOrDefault("GUEST_PULL_LOG_MAX_SIZE", "100MiB"),
+		"size past which the log file is rotated, empty to disable rotation")
+
+	// LogMaxBackups specifies the number of rotated log files kept
+	LogMaxBackups = flag.Int("log-max-backups", getEnvIntOrDefault("GUEST_PULL_LOG_MAX_BACKUPS", 5),
+		"number of rotated log files kept")
+
 	// RootDir specifies the root directory for the snapshotter
 	RootDir = flag.String("root", getEnvOrDefault("GUEST_PULL_ROOT", DefaultRootDir),
 		"path to the root directory for this snapshotter")
 
+	// Rootless indicates that containerd runs without root privileges
+	Rootless = flag.Bool("rootless", getEnvBoolOrDefault("GUEST_PULL_ROOTLESS", userns.RunningInUserNS()),
+		"run the snapshotter for a rootless containerd, defaults to true inside a user namespace")
+
 	// PrintVersion indicates whether to print the version and exit
 	PrintVersion = flag.Bool("version", false, "print the version")
 )
@@ -59,6 +98,28 @@ func getEnvOrDefault(envVar, defaultValue string) string {
 	return defaultValue
 }
 
+// getEnvBoolOrDefault returns the boolean value of the environment variable if
+// set and valid, otherwise returns the default value
+func getEnvBoolOrDefault(envVar string, defaultValue bool) bool {
+	if val, ok := os.LookupEnv(envVar); ok {
+		if b, err := strconv.ParseBool(val); err == nil {
+			return b
+		}
+	}
+	return defaultValue
+}
+
+// getEnvIntOrDefault returns the integer value of the environment variable if
+// set and valid, otherwise returns the default value
+func getEnvIntOrDefault(envVar string, defaultValue int) int {
+	if val, ok := os.LookupEnv(envVar); ok {
+		if i, err := strconv.Atoi(val); err == nil {
+			return i
+		}
+	}
+	return defaultValue
+}
+
 // Add validation function for configuration
 func ValidateConfig() error {
 	if *RootDir == "" {
@@ -2,10 +2,12 @@ package config
 
 import (
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/containerd/log"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestDefaultValues(t *testing.T) {
@@ -15,6 +17,8 @@ func TestDefaultValues(t *testing.T) {
 	assert.Equal(t, log.InfoLevel, DefaultLogLevel)
 	assert.Equal(t, "/var/lib/containerd/io.containerd.snapshotter.v1.guest-pull", DefaultRootDir)
 	assert.Equal(t, "/run/containerd/containerd.sock", DefaultImageServiceAddress)
+	assert.Equal(t, "/run/containerd-guest-pull-grpc/admin.sock", DefaultAdminAddress)
+	assert.Equal(t, log.JSONFormat, DefaultLogFormat)
 }
 
 func TestGetEnvOrDefault(t *testing.T) {
@@ -111,8 +115,237 @@ func TestEnvironmentVariableOverrides(t *testing.T) {
 func TestFlagInitialization(t *testing.T) {
 	// We can only verify that the flags exist and have the expected help text
 	assert.NotNil(t, Address)
+	assert.NotNil(t, AdminAddress)
 	assert.NotNil(t, ConfigPath)
 	assert.NotNil(t, LogLevel)
+	assert.NotNil(t, LogFormat)
+	assert.NotNil(t, LogFile)
+	assert.NotNil(t, LogMaxSize)
+	assert.NotNil(t, LogMaxBackups)
 	assert.NotNil(t, RootDir)
+	assert.NotNil(t, Rootless)
 	assert.NotNil(t, PrintVersion)
 }
+
+func TestGetEnvBoolOrDefault(t *testing.T) {
+	os.Setenv("TEST_ENV_BOOL", "true")
+	defer os.Unsetenv("TEST_ENV_BOOL")
+	assert.True(t, getEnvBoolOrDefault("TEST_ENV_BOOL", false))
+
+	os.Setenv("TEST_ENV_BOOL", "not-a-bool")
+	assert.False(t, getEnvBoolOrDefault("TEST_ENV_BOOL", false))
+
+	assert.True(t, getEnvBoolOrDefault("TEST_ENV_BOOL_NOT_SET", true))
+}
+
+func TestGetEnvIntOrDefault(t *testing.T) {
+	os.Setenv("TEST_ENV_INT", "3")
+	defer os.Unsetenv("TEST_ENV_INT")
+	assert.Equal(t, 3, getEnvIntOrDefault("TEST_ENV_INT", 5))
+
+	os.Setenv("TEST_ENV_INT", "three")
+	assert.Equal(t, 5, getEnvIntOrDefault("TEST_ENV_INT", 5))
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir := t.TempDir()
+
+	cfg, err := LoadConfig(filepath.Join(dir, "missing.toml"))
+	require.NoError(t, err)
+	assert.Equal(t, DefaultConfig(), cfg)
+
+	path := filepath.Join(dir, "config.toml")
+	require.NoError(t, os.WriteFile(path, []byte("[quota]\ndefault_size = \"10GiB\"\n"), 0600))
+	cfg, err = LoadConfig(path)
+	require.NoError(t, err)
+	size, err := cfg.Quota.DefaultSizeBytes()
+	require.NoError(t, err)
+	assert.Equal(t, uint64(10<<30), size)
+
+	require.NoError(t, os.WriteFile(path, []byte("[quota]\ndefault_size = \"lots\"\n"), 0600))
+	_, err = LoadConfig(path)
+	assert.Error(t, err)
+
+	require.NoError(t, os.WriteFile(path, []byte("[usage]\nreport = \"compressed\"\n"), 0600))
+	cfg, err = LoadConfig(path)
+	require.NoError(t, err)
+	assert.Equal(t, UsageReportCompressed, cfg.Usage.Report)
+	assert.Equal(t, DefaultImageServiceAddress, cfg.Containerd.Address)
+	assert.True(t, cfg.NeedsContainerd())
+
+	require.NoError(t, os.WriteFile(path, []byte("[identity_stub]\nenable = true\nsource_dir = \"/etc/guest-pull/identity\"\n"), 0600))
+	cfg, err = LoadConfig(path)
+	require.NoError(t, err)
+	assert.False(t, cfg.NeedsContainerd())
+	cfg.IdentityStub.ContentStore = true
+	assert.True(t, cfg.NeedsContainerd())
+
+	require.NoError(t, os.WriteFile(path, []byte("[usage]\nreport = \"guest\"\n"), 0600))
+	_, err = LoadConfig(path)
+	assert.Error(t, err)
+
+	require.NoError(t, os.WriteFile(path, []byte("[volume]\nencoder = \"nydus\"\n"), 0600))
+	cfg, err = LoadConfig(path)
+	require.NoError(t, err)
+	assert.Equal(t, "nydus", cfg.Volume.Encoder)
+
+	require.NoError(t, os.WriteFile(path, []byte("[volume]\nencoder = \"kata-2\"\n"), 0600))
+	_, err = LoadConfig(path)
+	assert.Error(t, err)
+
+	require.NoError(t, os.WriteFile(path, []byte(`[volume]
+profile = "kata-main"
+
+[[volume.runtime_handlers]]
+name = "kata-qemu-coco-dev"
+encoder = "nydus"
+`), 0600))
+	cfg, err = LoadConfig(path)
+	require.NoError(t, err)
+	assert.Equal(t, "kata-main", cfg.Volume.Profile)
+	require.Len(t, cfg.Volume.RuntimeHandlers, 1)
+	assert.Equal(t, RuntimeHandlerConfig{
+		Name:        "kata-qemu-coco-dev",
+		Snapshotter: "guest-pull-kata-qemu-coco-dev",
+		Encoder:     "nydus",
+		Profile:     "kata-main",
+	}, cfg.Volume.RuntimeHandlers[0].Resolve(cfg.Volume))
+
+	require.NoError(t, os.WriteFile(path, []byte("[volume]\nprofile = \"kata-2.x\"\n"), 0600))
+	_, err = LoadConfig(path)
+	assert.Error(t, err)
+
+	require.NoError(t, os.WriteFile(path, []byte("unknown = true\n"), 0600))
+	_, err = LoadConfig(path)
+	assert.Error(t, err)
+}
+
+func TestGRPCConfigFileMode(t *testing.T) {
+	_, ok, err := GRPCConfig{}.FileMode()
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	mode, ok, err := GRPCConfig{Mode: "0660"}.FileMode()
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, os.FileMode(0660), mode)
+
+	for _, invalid := range []string{"rw", "0999", "01777"} {
+		_, _, err := GRPCConfig{Mode: invalid}.FileMode()
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestLimitsConfigValidate(t *testing.T) {
+	assert.NoError(t, LimitsConfig{}.Validate())
+	assert.NoError(t, LimitsConfig{UsageConcurrency: 4, QueueTimeout: "30s", UsageCacheTTL: "10s"}.Validate())
+	assert.Error(t, LimitsConfig{CommitConcurrency: -1}.Validate())
+	assert.Error(t, LimitsConfig{QueueTimeout: "soon"}.Validate())
+	assert.Error(t, LimitsConfig{UsageCacheTTL: "-1s"}.Validate())
+}
+
+func TestMountConfigValidate(t *testing.T) {
+	assert.NoError(t, DefaultConfig().Mount.Validate())
+	assert.NoError(t, MountConfig{Helper: "guest-pull-overlayfs-verity", Type: "fuse3.guest-pull-overlayfs-verity", Source: "verity"}.Validate())
+	assert.Error(t, MountConfig{Helper: "/usr/local/bin/guest-pull-overlayfs", Source: "overlay"}.Validate())
+	assert.Error(t, MountConfig{Helper: "guest-pull-overlayfs", Source: ""}.Validate())
+	assert.Error(t, MountConfig{Helper: "guest-pull-overlayfs", Source: "a,b"}.Validate())
+}
+
+func TestVolumeConfigValidate(t *testing.T) {
+	volume := DefaultConfig().Volume
+	assert.NoError(t, volume.Validate())
+
+	testCases := []struct {
+		name     string
+		handlers []RuntimeHandlerConfig
+		valid    bool
+	}{
+		{"handlers", []RuntimeHandlerConfig{{Name: "kata-qemu"}, {Name: "kata-clh", Profile: "kata-main"}}, true},
+		{"no name", []RuntimeHandlerConfig{{Profile: "kata-main"}}, false},
+		{"duplicate name", []RuntimeHandlerConfig{{Name: "kata-qemu"}, {Name: "kata-qemu", Snapshotter: "other"}}, false},
+		{"duplicate snapshotter", []RuntimeHandlerConfig{{Name: "kata-qemu"}, {Name: "kata-clh", Snapshotter: "guest-pull-kata-qemu"}}, false},
+		{"default snapshotter", []RuntimeHandlerConfig{{Name: "kata-qemu", Snapshotter: "guest-pull"}}, false},
+		{"snapshotter with slash", []RuntimeHandlerConfig{{Name: "kata-qemu", Snapshotter: "a/b"}}, false},
+		{"parent directory snapshotter", []RuntimeHandlerConfig{{Name: "kata-qemu", Snapshotter: ".."}}, false},
+		{"name with slash", []RuntimeHandlerConfig{{Name: "../kata"}}, false},
+		{"unknown profile", []RuntimeHandlerConfig{{Name: "kata-qemu", Profile: "kata-2.x"}}, false},
+		{"unknown encoder", []RuntimeHandlerConfig{{Name: "kata-qemu", Encoder: "kata-2"}}, false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			v := volume
+			v.RuntimeHandlers = tc.handlers
+			err := v.Validate()
+			if tc.valid {
+				assert.NoError(t, err)
+			} else {
+				assert.Error(t, err)
+			}
+		})
+	}
+}
+
+func TestTracingConfigValidate(t *testing.T) {
+	testCases := []struct {
+		name    string
+		tracing TracingConfig
+		valid   bool
+	}{
+		{"disabled", TracingConfig{}, true},
+		{"otlp", TracingConfig{Exporter: TracingExporterOTLP, Endpoint: "collector:4317"}, true},
+		{"otlp without endpoint", TracingConfig{Exporter: TracingExporterOTLP}, false},
+		{"file", TracingConfig{Exporter: TracingExporterFile, File: "/tmp/spans.json"}, true},
+		{"file without path", TracingConfig{Exporter: TracingExporterFile}, false},
+		{"unknown exporter", TracingConfig{Exporter: "jaeger"}, false},
+		{"sampling ratio above 1", TracingConfig{Exporter: TracingExporterStdout, SamplingRatio: 2}, false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.tracing.Validate()
+			if tc.valid {
+				assert.NoError(t, err)
+			} else {
+				assert.Error(t, err)
+			}
+		})
+	}
+}
+
+func TestListenerConfigValidate(t *testing.T) {
+	uid := 1000
+	testCases := []struct {
+		name     string
+		listener ListenerConfig
+		valid    bool
+	}{
+		{"read-only unix", ListenerConfig{Network: NetworkUnix, Address: "/run/ro.sock", Access: AccessReadOnly, GID: &uid, Mode: "0660"}, true},
+		{"mtls tcp", ListenerConfig{Network: NetworkTCP, Address: ":7443", Access: AccessReadWrite, CA: "ca.pem", Cert: "cert.pem", Key: "key.pem"}, true},
+		{"tcp without client ca", ListenerConfig{Network: NetworkTCP, Address: ":7443", Access: AccessReadOnly, Cert: "cert.pem", Key: "key.pem"}, false},
+		{"unix with tls", ListenerConfig{Network: NetworkUnix, Address: "/run/ro.sock", Access: AccessReadOnly, CA: "ca.pem"}, false},
+		{"tcp with owner", ListenerConfig{Network: NetworkTCP, Address: ":7443", Access: AccessReadOnly, CA: "ca.pem", Cert: "cert.pem", Key: "key.pem", UID: &uid}, false},
+		{"missing access", ListenerConfig{Network: NetworkUnix, Address: "/run/ro.sock"}, false},
+		{"missing address", ListenerConfig{Network: NetworkUnix, Access: AccessReadOnly}, false},
+		{"unknown network", ListenerConfig{Network: "vsock", Address: "3:1024", Access: AccessReadOnly}, false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.listener.Validate()
+			if tc.valid {
+				assert.NoError(t, err)
+			} else {
+				assert.Error(t, err)
+			}
+		})
+	}
+}
+
+func TestAuthorizationRuleValidate(t *testing.T) {
+	assert.NoError(t, AuthorizationRule{UIDs: []uint32{0}, Methods: []string{"*"}}.Validate())
+	assert.NoError(t, AuthorizationRule{Methods: []string{"Stat", "List"}, Namespaces: []string{"k8s.io"}}.Validate())
+	assert.Error(t, AuthorizationRule{UIDs: []uint32{0}}.Validate())
+	assert.Error(t, AuthorizationRule{Methods: []string{"Delete"}}.Validate())
+}
@@ -0,0 +1,644 @@
+package config
+
+import (
+	"bytes"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ChengyuZhu6/guest-pull-snapshotter/containerdconfig"
+	guestpull "github.com/ChengyuZhu6/guest-pull-snapshotter/guest-pull"
+	"github.com/docker/go-units"
+	"github.com/pelletier/go-toml/v2"
+	"github.com/pkg/errors"
+)
+
+// Config is the content of the configuration file
+type Config struct {
+	// GRPC configures the socket of the gRPC server
+	GRPC GRPCConfig `toml:"grpc"`
+
+	// Containerd configures the connection to containerd
+	Containerd ContainerdConfig `toml:"containerd"`
+
+	// Mount configures the mounts returned to containerd
+	Mount MountConfig `toml:"mount"`
+
+	// Volume configures how guest pulled snapshots are described to the
+	// runtime
+	Volume VolumeConfig `toml:"volume"`
+
+	// Quota configures disk quotas of container writable layers
+	Quota QuotaConfig `toml:"quota"`
+
+	// Usage configures the usage reported for guest pulled layers
+	Usage UsageConfig `toml:"usage"`
+
+	// IdentityStub configures the /etc/passwd and /etc/group stubs of guest
+	// pulled images
+	IdentityStub IdentityStubConfig `toml:"identity_stub"`
+
+	// Tracing configures the export of OpenTelemetry traces
+	Tracing TracingConfig `toml:"tracing"`
+
+	// Audit configures the audit log of guest pull decisions
+	Audit AuditConfig `toml:"audit"`
+
+	// Limits bounds the concurrency of expensive snapshot operations
+	Limits LimitsConfig `toml:"limits"`
+
+	// Metrics configures the Prometheus metrics endpoint
+	Metrics MetricsConfig `toml:"metrics"`
+
+	// Authorization restricts the snapshots API calls allowed to each caller
+	Authorization AuthorizationConfig `toml:"authorization"`
+
+	// Listeners are served along with the --address socket, which allows
+	// every call
+	Listeners []ListenerConfig `toml:"listeners"`
+}
+
+// GRPCConfig configures the socket of the gRPC server, so that a containerd
+// running as another user or group can connect to it
+type GRPCConfig struct {
+	// UID and GID own the socket, -1 leaves the owner unchanged
+	UID int `toml:"uid"`
+	GID int `toml:"gid"`
+
+	// Mode is the octal permission mode of the socket, such as "0660". Empty
+	// leaves the mode set by the umask.
+	Mode string `toml:"mode"`
+}
+
+// FileMode returns the permission mode of the socket, and false if it is
+// left unchanged
+func (g GRPCConfig) FileMode() (os.FileMode, bool, error) {
+	if g.Mode == "" {
+		return 0, false, nil
+	}
+	mode, err := strconv.ParseUint(g.Mode, 8, 32)
+	if err != nil || mode&^0777 != 0 {
+		return 0, false, errors.Errorf("invalid grpc.mode %q, expected octal permissions such as \"0660\"", g.Mode)
+	}
+	return os.FileMode(mode), true, nil
+}
+
+// ContainerdConfig configures the connection to containerd, whose content
+// store holds the manifests of the images being pulled
+type ContainerdConfig struct {
+	// Address is the containerd socket
+	Address string `toml:"address"`
+}
+
+// MountConfig configures the mounts returned to containerd, so that several
+// snapshotters or mount helper variants can run on a node
+type MountConfig struct {
+	// Helper is the name of the mount helper binary containerd runs, which
+	// makes the mount type "fuse.<helper>"
+	Helper string `toml:"helper"`
+
+	// Type replaces the mount type made from the helper, such as
+	// "fuse3.guest-pull-overlayfs"
+	Type string `toml:"type"`
+
+	// Source is the source of the mounts, which tells those of several
+	// snapshotters apart in the mount table
+	Source string `toml:"source"`
+}
+
+// Validate checks the mount configuration
+func (m MountConfig) Validate() error {
+	if m.Helper == "" || strings.ContainsAny(m.Helper, "/, ") {
+		return errors.Errorf("invalid mount.helper %q, expected the name of a binary on PATH", m.Helper)
+	}
+	if strings.ContainsAny(m.Type, ", ") {
+		return errors.Errorf("invalid mount.type %q", m.Type)
+	}
+	if m.Source == "" || strings.ContainsAny(m.Source, "#, ") {
+		return errors.Errorf("invalid mount.source %q", m.Source)
+	}
+	return nil
+}
+
+// VolumeConfig configures how the volume describing a guest pulled snapshot
+// is passed to the runtime in the mount options
+type VolumeConfig struct {
+	// Encoder is "kata" for the io.katacontainers.volume option, or
+	// "cc-init-data" or "nydus" for runtimes reading the volume from initdata
+	// or from the extraoption of the nydus snapshotter
+	Encoder string `toml:"encoder"`
+
+	// Profile is the Kata release whose volume schema is written, such as
+	// "kata-3.x" or "kata-main"
+	Profile string `toml:"profile"`
+
+	// RuntimeHandlers override the encoder and profile for the containers of
+	// runtime handlers, which containerd maps to snapshotters of their own
+	RuntimeHandlers []RuntimeHandlerConfig `toml:"runtime_handlers"`
+}
+
+// RuntimeHandlerConfig describes the volumes of the containers of a runtime
+// handler. containerd doesn't tell snapshotters the runtime handler, so the
+// handler gets its own snapshotter, served on the same socket.
+type RuntimeHandlerConfig struct {
+	// Name is the runtime handler, such as "kata-qemu-coco-dev"
+	Name string `toml:"name"`
+
+	// Snapshotter is the name of the snapshotter of the handler in
+	// containerd, "guest-pull-<name>" if empty
+	Snapshotter string `toml:"snapshotter"`
+
+	// Encoder and Profile replace those of the volume section if set
+	Encoder string `toml:"encoder"`
+	Profile string `toml:"profile"`
+}
+
+// snapshotterName matches the names of the snapshotters of runtime handlers,
+// which are also the names of their directories below the root directory
+var snapshotterName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+
+// SnapshotterName returns the name of the snapshotter of the handler
+func (h RuntimeHandlerConfig) SnapshotterName() string {
+	if h.Snapshotter != "" {
+		return h.Snapshotter
+	}
+	return containerdconfig.DefaultProxyPlugin + "-" + h.Name
+}
+
+// HandlerSnapshotters returns the names of the snapshotters of the runtime
+// handlers by handler, nil if there are none
+func (v VolumeConfig) HandlerSnapshotters() map[string]string {
+	if len(v.RuntimeHandlers) == 0 {
+		return nil
+	}
+	snapshotters := map[string]string{}
+	for _, h := range v.RuntimeHandlers {
+		snapshotters[h.Name] = h.SnapshotterName()
+	}
+	return snapshotters
+}
+
+// Resolve returns the handler with the encoder and profile of volume filled in
+func (h RuntimeHandlerConfig) Resolve(volume VolumeConfig) RuntimeHandlerConfig {
+	h.Snapshotter = h.SnapshotterName()
+	if h.Encoder == "" {
+		h.Encoder = volume.Encoder
+	}
+	if h.Profile == "" {
+		h.Profile = volume.Profile
+	}
+	return h
+}
+
+// Validate checks the volume configuration
+func (v VolumeConfig) Validate() error {
+	if _, err := guestpull.NewEncoder(v.Encoder, v.Profile); err != nil {
+		return errors.Wrap(err, "volume")
+	}
+
+	names := map[string]bool{}
+	snapshotters := map[string]bool{containerdconfig.DefaultProxyPlugin: true}
+	for i, h := range v.RuntimeHandlers {
+		h = h.Resolve(v)
+		if h.Name == "" {
+			return errors.Errorf("volume.runtime_handlers[%d]: name is required", i)
+		}
+		if names[h.Name] {
+			return errors.Errorf("volume.runtime_handlers[%d]: duplicate runtime handler %q", i, h.Name)
+		}
+		names[h.Name] = true
+		if !snapshotterName.MatchString(h.Snapshotter) {
+			return errors.Errorf("volume.runtime_handlers[%d]: invalid snapshotter %q", i, h.Snapshotter)
+		}
+		if snapshotters[h.Snapshotter] {
+			return errors.Errorf("volume.runtime_handlers[%d]: duplicate snapshotter %q", i, h.Snapshotter)
+		}
+		snapshotters[h.Snapshotter] = true
+		if _, err := guestpull.NewEncoder(h.Encoder, h.Profile); err != nil {
+			return errors.Wrapf(err, "volume.runtime_handlers[%d]", i)
+		}
+	}
+	return nil
+}
+
+// QuotaConfig configures disk quotas of container writable layers
+type QuotaConfig struct {
+	// DefaultSize is the quota of writable layers that don't carry a quota
+	// label, such as "10GiB". Empty disables the default quota.
+	DefaultSize string `toml:"default_size"`
+}
+
+// UsageConfig configures the usage reported for guest pulled layers, which
+// the kubelet uses for image garbage collection
+type UsageConfig struct {
+	// Report is "host" to report the disk usage on the host, which is nothing
+	// for guest pulled layers, or "compressed" or "uncompressed" to report
+	// the size of the layer in the image
+	Report string `toml:"report"`
+}
+
+// IdentityStubConfig configures the /etc/passwd and /etc/group stubs placed
+// on the host for guest pulled images, so that containerd can resolve user
+// names while the rest of the image stays off the host
+type IdentityStubConfig struct {
+	// Enable places the stubs in the top layer of guest pulled images
+	Enable bool `toml:"enable"`
+
+	// SourceDir is a local directory with stand-in files, looked up as
+	// <source_dir>/<manifest digest algorithm>/<manifest digest hex>/etc/passwd
+	// and then as <source_dir>/etc/passwd. It is the supported source.
+	SourceDir string `toml:"source_dir"`
+
+	// ContentStore extracts the files of images without stand-in files from
+	// their layers in the containerd content store. Guest pulled layers are
+	// only there if the image was also pulled on the host, and the layers
+	// found are decompressed in full while the snapshot is prepared.
+	ContentStore bool `toml:"content_store"`
+}
+
+// TracingConfig configures the export of the OpenTelemetry spans of the
+// gRPC server and the snapshotter
+type TracingConfig struct {
+	// Exporter is "otlp" to send spans to an OTLP gRPC collector, "stdout" or
+	// "file" to write them as JSON, or empty to disable tracing
+	Exporter string `toml:"exporter"`
+
+	// Endpoint is the host:port of the OTLP collector
+	Endpoint string `toml:"endpoint"`
+
+	// Insecure connects to the OTLP collector without TLS
+	Insecure bool `toml:"insecure"`
+
+	// File is the file the spans are appended to by the file exporter
+	File string `toml:"file"`
+
+	// SamplingRatio is the fraction of the traces started by the snapshotter
+	// that are sampled. Traces started by containerd follow its decision.
+	SamplingRatio float64 `toml:"sampling_ratio"`
+}
+
+// AuditConfig configures the audit log, which records whether each snapshot
+// was left to the guest to pull, mounted on the host or refused
+type AuditConfig struct {
+	// Path is the file records are appended to. Empty disables the audit log.
+	Path string `toml:"path"`
+
+	// MaxSize is the size, such as "100MiB", past which the file is rotated to
+	// <path>.1. Empty disables rotation.
+	MaxSize string `toml:"max_size"`
+
+	// MaxBackups is the number of rotated files kept
+	MaxBackups int `toml:"max_backups"`
+
+	// HashChain links each record to the previous one with a SHA-256 hash
+	HashChain bool `toml:"hash_chain"`
+}
+
+// LimitsConfig bounds the disk usage walks of Commit and Usage, which the
+// stats collection of the CRI can issue in large numbers
+type LimitsConfig struct {
+	// CommitConcurrency is the number of Commit calls run at once, 0 for no
+	// limit
+	CommitConcurrency int `toml:"commit_concurrency"`
+
+	// UsageConcurrency is the number of Usage calls walking a snapshot at
+	// once, 0 for no limit
+	UsageConcurrency int `toml:"usage_concurrency"`
+
+	// QueueTimeout is how long calls wait for a slot, such as "30s", before
+	// failing as unavailable. Empty waits as long as the caller does.
+	QueueTimeout string `toml:"queue_timeout"`
+
+	// UsageCacheTTL is how long the usage of an active snapshot is reused,
+	// such as "10s". Empty disables the cache.
+	UsageCacheTTL string `toml:"usage_cache_ttl"`
+}
+
+// MetricsConfig configures the Prometheus metrics endpoint
+type MetricsConfig struct {
+	// Address is the host:port serving /metrics. Empty disables the endpoint.
+	Address string `toml:"address"`
+}
+
+// ListenerConfig configures an additional listener of the gRPC server
+type ListenerConfig struct {
+	// Network is "unix" or "tcp"
+	Network string `toml:"network"`
+
+	// Address is the socket path of a unix listener or the host:port of a
+	// tcp listener
+	Address string `toml:"address"`
+
+	// Access is "read-only" to allow only the calls that don't change
+	// snapshots (Stat, List, Mounts and Usage), or "read-write" to allow all
+	Access string `toml:"access"`
+
+	// UID, GID and Mode set the owner and permission mode of a unix socket
+	// as in the grpc section. Unset leaves them unchanged.
+	UID  *int   `toml:"uid"`
+	GID  *int   `toml:"gid"`
+	Mode string `toml:"mode"`
+
+	// CA is the PEM file of the certificate authorities verifying client
+	// certificates, which tcp listeners require
+	CA string `toml:"ca"`
+
+	// Cert and Key are the PEM files of the certificate and key of a tcp
+	// listener
+	Cert string `toml:"cert"`
+	Key  string `toml:"key"`
+}
+
+// AuthorizationConfig restricts the snapshots API calls allowed to each
+// caller. Without rules every call is allowed, otherwise the calls that no
+// rule allows are denied.
+type AuthorizationConfig struct {
+	Rules []AuthorizationRule `toml:"rules"`
+}
+
+// AuthorizationRule allows callers to call methods in namespaces
+type AuthorizationRule struct {
+	// UIDs and GIDs match the callers on unix sockets whose process runs as
+	// one of the users or primary groups. A rule without either matches every
+	// caller, including those on tcp listeners.
+	UIDs []uint32 `toml:"uids"`
+	GIDs []uint32 `toml:"gids"`
+
+	// Methods are the snapshots API methods allowed, such as "Prepare", or
+	// "*" for all of them
+	Methods []string `toml:"methods"`
+
+	// Namespaces are the containerd namespaces the calls are allowed in,
+	// empty for all of them
+	Namespaces []string `toml:"namespaces"`
+}
+
+// SnapshotsMethods are the methods of the snapshots API
+var SnapshotsMethods = []string{"Prepare", "View", "Mounts", "Commit", "Remove", "Stat", "Update", "Usage", "List", "Cleanup"}
+
+// Listener networks
+const (
+	NetworkUnix = "unix"
+	NetworkTCP  = "tcp"
+)
+
+// Listener access levels
+const (
+	AccessReadOnly  = "read-only"
+	AccessReadWrite = "read-write"
+)
+
+// Tracing exporters
+const (
+	TracingExporterNone   = ""
+	TracingExporterOTLP   = "otlp"
+	TracingExporterStdout = "stdout"
+	TracingExporterFile   = "file"
+)
+
+// Usage report modes
+const (
+	UsageReportHost         = "host"
+	UsageReportCompressed   = "compressed"
+	UsageReportUncompressed = "uncompressed"
+)
+
+// DefaultConfig returns the configuration used when no file is present
+func DefaultConfig() *Config {
+	return &Config{
+		GRPC: GRPCConfig{
+			UID: -1,
+			GID: -1,
+		},
+		Containerd: ContainerdConfig{
+			Address: DefaultImageServiceAddress,
+		},
+		Mount: MountConfig{
+			Helper: DefaultMountHelper,
+			Source: DefaultMountSource,
+		},
+		Volume: VolumeConfig{
+			Encoder: guestpull.EncoderKata,
+			Profile: guestpull.DefaultProfile,
+		},
+		Usage: UsageConfig{
+			Report: UsageReportHost,
+		},
+		Tracing: TracingConfig{
+			Endpoint:      "localhost:4317",
+			SamplingRatio: 1.0,
+		},
+		Audit: AuditConfig{
+			MaxSize:    "100MiB",
+			MaxBackups: 5,
+		},
+	}
+}
+
+// LoadConfig reads and validates the configuration file at path. A missing
+// file yields the default configuration.
+func LoadConfig(path string) (*Config, error) {
+	cfg := DefaultConfig()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return cfg, nil
+		}
+		return nil, errors.Wrapf(err, "failed to read config file %s", path)
+	}
+
+	if err := toml.NewDecoder(bytes.NewReader(data)).DisallowUnknownFields().Decode(cfg); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse config file %s", path)
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, errors.Wrapf(err, "invalid config file %s", path)
+	}
+
+	return cfg, nil
+}
+
+// Validate checks the values of the configuration
+func (c *Config) Validate() error {
+	if _, _, err := c.GRPC.FileMode(); err != nil {
+		return err
+	}
+
+	if err := c.Mount.Validate(); err != nil {
+		return err
+	}
+	if err := c.Volume.Validate(); err != nil {
+		return err
+	}
+
+	if _, err := c.Quota.DefaultSizeBytes(); err != nil {
+		return err
+	}
+
+	switch c.Usage.Report {
+	case UsageReportHost, UsageReportCompressed, UsageReportUncompressed:
+	default:
+		return errors.Errorf("invalid usage report %q, expected %q, %q or %q", c.Usage.Report,
+			UsageReportHost, UsageReportCompressed, UsageReportUncompressed)
+	}
+	if c.NeedsContainerd() && c.Containerd.Address == "" {
+		return errors.New("containerd.address is required to report layer sizes or extract identity files from the content store")
+	}
+
+	if err := c.Tracing.Validate(); err != nil {
+		return err
+	}
+
+	if _, err := ParseSize(c.Audit.MaxSize); err != nil {
+		return errors.Wrap(err, "audit.max_size")
+	}
+	if c.Audit.MaxBackups < 0 {
+		return errors.Errorf("invalid audit.max_backups %d, must not be negative", c.Audit.MaxBackups)
+	}
+
+	for i, r := range c.Authorization.Rules {
+		if err := r.Validate(); err != nil {
+			return errors.Wrapf(err, "authorization.rules[%d]", i)
+		}
+	}
+
+	for i, l := range c.Listeners {
+		if err := l.Validate(); err != nil {
+			return errors.Wrapf(err, "listeners[%d]", i)
+		}
+	}
+
+	return c.Limits.Validate()
+}
+
+// Validate checks the authorization rule
+func (r AuthorizationRule) Validate() error {
+	if len(r.Methods) == 0 {
+		return errors.New("methods is required")
+	}
+	for _, m := range r.Methods {
+		if m != "*" && !slices.Contains(SnapshotsMethods, m) {
+			return errors.Errorf("invalid method %q, expected \"*\" or one of %v", m, SnapshotsMethods)
+		}
+	}
+	return nil
+}
+
+// Validate checks the listener configuration
+func (l ListenerConfig) Validate() error {
+	if l.Address == "" {
+		return errors.New("address is required")
+	}
+	switch l.Access {
+	case AccessReadOnly, AccessReadWrite:
+	default:
+		return errors.Errorf("invalid access %q, expected %q or %q", l.Access, AccessReadOnly, AccessReadWrite)
+	}
+	switch l.Network {
+	case NetworkUnix:
+		if l.CA != "" || l.Cert != "" || l.Key != "" {
+			return errors.New("ca, cert and key only apply to tcp listeners")
+		}
+		if _, _, err := l.FileMode(); err != nil {
+			return err
+		}
+	case NetworkTCP:
+		if l.CA == "" || l.Cert == "" || l.Key == "" {
+			return errors.New("tcp listeners require ca, cert and key to authenticate clients with mTLS")
+		}
+		if l.UID != nil || l.GID != nil || l.Mode != "" {
+			return errors.New("uid, gid and mode only apply to unix listeners")
+		}
+	default:
+		return errors.Errorf("invalid network %q, expected %q or %q", l.Network, NetworkUnix, NetworkTCP)
+	}
+	return nil
+}
+
+// FileMode returns the permission mode of a unix socket, and false if it is
+// left unchanged
+func (l ListenerConfig) FileMode() (os.FileMode, bool, error) {
+	return GRPCConfig{Mode: l.Mode}.FileMode()
+}
+
+// Validate checks the limits
+func (l LimitsConfig) Validate() error {
+	if l.CommitConcurrency < 0 || l.UsageConcurrency < 0 {
+		return errors.New("limits.commit_concurrency and limits.usage_concurrency must not be negative")
+	}
+	if _, err := ParseDuration(l.QueueTimeout); err != nil {
+		return errors.Wrap(err, "limits.queue_timeout")
+	}
+	if _, err := ParseDuration(l.UsageCacheTTL); err != nil {
+		return errors.Wrap(err, "limits.usage_cache_ttl")
+	}
+	return nil
+}
+
+// Validate checks the tracing configuration
+func (t TracingConfig) Validate() error {
+	switch t.Exporter {
+	case TracingExporterNone, TracingExporterStdout:
+	case TracingExporterOTLP:
+		if t.Endpoint == "" {
+			return errors.New("tracing.endpoint is required by the otlp exporter")
+		}
+	case TracingExporterFile:
+		if t.File == "" {
+			return errors.New("tracing.file is required by the file exporter")
+		}
+	default:
+		return errors.Errorf("invalid tracing exporter %q, expected %q, %q or %q", t.Exporter,
+			TracingExporterOTLP, TracingExporterStdout, TracingExporterFile)
+	}
+	if t.SamplingRatio < 0 || t.SamplingRatio > 1 {
+		return errors.Errorf("invalid tracing sampling ratio %v, must be between 0 and 1", t.SamplingRatio)
+	}
+	return nil
+}
+
+// NeedsContainerd reports whether the configured features use the containerd
+// content store
+func (c *Config) NeedsContainerd() bool {
+	return c.Usage.Report != UsageReportHost || (c.IdentityStub.Enable && c.IdentityStub.ContentStore)
+}
+
+// DefaultSizeBytes returns the default quota in bytes, 0 if it is disabled
+func (q QuotaConfig) DefaultSizeBytes() (uint64, error) {
+	return ParseSize(q.DefaultSize)
+}
+
+// ParseDuration parses a duration such as "30s" or "1m". An empty duration is 0.
+func ParseDuration(d string) (time.Duration, error) {
+	if d == "" {
+		return 0, nil
+	}
+	v, err := time.ParseDuration(d)
+	if err != nil {
+		return 0, errors.Wrapf(err, "invalid duration %q", d)
+	}
+	if v < 0 {
+		return 0, errors.Errorf("invalid duration %q: must not be negative", d)
+	}
+	return v, nil
+}
+
+// ParseSize parses a human readable size such as "512MiB" or "10G" into bytes,
+// with binary units. An empty size is 0.
+func ParseSize(size string) (uint64, error) {
+	if size == "" {
+		return 0, nil
+	}
+	n, err := units.RAMInBytes(size)
+	if err != nil {
+		return 0, errors.Wrapf(err, "invalid size %q", size)
+	}
+	if n < 0 {
+		return 0, errors.Errorf("invalid size %q: must not be negative", size)
+	}
+	return uint64(n), nil
+}
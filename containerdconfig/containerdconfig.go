@@ -0,0 +1,248 @@
+// Package containerdconfig reads the parts of a containerd configuration
+// file that the guest pull snapshotter depends on, for versions 2 (containerd
+// 1.7) and 3 (containerd 2.x) of its format
+package containerdconfig
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pelletier/go-toml/v2"
+	"github.com/pkg/errors"
+)
+
+// DefaultPath is the default containerd configuration file
+const DefaultPath = "/etc/containerd/config.toml"
+
+// Plugin IDs of the sections holding the CRI settings
+const (
+	// CRIPluginV2 holds all the CRI settings in version 2
+	CRIPluginV2 = "io.containerd.grpc.v1.cri"
+	// ImagesPluginV3 holds the image settings of the CRI in version 3
+	ImagesPluginV3 = "io.containerd.cri.v1.images"
+	// RuntimePluginV3 holds the runtime settings of the CRI in version 3
+	RuntimePluginV3 = "io.containerd.cri.v1.runtime"
+)
+
+// Config is a containerd configuration file merged with the files it imports
+type Config struct {
+	// Path is the file the configuration was loaded from
+	Path string
+	// Version is the version of the format, 1 if unset
+	Version int
+	// Imports are the imported files, in the order they were merged
+	Imports []string
+
+	tree map[string]interface{}
+}
+
+// Runtime is a CRI runtime handler
+type Runtime struct {
+	Handler string
+	// Type is the runtime type, such as "io.containerd.kata-qemu-coco-dev.v2"
+	Type string
+	// Path is the shim binary set in the runtime options, if any
+	Path string
+	// Snapshotter is the snapshotter of the containers of the runtime
+	Snapshotter string
+	// PullSnapshotter is the snapshotter images are pulled into for the
+	// runtime, which version 3 sets apart in the runtime platforms
+	PullSnapshotter string
+}
+
+// Load reads the containerd configuration file at path and the files it
+// imports, the latter overriding the former as containerd does
+func Load(path string) (*Config, error) {
+	tree, err := readTree(path)
+	if err != nil {
+		return nil, err
+	}
+	c := &Config{Path: path, Version: 1, tree: tree}
+	if v, ok := tree["version"].(int64); ok {
+		c.Version = int(v)
+	}
+
+	imports, _ := tree["imports"].([]interface{})
+	for _, i := range imports {
+		pattern, ok := i.(string)
+		if !ok {
+			continue
+		}
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(filepath.Dir(path), pattern)
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid import %q in %s", pattern, path)
+		}
+		sort.Strings(matches)
+		for _, m := range matches {
+			imported, err := readTree(m)
+			if err != nil {
+				return nil, err
+			}
+			delete(imported, "version")
+			delete(imported, "imports")
+			merge(c.tree, imported)
+			c.Imports = append(c.Imports, m)
+		}
+	}
+	return c, nil
+}
+
+func readTree(path string) (map[string]interface{}, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read containerd config %s", path)
+	}
+	tree := map[string]interface{}{}
+	if err := toml.NewDecoder(bytes.NewReader(data)).Decode(&tree); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse containerd config %s", path)
+	}
+	return tree, nil
+}
+
+// merge merges src into dst, the tables of both being merged key by key and
+// the other values of src replacing those of dst
+func merge(dst, src map[string]interface{}) {
+	for k, v := range src {
+		srcTable, ok := v.(map[string]interface{})
+		dstTable, ok2 := dst[k].(map[string]interface{})
+		if ok && ok2 {
+			merge(dstTable, srcTable)
+			continue
+		}
+		dst[k] = v
+	}
+}
+
+// Lookup returns the value at the path of keys, such as "plugins",
+// "io.containerd.cri.v1.images", "snapshotter"
+func (c *Config) Lookup(keys ...string) (interface{}, bool) {
+	var v interface{} = c.tree
+	for _, k := range keys {
+		table, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if v, ok = table[k]; !ok {
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+// lookupString returns the string at the path of keys, empty if unset
+func (c *Config) lookupString(keys ...string) string {
+	v, _ := c.Lookup(keys...)
+	s, _ := v.(string)
+	return s
+}
+
+// lookupTable returns the table at the path of keys, nil if unset
+func (c *Config) lookupTable(keys ...string) map[string]interface{} {
+	v, _ := c.Lookup(keys...)
+	t, _ := v.(map[string]interface{})
+	return t
+}
+
+// Supported reports whether the version of the format is 2 or 3
+func (c *Config) Supported() bool {
+	return c.Version == 2 || c.Version == 3
+}
+
+// SnapshotAnnotationsKey returns the path of the disable_snapshot_annotations
+// setting in the version of the format
+func (c *Config) SnapshotAnnotationsKey() []string {
+	if c.Version == 3 {
+		return []string{"plugins", ImagesPluginV3, "disable_snapshot_annotations"}
+	}
+	return []string{"plugins", CRIPluginV2, "containerd", "disable_snapshot_annotations"}
+}
+
+// SnapshotAnnotationsDisabled reports whether the CRI withholds the snapshot
+// annotations that the guest pull snapshotter relies on, which it does unless
+// told otherwise
+func (c *Config) SnapshotAnnotationsDisabled() bool {
+	v, ok := c.Lookup(c.SnapshotAnnotationsKey()...)
+	if !ok {
+		return true
+	}
+	disabled, ok := v.(bool)
+	return !ok || disabled
+}
+
+// ProxyPlugin returns the type and address of the proxy plugin name
+func (c *Config) ProxyPlugin(name string) (typ, address string, ok bool) {
+	p := c.lookupTable("proxy_plugins", name)
+	if p == nil {
+		return "", "", false
+	}
+	typ, _ = p["type"].(string)
+	address, _ = p["address"].(string)
+	return typ, address, true
+}
+
+// RuntimesKey returns the path of the table of runtime handlers in the
+// version of the format
+func (c *Config) RuntimesKey() []string {
+	if c.Version == 3 {
+		return []string{"plugins", RuntimePluginV3, "containerd", "runtimes"}
+	}
+	return []string{"plugins", CRIPluginV2, "containerd", "runtimes"}
+}
+
+// RuntimePlatformsKey returns the path of the table of runtime platforms of
+// version 3, nil in version 2
+func (c *Config) RuntimePlatformsKey() []string {
+	if c.Version == 3 {
+		return []string{"plugins", ImagesPluginV3, "runtime_platforms"}
+	}
+	return nil
+}
+
+// Runtimes returns the CRI runtime handlers sorted by name
+func (c *Config) Runtimes() []Runtime {
+	table := c.lookupTable(c.RuntimesKey()...)
+	var runtimes []Runtime
+	for handler, v := range table {
+		rt, ok := v.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		r := Runtime{Handler: handler}
+		r.Type, _ = rt["runtime_type"].(string)
+		r.Snapshotter, _ = rt["snapshotter"].(string)
+		r.Path, _ = rt["runtime_path"].(string)
+		r.PullSnapshotter = r.Snapshotter
+		if key := c.RuntimePlatformsKey(); key != nil {
+			r.PullSnapshotter = c.lookupString(append(key, handler, "snapshotter")...)
+		}
+		runtimes = append(runtimes, r)
+	}
+	sort.Slice(runtimes, func(i, j int) bool { return runtimes[i].Handler < runtimes[j].Handler })
+	return runtimes
+}
+
+// IsKata reports whether the runtime runs containers in Kata VMs
+func (r Runtime) IsKata() bool {
+	return strings.Contains(r.Type, "kata") || strings.Contains(r.Handler, "kata")
+}
+
+// ShimBinary returns the name of the shim binary of the runtime, such as
+// "containerd-shim-kata-qemu-coco-dev-v2" for
+// "io.containerd.kata-qemu-coco-dev.v2", or its path if set
+func (r Runtime) ShimBinary() string {
+	if r.Path != "" {
+		return r.Path
+	}
+	name := strings.TrimPrefix(r.Type, "io.containerd.")
+	i := strings.LastIndex(name, ".")
+	if i < 0 {
+		return ""
+	}
+	return "containerd-shim-" + name[:i] + "-" + name[i+1:]
+}
@@ -0,0 +1,123 @@
+package containerdconfig
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+	require.NoError(t, os.WriteFile(path, []byte(content), 0644))
+}
+
+func TestLoadV2(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.toml")
+	writeFile(t, path, `
+version = 2
+
+[plugins."io.containerd.grpc.v1.cri".containerd]
+  disable_snapshot_annotations = false
+
+[plugins."io.containerd.grpc.v1.cri".containerd.runtimes.runc]
+  runtime_type = "io.containerd.runc.v2"
+
+[plugins."io.containerd.grpc.v1.cri".containerd.runtimes.kata-qemu-coco-dev]
+  runtime_type = "io.containerd.kata-qemu-coco-dev.v2"
+  snapshotter = "guest-pull"
+
+[proxy_plugins.guest-pull]
+  type = "snapshot"
+  address = "/run/guest-pull.sock"
+`)
+
+	cfg, err := Load(path)
+	require.NoError(t, err)
+	assert.Equal(t, 2, cfg.Version)
+	assert.True(t, cfg.Supported())
+	assert.False(t, cfg.SnapshotAnnotationsDisabled())
+
+	typ, address, ok := cfg.ProxyPlugin("guest-pull")
+	require.True(t, ok)
+	assert.Equal(t, "snapshot", typ)
+	assert.Equal(t, "/run/guest-pull.sock", address)
+	_, _, ok = cfg.ProxyPlugin("nydus")
+	assert.False(t, ok)
+
+	runtimes := cfg.Runtimes()
+	require.Len(t, runtimes, 2)
+	kata := runtimes[0]
+	assert.Equal(t, "kata-qemu-coco-dev", kata.Handler)
+	assert.True(t, kata.IsKata())
+	assert.Equal(t, "guest-pull", kata.Snapshotter)
+	assert.Equal(t, "guest-pull", kata.PullSnapshotter)
+	assert.Equal(t, "containerd-shim-kata-qemu-coco-dev-v2", kata.ShimBinary())
+	assert.False(t, runtimes[1].IsKata())
+}
+
+func TestLoadV3Imports(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.toml")
+	writeFile(t, path, `
+version = 3
+imports = ["conf.d/*.toml"]
+
+[plugins."io.containerd.cri.v1.images"]
+  snapshotter = "overlayfs"
+
+[plugins."io.containerd.cri.v1.runtime".containerd.runtimes.kata-qemu]
+  runtime_type = "io.containerd.kata-qemu.v2"
+  snapshotter = "overlayfs"
+`)
+	writeFile(t, filepath.Join(dir, "conf.d", "kata.toml"), `
+version = 3
+
+[plugins."io.containerd.cri.v1.images".runtime_platforms.kata-qemu]
+  snapshotter = "guest-pull"
+
+[plugins."io.containerd.cri.v1.runtime".containerd.runtimes.kata-qemu]
+  runtime_path = "/opt/kata/bin/containerd-shim-kata-v2"
+  snapshotter = "guest-pull"
+`)
+
+	cfg, err := Load(path)
+	require.NoError(t, err)
+	assert.Equal(t, 3, cfg.Version)
+	assert.Equal(t, []string{filepath.Join(dir, "conf.d", "kata.toml")}, cfg.Imports)
+	// Unset, which defaults to disabled
+	assert.True(t, cfg.SnapshotAnnotationsDisabled())
+	v, ok := cfg.Lookup("plugins", ImagesPluginV3, "snapshotter")
+	require.True(t, ok)
+	assert.Equal(t, "overlayfs", v)
+
+	runtimes := cfg.Runtimes()
+	require.Len(t, runtimes, 1)
+	assert.Equal(t, Runtime{
+		Handler:         "kata-qemu",
+		Type:            "io.containerd.kata-qemu.v2",
+		Path:            "/opt/kata/bin/containerd-shim-kata-v2",
+		Snapshotter:     "guest-pull",
+		PullSnapshotter: "guest-pull",
+	}, runtimes[0])
+	assert.Equal(t, "/opt/kata/bin/containerd-shim-kata-v2", runtimes[0].ShimBinary())
+}
+
+func TestLoadErrors(t *testing.T) {
+	_, err := Load(filepath.Join(t.TempDir(), "missing.toml"))
+	assert.Error(t, err)
+
+	path := filepath.Join(t.TempDir(), "config.toml")
+	writeFile(t, path, "version = \n")
+	_, err = Load(path)
+	assert.Error(t, err)
+
+	writeFile(t, path, "[plugins.cri]\n")
+	cfg, err := Load(path)
+	require.NoError(t, err)
+	assert.Equal(t, 1, cfg.Version)
+	assert.False(t, cfg.Supported())
+}
@@ -0,0 +1,167 @@
+package containerdconfig
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pelletier/go-toml/v2"
+	"github.com/pkg/errors"
+)
+
+// DefaultProxyPlugin is the name the snapshotter is registered under in
+// containerd
+const DefaultProxyPlugin = "guest-pull"
+
+// Settings are the containerd settings the guest pull snapshotter needs
+type Settings struct {
+	// Version is the version of the configuration format, 2 or 3
+	Version int
+	// ProxyPlugin is the name of the snapshotter in containerd
+	ProxyPlugin string
+	// Address is the socket the snapshotter serves
+	Address string
+	// Handlers are the runtime handlers whose containers use the snapshotter
+	Handlers []string
+	// HandlerPlugins register the snapshotters of runtime handlers with their
+	// own volume settings, by handler, under their own name on Address
+	HandlerPlugins map[string]string
+}
+
+// proxyPlugin returns the name of the snapshotter of the runtime handler
+func (s Settings) proxyPlugin(handler string) string {
+	if p, ok := s.HandlerPlugins[handler]; ok {
+		return p
+	}
+	return s.ProxyPlugin
+}
+
+// FormatVersion returns the version of the configuration format of a
+// containerd release, such as 2 for "1.7.26" and 3 for "v2.0.3"
+func FormatVersion(containerdVersion string) (int, error) {
+	major, _, _ := strings.Cut(strings.TrimPrefix(containerdVersion, "v"), ".")
+	n, err := strconv.Atoi(major)
+	if err != nil {
+		return 0, errors.Errorf("invalid containerd version %q", containerdVersion)
+	}
+	switch {
+	case n < 1:
+		return 0, errors.Errorf("unsupported containerd version %q", containerdVersion)
+	case n == 1:
+		return 2, nil
+	default:
+		return 3, nil
+	}
+}
+
+// apply sets the settings in tree, keeping the other values
+func (s Settings) apply(tree map[string]interface{}) {
+	tree["version"] = int64(s.Version)
+	c := &Config{Version: s.Version}
+	set(tree, false, c.SnapshotAnnotationsKey()...)
+	for _, h := range s.Handlers {
+		set(tree, s.proxyPlugin(h), append(c.RuntimesKey(), h, "snapshotter")...)
+		if key := c.RuntimePlatformsKey(); key != nil {
+			set(tree, s.proxyPlugin(h), append(key, h, "snapshotter")...)
+		}
+	}
+	plugins := []string{s.ProxyPlugin}
+	for _, p := range s.HandlerPlugins {
+		plugins = append(plugins, p)
+	}
+	for _, p := range plugins {
+		set(tree, "snapshot", "proxy_plugins", p, "type")
+		set(tree, s.Address, "proxy_plugins", p, "address")
+	}
+}
+
+// set sets the value at the path of keys, creating the missing tables and
+// replacing the values in the way
+func set(tree map[string]interface{}, value interface{}, keys ...string) {
+	for _, k := range keys[:len(keys)-1] {
+		next, ok := tree[k].(map[string]interface{})
+		if !ok {
+			next = map[string]interface{}{}
+			tree[k] = next
+		}
+		tree = next
+	}
+	tree[keys[len(keys)-1]] = value
+}
+
+// Generate returns a configuration file made of the settings only
+func Generate(s Settings) ([]byte, error) {
+	if s.Version != 2 && s.Version != 3 {
+		return nil, errors.Errorf("unsupported containerd config version %d", s.Version)
+	}
+	tree := map[string]interface{}{}
+	s.apply(tree)
+	return marshal(tree)
+}
+
+// Merge returns the configuration file at path with the settings applied,
+// leaving the files it imports alone. The file is rewritten from its parsed
+// content, which drops its comments and formatting. If the file sets its
+// version, that version decides where the settings go, otherwise s.Version
+// does, as drop-ins imported by the main file often set none. A missing file
+// is merged as an empty one.
+func Merge(path string, s Settings) ([]byte, error) {
+	tree := map[string]interface{}{}
+	if _, err := os.Stat(path); err == nil {
+		if tree, err = readTree(path); err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, errors.Wrapf(err, "failed to read containerd config %s", path)
+	}
+
+	if v, ok := tree["version"].(int64); ok {
+		s.Version = int(v)
+	}
+	if s.Version != 2 && s.Version != 3 {
+		return nil, errors.Errorf("%s uses version %d of the containerd config format, convert it with `containerd config migrate`", path, s.Version)
+	}
+	s.apply(tree)
+	return marshal(tree)
+}
+
+func marshal(tree map[string]interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := toml.NewEncoder(&buf)
+	enc.SetIndentTables(true)
+	if err := enc.Encode(tree); err != nil {
+		return nil, errors.Wrap(err, "failed to encode containerd config")
+	}
+	return buf.Bytes(), nil
+}
+
+// WriteFile replaces the file at path with data, keeping its mode
+func WriteFile(path string, data []byte) error {
+	mode := os.FileMode(0644)
+	if fi, err := os.Stat(path); err == nil {
+		mode = fi.Mode().Perm()
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return errors.Wrapf(err, "failed to create directory of %s", path)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return errors.Wrapf(err, "failed to write %s", path)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return errors.Wrapf(err, "failed to write %s", path)
+	}
+	if err := tmp.Chmod(mode); err != nil {
+		tmp.Close()
+		return errors.Wrapf(err, "failed to write %s", path)
+	}
+	if err := tmp.Close(); err != nil {
+		return errors.Wrapf(err, "failed to write %s", path)
+	}
+	return errors.Wrapf(os.Rename(tmp.Name(), path), "failed to replace %s", path)
+}
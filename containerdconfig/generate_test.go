@@ -0,0 +1,200 @@
+package containerdconfig
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFormatVersion(t *testing.T) {
+	for version, expected := range map[string]int{
+		"1.7":    2,
+		"1.7.26": 2,
+		"2.0":    3,
+		"v2.0.3": 3,
+		"2":      3,
+	} {
+		v, err := FormatVersion(version)
+		require.NoError(t, err, version)
+		assert.Equal(t, expected, v, version)
+	}
+	for _, version := range []string{"", "latest", "0.9"} {
+		_, err := FormatVersion(version)
+		assert.Error(t, err, version)
+	}
+}
+
+// loadSettings writes data to a file and loads it as a containerd config
+func loadSettings(t *testing.T, data []byte) *Config {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.toml")
+	require.NoError(t, os.WriteFile(path, data, 0644))
+	cfg, err := Load(path)
+	require.NoError(t, err)
+	return cfg
+}
+
+func TestGenerate(t *testing.T) {
+	for _, version := range []int{2, 3} {
+		data, err := Generate(Settings{
+			Version:     version,
+			ProxyPlugin: "guest-pull",
+			Address:     "/run/guest-pull.sock",
+			Handlers:    []string{"kata-qemu", "kata-qemu-coco-dev"},
+		})
+		require.NoError(t, err)
+
+		cfg := loadSettings(t, data)
+		assert.Equal(t, version, cfg.Version)
+		assert.False(t, cfg.SnapshotAnnotationsDisabled())
+		typ, address, ok := cfg.ProxyPlugin("guest-pull")
+		require.True(t, ok)
+		assert.Equal(t, "snapshot", typ)
+		assert.Equal(t, "/run/guest-pull.sock", address)
+
+		runtimes := cfg.Runtimes()
+		require.Len(t, runtimes, 2)
+		for _, r := range runtimes {
+			assert.Equal(t, "guest-pull", r.Snapshotter, r.Handler)
+			assert.Equal(t, "guest-pull", r.PullSnapshotter, r.Handler)
+		}
+	}
+
+	_, err := Generate(Settings{Version: 1})
+	assert.Error(t, err)
+}
+
+func TestGenerateHandlerPlugins(t *testing.T) {
+	data, err := Generate(Settings{
+		Version:        3,
+		ProxyPlugin:    "guest-pull",
+		Address:        "/run/guest-pull.sock",
+		Handlers:       []string{"kata-qemu", "kata-qemu-coco-dev"},
+		HandlerPlugins: map[string]string{"kata-qemu-coco-dev": "guest-pull-kata-qemu-coco-dev"},
+	})
+	require.NoError(t, err)
+
+	cfg := loadSettings(t, data)
+	for _, name := range []string{"guest-pull", "guest-pull-kata-qemu-coco-dev"} {
+		_, address, ok := cfg.ProxyPlugin(name)
+		require.True(t, ok, name)
+		assert.Equal(t, "/run/guest-pull.sock", address)
+	}
+
+	snapshotters := map[string]string{}
+	for _, r := range cfg.Runtimes() {
+		snapshotters[r.Handler] = r.Snapshotter
+	}
+	assert.Equal(t, map[string]string{
+		"kata-qemu":          "guest-pull",
+		"kata-qemu-coco-dev": "guest-pull-kata-qemu-coco-dev",
+	}, snapshotters)
+}
+
+func TestMerge(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.toml")
+	require.NoError(t, os.WriteFile(path, []byte(`
+version = 2
+root = "/var/lib/containerd"
+
+# Dropped by the merge
+[plugins."io.containerd.grpc.v1.cri".containerd]
+  snapshotter = "overlayfs"
+  disable_snapshot_annotations = true
+
+[plugins."io.containerd.grpc.v1.cri".containerd.runtimes.kata-qemu-coco-dev]
+  runtime_type = "io.containerd.kata-qemu-coco-dev.v2"
+  snapshotter = "nydus"
+
+[proxy_plugins.nydus]
+  type = "snapshot"
+  address = "/run/nydus.sock"
+`), 0600))
+
+	// The version of the file wins over the requested one
+	data, err := Merge(path, Settings{
+		Version:     3,
+		ProxyPlugin: "guest-pull",
+		Address:     "/run/guest-pull.sock",
+		Handlers:    []string{"kata-qemu-coco-dev"},
+	})
+	require.NoError(t, err)
+	require.NoError(t, WriteFile(path, data))
+	fi, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+
+	cfg, err := Load(path)
+	require.NoError(t, err)
+	assert.Equal(t, 2, cfg.Version)
+	assert.False(t, cfg.SnapshotAnnotationsDisabled())
+	root, _ := cfg.Lookup("root")
+	assert.Equal(t, "/var/lib/containerd", root)
+	snapshotter, _ := cfg.Lookup("plugins", CRIPluginV2, "containerd", "snapshotter")
+	assert.Equal(t, "overlayfs", snapshotter)
+	_, _, ok := cfg.ProxyPlugin("nydus")
+	assert.True(t, ok)
+	_, address, ok := cfg.ProxyPlugin("guest-pull")
+	require.True(t, ok)
+	assert.Equal(t, "/run/guest-pull.sock", address)
+	assert.Equal(t, []Runtime{{
+		Handler:         "kata-qemu-coco-dev",
+		Type:            "io.containerd.kata-qemu-coco-dev.v2",
+		Snapshotter:     "guest-pull",
+		PullSnapshotter: "guest-pull",
+	}}, cfg.Runtimes())
+
+	// Merging is idempotent
+	again, err := Merge(path, Settings{Version: 3, ProxyPlugin: "guest-pull", Address: "/run/guest-pull.sock", Handlers: []string{"kata-qemu-coco-dev"}})
+	require.NoError(t, err)
+	assert.Equal(t, string(data), string(again))
+
+	// Missing files are created with the requested version
+	missing := filepath.Join(t.TempDir(), "config.toml")
+	data, err = Merge(missing, Settings{Version: 3, ProxyPlugin: "guest-pull", Address: "/run/guest-pull.sock"})
+	require.NoError(t, err)
+	assert.Equal(t, 3, loadSettings(t, data).Version)
+
+	// Files of unsupported versions are refused
+	require.NoError(t, os.WriteFile(missing, []byte("version = 1\n"), 0644))
+	_, err = Merge(missing, Settings{Version: 3, ProxyPlugin: "guest-pull"})
+	assert.Error(t, err)
+}
+
+func TestMergeDropIn(t *testing.T) {
+	// Drop-ins such as the one of kata-deploy set no version
+	path := filepath.Join(t.TempDir(), "kata-deploy.toml")
+	require.NoError(t, os.WriteFile(path, []byte(`
+[plugins."io.containerd.cri.v1.runtime".containerd.runtimes.kata-qemu-coco-dev]
+  runtime_type = "io.containerd.kata-qemu-coco-dev.v2"
+  runtime_path = "/opt/kata/bin/containerd-shim-kata-v2"
+`), 0644))
+
+	version, err := FormatVersion("2.0.3")
+	require.NoError(t, err)
+	data, err := Merge(path, Settings{
+		Version:     version,
+		ProxyPlugin: "guest-pull",
+		Address:     "/run/guest-pull.sock",
+		Handlers:    []string{"kata-qemu-coco-dev"},
+	})
+	require.NoError(t, err)
+	require.NoError(t, WriteFile(path, data))
+
+	cfg, err := Load(path)
+	require.NoError(t, err)
+	assert.Equal(t, 3, cfg.Version)
+	_, address, ok := cfg.ProxyPlugin("guest-pull")
+	require.True(t, ok)
+	assert.Equal(t, "/run/guest-pull.sock", address)
+	assert.Equal(t, []Runtime{{
+		Handler:         "kata-qemu-coco-dev",
+		Type:            "io.containerd.kata-qemu-coco-dev.v2",
+		Path:            "/opt/kata/bin/containerd-shim-kata-v2",
+		Snapshotter:     "guest-pull",
+		PullSnapshotter: "guest-pull",
+	}}, cfg.Runtimes())
+}
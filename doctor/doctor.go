@@ -0,0 +1,394 @@
+// Package doctor diagnoses the setups where the guest pull snapshotter can't
+// work: a containerd configuration that doesn't route Kata runtimes to it, a
+// missing or mismatched mount helper, an unpatched Kata shim or a root
+// directory where overlays can't be mounted
+package doctor
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/ChengyuZhu6/guest-pull-snapshotter/containerdconfig"
+)
+
+// Severities of findings
+const (
+	SeverityOK      = "ok"
+	SeverityWarning = "warning"
+	SeverityError   = "error"
+)
+
+// Finding is the outcome of a check
+type Finding struct {
+	Severity string
+	Check    string
+	Message  string
+	// Fix is what to do about a warning or an error
+	Fix string
+}
+
+// Options are the settings the checks compare the setup against
+type Options struct {
+	// ContainerdConfig is the containerd configuration file
+	ContainerdConfig string
+	// ProxyPlugin is the name of the snapshotter in containerd
+	ProxyPlugin string
+	// HandlerPlugins are the names of the snapshotters of the runtime
+	// handlers with volume settings of their own, by handler
+	HandlerPlugins map[string]string
+	// Address is the socket the snapshotter serves
+	Address string
+	// Root is the root directory of the snapshotter
+	Root string
+	// Helper is the name of the mount helper binary
+	Helper string
+	// MountType is the type of the mounts of the snapshotter
+	MountType string
+	// Version is the version of the snapshotter, which the mount helper must
+	// match
+	Version string
+	// ShimDirs are searched for Kata shims after PATH
+	ShimDirs []string
+}
+
+// proxyPlugin returns the name of the snapshotter of the runtime handler
+func (o Options) proxyPlugin(handler string) string {
+	if p, ok := o.HandlerPlugins[handler]; ok {
+		return p
+	}
+	return o.ProxyPlugin
+}
+
+// shimMarker is a function of the Kata guest pull patch, whose name is kept in
+// the shim binary
+const shimMarker = "IsGuestPullRootFSType"
+
+// Run runs all the checks
+func Run(ctx context.Context, opts Options) []Finding {
+	var findings []Finding
+	cfg, configFindings := checkContainerdConfig(opts)
+	findings = append(findings, configFindings...)
+	findings = append(findings, checkMountType(opts.MountType))
+	if opts.Helper != "" {
+		findings = append(findings, checkHelper(ctx, opts))
+	}
+	if cfg != nil {
+		findings = append(findings, checkKataShims(cfg, opts)...)
+	}
+	findings = append(findings, checkOverlay(opts.Root))
+	return findings
+}
+
+// HasErrors reports whether one of findings is an error
+func HasErrors(findings []Finding) bool {
+	for _, f := range findings {
+		if f.Severity == SeverityError {
+			return true
+		}
+	}
+	return false
+}
+
+// Print writes findings to w, one per line followed by its fix
+func Print(w io.Writer, findings []Finding) {
+	for _, f := range findings {
+		fmt.Fprintf(w, "[%s] %s: %s\n", f.Severity, f.Check, f.Message)
+		if f.Fix != "" {
+			fmt.Fprintf(w, "    fix: %s\n", f.Fix)
+		}
+	}
+}
+
+// section returns the TOML table header of the parent of a setting at keys
+func section(keys []string) string {
+	quoted := make([]string, len(keys)-1)
+	for i, k := range keys[:len(keys)-1] {
+		if strings.Contains(k, ".") {
+			k = fmt.Sprintf("%q", k)
+		}
+		quoted[i] = k
+	}
+	return "[" + strings.Join(quoted, ".") + "]"
+}
+
+func checkContainerdConfig(opts Options) (*containerdconfig.Config, []Finding) {
+	const check = "containerd config"
+	cfg, err := containerdconfig.Load(opts.ContainerdConfig)
+	if err != nil {
+		return nil, []Finding{{
+			Severity: SeverityError,
+			Check:    check,
+			Message:  err.Error(),
+			Fix:      "pass the containerd configuration file with --containerd-config",
+		}}
+	}
+	if !cfg.Supported() {
+		return nil, []Finding{{
+			Severity: SeverityError,
+			Check:    check,
+			Message:  fmt.Sprintf("%s uses version %d of the configuration format, only versions 2 and 3 are supported", cfg.Path, cfg.Version),
+			Fix:      "convert it with `containerd config migrate`",
+		}}
+	}
+
+	findings := []Finding{{
+		Severity: SeverityOK,
+		Check:    check,
+		Message:  fmt.Sprintf("%s is version %d, importing %d files", cfg.Path, cfg.Version, len(cfg.Imports)),
+	}}
+
+	key := cfg.SnapshotAnnotationsKey()
+	if cfg.SnapshotAnnotationsDisabled() {
+		findings = append(findings, Finding{
+			Severity: SeverityError,
+			Check:    "snapshot annotations",
+			Message:  "the CRI doesn't pass the image annotations the snapshotter needs to leave images to the guest",
+			Fix:      fmt.Sprintf("set `%s = false` under %s", key[len(key)-1], section(key)),
+		})
+	} else {
+		findings = append(findings, Finding{Severity: SeverityOK, Check: "snapshot annotations", Message: "passed to snapshotters"})
+	}
+
+	findings = append(findings, checkProxyPlugin(cfg, "proxy plugin", opts.ProxyPlugin, opts.Address))
+	var plugins []string
+	for _, p := range opts.HandlerPlugins {
+		plugins = append(plugins, p)
+	}
+	sort.Strings(plugins)
+	for _, p := range plugins {
+		findings = append(findings, checkProxyPlugin(cfg, "proxy plugin "+p, p, opts.Address))
+	}
+
+	var kata int
+	for _, r := range cfg.Runtimes() {
+		if !r.IsKata() {
+			continue
+		}
+		kata++
+		check := "runtime " + r.Handler
+		plugin := opts.proxyPlugin(r.Handler)
+		switch {
+		case r.Snapshotter != plugin:
+			findings = append(findings, Finding{Severity: SeverityWarning, Check: check,
+				Message: fmt.Sprintf("containers use snapshotter %q", r.Snapshotter),
+				Fix:     fmt.Sprintf("set snapshotter = %q under %s", plugin, section(append(cfg.RuntimesKey(), r.Handler, "snapshotter")))})
+		case r.PullSnapshotter != plugin:
+			findings = append(findings, Finding{Severity: SeverityWarning, Check: check,
+				Message: fmt.Sprintf("images are pulled with snapshotter %q", r.PullSnapshotter),
+				Fix:     fmt.Sprintf("set snapshotter = %q under %s", plugin, section(append(cfg.RuntimePlatformsKey(), r.Handler, "snapshotter")))})
+		default:
+			findings = append(findings, Finding{Severity: SeverityOK, Check: check, Message: "uses the guest pull snapshotter"})
+		}
+	}
+	if kata == 0 {
+		findings = append(findings, Finding{Severity: SeverityWarning, Check: "runtimes",
+			Message: "no Kata runtime handler is configured",
+			Fix:     "install Kata Containers and map its runtime handlers to the snapshotter"})
+	}
+
+	return cfg, findings
+}
+
+// checkProxyPlugin checks that containerd connects the snapshotter name to
+// the socket the snapshotter serves
+func checkProxyPlugin(cfg *containerdconfig.Config, check, name, address string) Finding {
+	plugin := "proxy_plugins." + name
+	typ, got, ok := cfg.ProxyPlugin(name)
+	fix := fmt.Sprintf("add [%s] with type = \"snapshot\" and address = %q", plugin, address)
+	switch {
+	case !ok:
+		return Finding{Severity: SeverityError, Check: check, Message: plugin + " is missing", Fix: fix}
+	case typ != "snapshot":
+		return Finding{Severity: SeverityError, Check: check,
+			Message: fmt.Sprintf("%s has type %q", plugin, typ), Fix: fix}
+	case got != address:
+		return Finding{Severity: SeverityError, Check: check,
+			Message: fmt.Sprintf("%s connects to %q, the snapshotter serves %q", plugin, got, address), Fix: fix}
+	default:
+		return Finding{Severity: SeverityOK, Check: check, Message: fmt.Sprintf("%s connects to %q", plugin, got)}
+	}
+}
+
+// checkMountType checks that the Kata shim patched for guest pull, which
+// matches "fuse.guest-pull-overlayfs*", recognizes the mounts
+func checkMountType(mountType string) Finding {
+	const check = "mount type"
+	name, ok := strings.CutPrefix(mountType, "fuse.")
+	if !ok || !strings.HasPrefix(filepath.Base(name), "guest-pull-overlayfs") {
+		return Finding{Severity: SeverityWarning, Check: check,
+			Message: fmt.Sprintf("the patched Kata shim doesn't recognize mounts of type %q and would mount images on the host", mountType),
+			Fix:     "name the mount helper guest-pull-overlayfs or guest-pull-overlayfs-<variant> and leave mount.type unset"}
+	}
+	return Finding{Severity: SeverityOK, Check: check, Message: mountType}
+}
+
+func checkHelper(ctx context.Context, opts Options) Finding {
+	const check = "mount helper"
+	path, err := exec.LookPath(opts.Helper)
+	if err != nil {
+		return Finding{Severity: SeverityError, Check: check,
+			Message: fmt.Sprintf("%s is not on PATH", opts.Helper),
+			Fix:     "install it next to the snapshotter, such as with `make install`"}
+	}
+
+	out, err := exec.CommandContext(ctx, path, "--version").Output()
+	if err != nil {
+		return Finding{Severity: SeverityError, Check: check,
+			Message: fmt.Sprintf("%s --version failed: %v", path, err),
+			Fix:     "reinstall the mount helper"}
+	}
+	// guest-pull-overlayfs <version> <revision> (built <time>)
+	fields := strings.Fields(string(out))
+	if len(fields) < 2 {
+		return Finding{Severity: SeverityWarning, Check: check,
+			Message: fmt.Sprintf("%s printed an unknown version %q", path, strings.TrimSpace(string(out)))}
+	}
+	// Development builds don't know their version
+	if opts.Version != "unknown" && fields[1] != opts.Version {
+		return Finding{Severity: SeverityError, Check: check,
+			Message: fmt.Sprintf("%s is version %s, the snapshotter is version %s", path, fields[1], opts.Version),
+			Fix:     "install the mount helper and the snapshotter from the same release"}
+	}
+	return Finding{Severity: SeverityOK, Check: check, Message: fmt.Sprintf("%s is version %s", path, fields[1])}
+}
+
+func checkKataShims(cfg *containerdconfig.Config, opts Options) []Finding {
+	var findings []Finding
+	checked := map[string]bool{}
+	for _, r := range cfg.Runtimes() {
+		if !r.IsKata() || r.Snapshotter != opts.proxyPlugin(r.Handler) {
+			continue
+		}
+		check := "kata shim " + r.Handler
+		path := findShim(r.ShimBinary(), opts.ShimDirs)
+		if path == "" {
+			findings = append(findings, Finding{Severity: SeverityWarning, Check: check,
+				Message: fmt.Sprintf("shim %q not found", r.ShimBinary()),
+				Fix:     "set runtime_path of the runtime to the patched shim"})
+			continue
+		}
+		if resolved, err := filepath.EvalSymlinks(path); err == nil {
+			path = resolved
+		}
+		if checked[path] {
+			continue
+		}
+		checked[path] = true
+
+		patched, err := containsMarker(path, shimMarker)
+		switch {
+		case err != nil:
+			findings = append(findings, Finding{Severity: SeverityWarning, Check: check, Message: err.Error()})
+		case !patched:
+			findings = append(findings, Finding{Severity: SeverityError, Check: check,
+				Message: fmt.Sprintf("%s lacks the guest pull patch, it would mount images on the host", path),
+				Fix:     "install the patched shim with tests/prepare/install_patched_kata_runtime.sh"})
+		default:
+			findings = append(findings, Finding{Severity: SeverityOK, Check: check, Message: path + " is patched for guest pull"})
+		}
+	}
+	return findings
+}
+
+// findShim returns the path of the shim binary name, looked up on PATH and
+// then in dirs
+func findShim(name string, dirs []string) string {
+	if name == "" {
+		return ""
+	}
+	if filepath.IsAbs(name) {
+		if _, err := os.Stat(name); err != nil {
+			return ""
+		}
+		return name
+	}
+	if path, err := exec.LookPath(name); err == nil {
+		return path
+	}
+	for _, dir := range dirs {
+		path := filepath.Join(dir, name)
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return ""
+}
+
+// containsMarker reports whether the file at path contains marker
+func containsMarker(path, marker string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	// Chunks overlap by the length of the marker, so that it is found across
+	// their boundary
+	r := bufio.NewReaderSize(f, 1<<20)
+	buf := make([]byte, 1<<20)
+	var tail []byte
+	for {
+		n, err := r.Read(buf)
+		chunk := append(tail, buf[:n]...)
+		if bytes.Contains(chunk, []byte(marker)) {
+			return true, nil
+		}
+		if len(chunk) >= len(marker) {
+			tail = append([]byte(nil), chunk[len(chunk)-len(marker)+1:]...)
+		} else {
+			tail = chunk
+		}
+		if err == io.EOF {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+}
+
+func checkOverlay(root string) Finding {
+	const check = "overlay mount"
+	if os.Geteuid() != 0 {
+		return Finding{Severity: SeverityWarning, Check: check,
+			Message: "skipped, mounting a test overlay requires root",
+			Fix:     "run doctor as root"}
+	}
+	if err := os.MkdirAll(root, 0700); err != nil {
+		return Finding{Severity: SeverityError, Check: check, Message: err.Error()}
+	}
+
+	dir, err := os.MkdirTemp(root, "doctor-")
+	if err != nil {
+		return Finding{Severity: SeverityError, Check: check, Message: err.Error()}
+	}
+	defer os.RemoveAll(dir)
+
+	for _, d := range []string{"lower", "upper", "work", "merged"} {
+		if err := os.Mkdir(filepath.Join(dir, d), 0700); err != nil {
+			return Finding{Severity: SeverityError, Check: check, Message: err.Error()}
+		}
+	}
+	merged := filepath.Join(dir, "merged")
+	data := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s",
+		filepath.Join(dir, "lower"), filepath.Join(dir, "upper"), filepath.Join(dir, "work"))
+	if err := unix.Mount("overlay", merged, "overlay", 0, data); err != nil {
+		return Finding{Severity: SeverityError, Check: check,
+			Message: fmt.Sprintf("can't mount an overlay in %s: %v", root, err),
+			Fix:     "put the root directory on a filesystem supported as overlay upper directory, such as ext4 or xfs, and check that the overlay module is loaded"}
+	}
+	if err := unix.Unmount(merged, 0); err != nil {
+		return Finding{Severity: SeverityWarning, Check: check, Message: fmt.Sprintf("failed to unmount %s: %v", merged, err)}
+	}
+	return Finding{Severity: SeverityOK, Check: check, Message: "overlays can be mounted in " + root}
+}
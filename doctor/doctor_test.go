@@ -0,0 +1,155 @@
+package doctor
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ChengyuZhu6/guest-pull-snapshotter/containerdconfig"
+)
+
+// byCheck indexes findings by check
+func byCheck(findings []Finding) map[string]Finding {
+	m := map[string]Finding{}
+	for _, f := range findings {
+		m[f.Check] = f
+	}
+	return m
+}
+
+func TestCheckContainerdConfig(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.toml")
+	opts := Options{ContainerdConfig: path, ProxyPlugin: "guest-pull", Address: "/run/guest-pull.sock"}
+
+	require.NoError(t, os.WriteFile(path, []byte(`
+version = 3
+
+[plugins."io.containerd.cri.v1.runtime".containerd.runtimes.kata-qemu-coco-dev]
+  runtime_type = "io.containerd.kata-qemu-coco-dev.v2"
+  snapshotter = "guest-pull"
+
+[proxy_plugins.guest-pull]
+  type = "snapshot"
+  address = "/run/other.sock"
+`), 0644))
+	cfg, findings := checkContainerdConfig(opts)
+	require.NotNil(t, cfg)
+	checks := byCheck(findings)
+	assert.Equal(t, SeverityError, checks["snapshot annotations"].Severity)
+	assert.Equal(t, "set `disable_snapshot_annotations = false` under [plugins.\"io.containerd.cri.v1.images\"]",
+		checks["snapshot annotations"].Fix)
+	assert.Equal(t, SeverityError, checks["proxy plugin"].Severity)
+	assert.Contains(t, checks["proxy plugin"].Message, "/run/other.sock")
+	rt := checks["runtime kata-qemu-coco-dev"]
+	assert.Equal(t, SeverityWarning, rt.Severity)
+	assert.Contains(t, rt.Fix, `[plugins."io.containerd.cri.v1.images".runtime_platforms.kata-qemu-coco-dev]`)
+
+	require.NoError(t, os.WriteFile(path, []byte(`
+version = 2
+
+[plugins."io.containerd.grpc.v1.cri".containerd]
+  disable_snapshot_annotations = false
+
+[plugins."io.containerd.grpc.v1.cri".containerd.runtimes.kata-qemu-coco-dev]
+  runtime_type = "io.containerd.kata-qemu-coco-dev.v2"
+  snapshotter = "guest-pull"
+
+[proxy_plugins.guest-pull]
+  type = "snapshot"
+  address = "/run/guest-pull.sock"
+`), 0644))
+	_, findings = checkContainerdConfig(opts)
+	assert.False(t, HasErrors(findings))
+	for _, f := range findings {
+		assert.Equal(t, SeverityOK, f.Severity, f.Check)
+	}
+
+	// A runtime handler with a snapshotter of its own
+	opts.HandlerPlugins = map[string]string{"kata-qemu-coco-dev": "guest-pull-kata-qemu-coco-dev"}
+	_, findings = checkContainerdConfig(opts)
+	checks = byCheck(findings)
+	assert.Equal(t, SeverityOK, checks["proxy plugin"].Severity)
+	assert.Equal(t, SeverityError, checks["proxy plugin guest-pull-kata-qemu-coco-dev"].Severity)
+	assert.Equal(t, SeverityWarning, checks["runtime kata-qemu-coco-dev"].Severity)
+	assert.Contains(t, checks["runtime kata-qemu-coco-dev"].Fix, `"guest-pull-kata-qemu-coco-dev"`)
+	opts.HandlerPlugins = nil
+
+	require.NoError(t, os.WriteFile(path, []byte("[plugins.cri]\n"), 0644))
+	cfg, findings = checkContainerdConfig(opts)
+	assert.Nil(t, cfg)
+	assert.True(t, HasErrors(findings))
+}
+
+func TestCheckKataShims(t *testing.T) {
+	dir := t.TempDir()
+	shim := filepath.Join(dir, "containerd-shim-kata-v2")
+	require.NoError(t, os.WriteFile(shim, []byte("shim without the patch"), 0755))
+	path := filepath.Join(dir, "config.toml")
+	require.NoError(t, os.WriteFile(path, []byte(`
+version = 3
+
+[plugins."io.containerd.cri.v1.runtime".containerd.runtimes.kata-qemu-coco-dev]
+  runtime_type = "io.containerd.kata-qemu-coco-dev.v2"
+  runtime_path = "`+shim+`"
+  snapshotter = "guest-pull-kata-qemu-coco-dev"
+`), 0644))
+	cfg, err := containerdconfig.Load(path)
+	require.NoError(t, err)
+
+	// Runtimes of handlers with a snapshotter of their own are checked
+	opts := Options{
+		ProxyPlugin:    "guest-pull",
+		HandlerPlugins: map[string]string{"kata-qemu-coco-dev": "guest-pull-kata-qemu-coco-dev"},
+	}
+	findings := checkKataShims(cfg, opts)
+	require.Len(t, findings, 1)
+	assert.Equal(t, "kata shim kata-qemu-coco-dev", findings[0].Check)
+	assert.Equal(t, SeverityError, findings[0].Severity)
+
+	// Runtimes using another snapshotter are not
+	opts.HandlerPlugins = nil
+	assert.Empty(t, checkKataShims(cfg, opts))
+}
+
+func TestContainsMarker(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "shim")
+	// The marker straddles the boundary of the first chunk read
+	data := append(bytes.Repeat([]byte{0}, 1<<20-5), []byte(shimMarker)...)
+	require.NoError(t, os.WriteFile(path, data, 0755))
+	found, err := containsMarker(path, shimMarker)
+	require.NoError(t, err)
+	assert.True(t, found)
+
+	require.NoError(t, os.WriteFile(path, bytes.Repeat([]byte{0}, 3<<20), 0755))
+	found, err = containsMarker(path, shimMarker)
+	require.NoError(t, err)
+	assert.False(t, found)
+}
+
+func TestPrint(t *testing.T) {
+	var buf strings.Builder
+	Print(&buf, []Finding{
+		{Severity: SeverityOK, Check: "proxy plugin", Message: "fine"},
+		{Severity: SeverityError, Check: "mount helper", Message: "missing", Fix: "install it"},
+	})
+	assert.Equal(t, "[ok] proxy plugin: fine\n[error] mount helper: missing\n    fix: install it\n", buf.String())
+	assert.True(t, HasErrors([]Finding{{Severity: SeverityError}}))
+	assert.False(t, HasErrors([]Finding{{Severity: SeverityWarning}}))
+}
+
+func TestCheckMountType(t *testing.T) {
+	for mountType, severity := range map[string]string{
+		"fuse.guest-pull-overlayfs":        SeverityOK,
+		"fuse.guest-pull-overlayfs-verity": SeverityOK,
+		"fuse3.guest-pull-overlayfs":       SeverityWarning,
+		"fuse.other-overlayfs":             SeverityWarning,
+	} {
+		assert.Equal(t, severity, checkMountType(mountType).Severity, mountType)
+	}
+}
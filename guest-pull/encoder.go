@@ -0,0 +1,339 @@
+package guestpull
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/containerd/log"
+	"github.com/pelletier/go-toml/v2"
+	"github.com/pkg/errors"
+)
+
+// Names of the built-in encoders
+const (
+	// EncoderKata passes the volume in the io.katacontainers.volume option
+	// read by the Kata runtime
+	EncoderKata = "kata"
+
+	// EncoderCCInitData passes the volume as a file of a Confidential
+	// Containers initdata document, in the cc_init_data option
+	EncoderCCInitData = "cc-init-data"
+
+	// EncoderNydus passes the volume in the extraoption option read by the
+	// runtimes supporting the nydus snapshotter
+	EncoderNydus = "nydus"
+)
+
+// Options of the built-in encoders
+const (
+	// CCInitDataOptionName is the option of the cc-init-data encoder, named
+	// after the Kata annotation holding initdata
+	CCInitDataOptionName = "io.katacontainers.config.hypervisor.cc_init_data"
+
+	// NydusExtraOptionName is the option of the nydus encoder
+	NydusExtraOptionName = "extraoption"
+)
+
+// Encoder encodes the volume describing a snapshot to the guest into mount
+// options read by the runtime
+type Encoder interface {
+	// Encode returns the mount options carrying volume
+	Encode(ctx context.Context, volume *KataVirtualVolume) ([]string, error)
+
+	// Decode returns the volume carried by a mount option, and false if the
+	// option is not one of the encoder
+	Decode(option string) (*KataVirtualVolume, bool, error)
+}
+
+var encoders = map[string]func(Profile) Encoder{
+	EncoderKata:       func(p Profile) Encoder { return KataEncoder{Profile: p} },
+	EncoderCCInitData: func(p Profile) Encoder { return CCInitDataEncoder{Profile: p} },
+	EncoderNydus:      func(p Profile) Encoder { return NydusEncoder{Profile: p} },
+}
+
+// NewEncoder returns the built-in encoder name, the Kata one if name is
+// empty, writing volumes in the schema of profile, the default one if empty
+func NewEncoder(name, profile string) (Encoder, error) {
+	if name == "" {
+		name = EncoderKata
+	}
+	newEncoder, ok := encoders[name]
+	if !ok {
+		return nil, errors.Errorf("unknown volume encoder %q, expected one of %v", name, EncoderNames())
+	}
+	p, err := LookupProfile(profile)
+	if err != nil {
+		return nil, err
+	}
+	return newEncoder(p), nil
+}
+
+// EncoderNames returns the names of the built-in encoders, sorted
+func EncoderNames() []string {
+	names := make([]string, 0, len(encoders))
+	for name := range encoders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// IsVolumeOption reports whether a mount option carries a volume for the
+// runtime, which the mount helper must not pass to the kernel
+func IsVolumeOption(option string) bool {
+	name, _, ok := strings.Cut(option, "=")
+	if !ok {
+		return false
+	}
+	switch name {
+	case KataVirtualVolumeOptionName, CCInitDataOptionName, NydusExtraOptionName:
+		return true
+	}
+	return false
+}
+
+// DecodeVolumeOption returns the volume carried by a mount option of any of
+// the built-in encoders, written in any of the profiles. Decoding in another
+// profile than the one of the option loses the fields it names differently,
+// so the profile whose encoder writes the volume back to the same option
+// wins, and the default one otherwise.
+func DecodeVolumeOption(option string) (*KataVirtualVolume, error) {
+	names := []string{DefaultProfile}
+	for _, profile := range ProfileNames() {
+		if profile != DefaultProfile {
+			names = append(names, profile)
+		}
+	}
+
+	for _, name := range EncoderNames() {
+		var decoded *KataVirtualVolume
+		var decodeErr error
+		for i, profile := range names {
+			e := encoders[name](profiles[profile])
+			volume, ok, err := e.Decode(option)
+			if !ok {
+				break
+			}
+			if err == nil && encodesTo(e, volume, option) {
+				return volume, nil
+			}
+			if i == 0 {
+				decoded, decodeErr = volume, err
+			}
+		}
+		if decoded != nil || decodeErr != nil {
+			return decoded, decodeErr
+		}
+	}
+	return nil, errors.Errorf("unknown volume option %q", option)
+}
+
+// encodesTo reports whether e encodes volume to option
+func encodesTo(e Encoder, volume *KataVirtualVolume, option string) bool {
+	options, err := e.Encode(context.Background(), volume)
+	return err == nil && slices.Contains(options, option)
+}
+
+// NewGuestPullVolume returns the volume of a snapshot pulled in the guest
+func NewGuestPullVolume(source string, options []string, metadata map[string]string) *KataVirtualVolume {
+	return &KataVirtualVolume{
+		VolumeType: KataVirtualVolumeImageGuestPullType,
+		Source:     source,
+		Options:    options,
+		ImagePull: &ImagePullVolume{
+			Metadata: metadata,
+		},
+	}
+}
+
+// KataEncoder encodes the volume as the base64 encoded JSON of a Kata virtual
+// volume
+type KataEncoder struct {
+	// Profile is the schema of the JSON, the zero value being that of
+	// KataVirtualVolume
+	Profile Profile
+}
+
+// Encode implements Encoder
+func (e KataEncoder) Encode(ctx context.Context, volume *KataVirtualVolume) ([]string, error) {
+	if err := ValidateVolumeConfig(volume); err != nil {
+		return nil, errors.Wrap(err, "invalid volume configuration")
+	}
+
+	volumeJSON, err := e.Profile.Marshal(volume)
+	if err != nil {
+		return nil, err
+	}
+
+	option := KataVirtualVolumeOptionName + "=" + base64.StdEncoding.EncodeToString(volumeJSON)
+	log.G(ctx).WithField("option", option).Debug("prepared guest pull mount option")
+	return []string{option}, nil
+}
+
+// Decode implements Encoder
+func (e KataEncoder) Decode(option string) (*KataVirtualVolume, bool, error) {
+	encoded, ok := strings.CutPrefix(option, KataVirtualVolumeOptionName+"=")
+	if !ok {
+		return nil, false, nil
+	}
+	volumeJSON, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, true, errors.Wrap(err, "failed to decode volume configuration")
+	}
+	volume, err := e.Profile.Unmarshal(volumeJSON)
+	return volume, true, err
+}
+
+// CCInitDataEncoder encodes the volume as the gzipped and base64 encoded TOML
+// of an initdata document, as Confidential Containers pass initdata in the
+// cc_init_data annotation. The document holds the JSON of the Kata virtual
+// volume in its guest-pull-volume.json file.
+type CCInitDataEncoder struct {
+	// Profile is the schema of the JSON of the volume
+	Profile Profile
+}
+
+// ccInitDataFile is the file of the initdata document holding the volume
+const ccInitDataFile = "guest-pull-volume.json"
+
+// initData is an initdata document
+type initData struct {
+	Algorithm string            `toml:"algorithm"`
+	Version   string            `toml:"version"`
+	Data      map[string]string `toml:"data"`
+}
+
+// Encode implements Encoder
+func (e CCInitDataEncoder) Encode(ctx context.Context, volume *KataVirtualVolume) ([]string, error) {
+	if err := ValidateVolumeConfig(volume); err != nil {
+		return nil, errors.Wrap(err, "invalid volume configuration")
+	}
+
+	volumeJSON, err := e.Profile.Marshal(volume)
+	if err != nil {
+		return nil, err
+	}
+	doc, err := toml.Marshal(initData{
+		Algorithm: "sha256",
+		Version:   "0.1.0",
+		Data:      map[string]string{ccInitDataFile: string(volumeJSON)},
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to marshal initdata")
+	}
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(doc); err != nil {
+		return nil, errors.Wrap(err, "failed to compress initdata")
+	}
+	if err := zw.Close(); err != nil {
+		return nil, errors.Wrap(err, "failed to compress initdata")
+	}
+
+	option := CCInitDataOptionName + "=" + base64.StdEncoding.EncodeToString(buf.Bytes())
+	log.G(ctx).WithField("option", option).Debug("prepared guest pull mount option")
+	return []string{option}, nil
+}
+
+// Decode implements Encoder
+func (e CCInitDataEncoder) Decode(option string) (*KataVirtualVolume, bool, error) {
+	encoded, ok := strings.CutPrefix(option, CCInitDataOptionName+"=")
+	if !ok {
+		return nil, false, nil
+	}
+	compressed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, true, errors.Wrap(err, "failed to decode initdata")
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return nil, true, errors.Wrap(err, "failed to decompress initdata")
+	}
+	doc, err := io.ReadAll(zr)
+	if err != nil {
+		return nil, true, errors.Wrap(err, "failed to decompress initdata")
+	}
+
+	var data initData
+	if err := toml.Unmarshal(doc, &data); err != nil {
+		return nil, true, errors.Wrap(err, "failed to unmarshal initdata")
+	}
+	volumeJSON, ok := data.Data[ccInitDataFile]
+	if !ok {
+		return nil, true, errors.Errorf("initdata has no %s", ccInitDataFile)
+	}
+	volume, err := e.Profile.Unmarshal([]byte(volumeJSON))
+	return volume, true, err
+}
+
+// NydusEncoder encodes the volume as the base64 encoded JSON of the extra
+// option of the nydus snapshotter. Its source is that of the volume, its
+// config the JSON of the Kata virtual volume and its fs_version "guest_pull".
+type NydusEncoder struct {
+	// Profile is the schema of the JSON of the volume
+	Profile Profile
+}
+
+// nydusExtraOption is the extra option of the nydus snapshotter
+type nydusExtraOption struct {
+	Source      string `json:"source"`
+	Config      string `json:"config"`
+	Snapshotdir string `json:"snapshotdir"`
+	Version     string `json:"fs_version"`
+}
+
+// nydusGuestPullVersion is the fs_version of guest pulled volumes
+const nydusGuestPullVersion = "guest_pull"
+
+// Encode implements Encoder
+func (e NydusEncoder) Encode(ctx context.Context, volume *KataVirtualVolume) ([]string, error) {
+	if err := ValidateVolumeConfig(volume); err != nil {
+		return nil, errors.Wrap(err, "invalid volume configuration")
+	}
+
+	volumeJSON, err := e.Profile.Marshal(volume)
+	if err != nil {
+		return nil, err
+	}
+	extra, err := json.Marshal(nydusExtraOption{
+		Source:  volume.Source,
+		Config:  string(volumeJSON),
+		Version: nydusGuestPullVersion,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to marshal extra option")
+	}
+
+	option := NydusExtraOptionName + "=" + base64.StdEncoding.EncodeToString(extra)
+	log.G(ctx).WithField("option", option).Debug("prepared guest pull mount option")
+	return []string{option}, nil
+}
+
+// Decode implements Encoder
+func (e NydusEncoder) Decode(option string) (*KataVirtualVolume, bool, error) {
+	encoded, ok := strings.CutPrefix(option, NydusExtraOptionName+"=")
+	if !ok {
+		return nil, false, nil
+	}
+	extraJSON, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, true, errors.Wrap(err, "failed to decode extra option")
+	}
+	var extra nydusExtraOption
+	if err := json.Unmarshal(extraJSON, &extra); err != nil {
+		return nil, true, errors.Wrap(err, "failed to unmarshal extra option")
+	}
+	if extra.Version != nydusGuestPullVersion {
+		return nil, true, errors.Errorf("extra option has fs_version %q, expected %q", extra.Version, nydusGuestPullVersion)
+	}
+	volume, err := e.Profile.Unmarshal([]byte(extra.Config))
+	return volume, true, err
+}
@@ -0,0 +1,75 @@
+package guestpull
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncoders(t *testing.T) {
+	ctx := context.Background()
+	volume := NewGuestPullVolume("docker.io/library/busybox:latest", []string{"lowerdir=/a"},
+		map[string]string{VolumeKindMetadataKey: VolumeKindImage})
+
+	for name, optionName := range map[string]string{
+		EncoderKata:       KataVirtualVolumeOptionName,
+		EncoderCCInitData: CCInitDataOptionName,
+		EncoderNydus:      NydusExtraOptionName,
+	} {
+		t.Run(name, func(t *testing.T) {
+			e, err := NewEncoder(name, "")
+			require.NoError(t, err)
+
+			options, err := e.Encode(ctx, volume)
+			require.NoError(t, err)
+			require.Len(t, options, 1)
+			assert.True(t, strings.HasPrefix(options[0], optionName+"="))
+			assert.True(t, IsVolumeOption(options[0]))
+
+			decoded, ok, err := e.Decode(options[0])
+			require.NoError(t, err)
+			require.True(t, ok)
+			assert.Equal(t, volume, decoded)
+
+			decoded, err = DecodeVolumeOption(options[0])
+			require.NoError(t, err)
+			assert.Equal(t, volume, decoded)
+
+			_, ok, _ = e.Decode("lowerdir=/a")
+			assert.False(t, ok)
+
+			_, err = e.Encode(ctx, &KataVirtualVolume{})
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestNewEncoder(t *testing.T) {
+	e, err := NewEncoder("", "")
+	require.NoError(t, err)
+	assert.Equal(t, KataEncoder{Profile: Profile{Name: DefaultProfile}}, e)
+
+	e, err = NewEncoder(EncoderNydus, ProfileKataMain)
+	require.NoError(t, err)
+	assert.Equal(t, NydusEncoder{Profile: Profile{Name: ProfileKataMain}}, e)
+
+	_, err = NewEncoder("", "kata-2.x")
+	assert.Error(t, err)
+
+	_, err = NewEncoder("kata-2", "")
+	assert.Error(t, err)
+	assert.Equal(t, []string{EncoderCCInitData, EncoderKata, EncoderNydus}, EncoderNames())
+}
+
+func TestIsVolumeOption(t *testing.T) {
+	assert.True(t, IsVolumeOption(KataVirtualVolumeOptionName+"=e30="))
+	assert.False(t, IsVolumeOption(KataVirtualVolumeOptionName))
+	assert.False(t, IsVolumeOption("lowerdir=/a"))
+	assert.False(t, IsVolumeOption("ro"))
+
+	_, err := DecodeVolumeOption("lowerdir=/a")
+	assert.Error(t, err)
+}
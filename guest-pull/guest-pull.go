@@ -6,9 +6,7 @@ import (
 	"context"
 	"encoding/base64"
 	"encoding/json"
-	"fmt"
 
-	"github.com/containerd/log"
 	"github.com/pkg/errors"
 )
 
@@ -23,6 +21,24 @@ const (
 	KataVirtualVolumeImageGuestPullType = "image_guest_pull"
 )
 
+// Metadata keys and values describing what a guest pull volume is used for
+const (
+	// VolumeKindMetadataKey tells the guest whether the volume is a container
+	// rootfs or an image mounted as a volume
+	VolumeKindMetadataKey = "io.katacontainers.volume.kind"
+
+	// VolumeKindRootfs marks the volume as the rootfs of a container
+	VolumeKindRootfs = "rootfs"
+
+	// VolumeKindImage marks the volume as an image or OCI artifact that is
+	// pulled in the guest and mounted read-only, such as a Kubernetes image volume
+	VolumeKindImage = "image"
+
+	// ImageReferenceMetadataKey carries the reference of the image to pull for
+	// image volumes
+	ImageReferenceMetadataKey = "io.katacontainers.volume.image-ref"
+)
+
 // ImagePullVolume represents the metadata for an image pull volume
 type ImagePullVolume struct {
 	Metadata map[string]string `json:"metadata"`
@@ -56,33 +72,28 @@ func ValidateVolumeConfig(volume *KataVirtualVolume) error {
 
 // PrepareGuestPullMounts creates mount options for guest pull operations
 // It takes a source path, mount options, and labels, and returns
-// a slice of options with the encoded Kata virtual volume configuration.
+// a slice of options with the encoded Kata virtual volume configuration, as
+// the Kata encoder does.
 func PrepareGuestPullMounts(ctx context.Context, source string, options []string, labels map[string]string) ([]string, error) {
 	if ctx == nil {
 		ctx = context.Background()
 	}
 
-	volume := &KataVirtualVolume{
-		VolumeType: KataVirtualVolumeImageGuestPullType,
-		Source:     source,
-		Options:    options,
-		ImagePull: &ImagePullVolume{
-			Metadata: labels,
-		},
-	}
-
-	if err := ValidateVolumeConfig(volume); err != nil {
-		return nil, errors.Wrap(err, "invalid volume configuration")
-	}
+	return KataEncoder{}.Encode(ctx, NewGuestPullVolume(source, options, labels))
+}
 
-	volumeJSON, err := json.Marshal(volume)
+// DecodeKataVirtualVolume decodes the base64 encoded value of a Kata virtual
+// volume option, as produced by PrepareGuestPullMounts, back into a volume.
+func DecodeKataVirtualVolume(encoded string) (*KataVirtualVolume, error) {
+	volumeJSON, err := base64.StdEncoding.DecodeString(encoded)
 	if err != nil {
-		return nil, errors.Wrap(err, "failed to marshal volume configuration")
+		return nil, errors.Wrap(err, "failed to decode volume configuration")
 	}
 
-	encodedVolume := base64.StdEncoding.EncodeToString(volumeJSON)
-	optionString := fmt.Sprintf("%s=%s", KataVirtualVolumeOptionName, encodedVolume)
-	log.G(ctx).WithField("option", optionString).Debug("prepared guest pull mount option")
+	var volume KataVirtualVolume
+	if err := json.Unmarshal(volumeJSON, &volume); err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal volume configuration")
+	}
 
-	return []string{optionString}, nil
+	return &volume, nil
 }
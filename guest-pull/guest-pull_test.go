@@ -99,6 +99,22 @@ func TestPrepareGuestPullMounts(t *testing.T) {
 	}
 }
 
+func TestDecodeKataVirtualVolume(t *testing.T) {
+	result, err := PrepareGuestPullMounts(context.Background(), "overlay", []string{"lowerdir=/a"}, map[string]string{"key": "value"})
+	require.NoError(t, err)
+
+	optionParts := splitOption(t, result[0])
+	volume, err := DecodeKataVirtualVolume(optionParts[1])
+	require.NoError(t, err)
+	assert.Equal(t, KataVirtualVolumeImageGuestPullType, volume.VolumeType)
+	assert.Equal(t, "overlay", volume.Source)
+	assert.Equal(t, []string{"lowerdir=/a"}, volume.Options)
+	assert.Equal(t, map[string]string{"key": "value"}, volume.ImagePull.Metadata)
+
+	_, err = DecodeKataVirtualVolume("not base64!")
+	assert.Error(t, err)
+}
+
 func splitOption(t *testing.T, option string) []string {
 	t.Helper()
 	parts := make([]string, 2)
@@ -0,0 +1,196 @@
+package guestpull
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Names of the Kata agent schema profiles
+const (
+	// ProfileKata3 is the schema of the Kata 3.x releases, which
+	// KataVirtualVolume mirrors
+	ProfileKata3 = "kata-3.x"
+
+	// ProfileKataMain is the schema of the main branch of Kata. Its mount.rs
+	// still matches the 3.x one, so it renames or omits nothing until the
+	// upstream schema changes.
+	ProfileKataMain = "kata-main"
+
+	// DefaultProfile is the profile of the encoders created without one
+	DefaultProfile = ProfileKata3
+)
+
+// Profile is a version of the Kata agent schema of virtual volumes, described
+// by how its JSON differs from that of KataVirtualVolume. Fields are named by
+// their JSON path in KataVirtualVolume, such as "image_pull.metadata".
+type Profile struct {
+	Name string
+
+	// Rename gives fields the name they have in the profile, which only
+	// replaces the last element of their path
+	Rename map[string]string
+
+	// Omit lists the fields the profile doesn't have
+	Omit []string
+}
+
+var profiles = map[string]Profile{
+	ProfileKata3:    {Name: ProfileKata3},
+	ProfileKataMain: {Name: ProfileKataMain},
+}
+
+// LookupProfile returns the profile name, the default one if name is empty
+func LookupProfile(name string) (Profile, error) {
+	if name == "" {
+		name = DefaultProfile
+	}
+	p, ok := profiles[name]
+	if !ok {
+		return Profile{}, errors.Errorf("unknown volume profile %q, expected one of %v", name, ProfileNames())
+	}
+	return p, nil
+}
+
+// ProfileNames returns the names of the profiles, sorted
+func ProfileNames() []string {
+	names := make([]string, 0, len(profiles))
+	for name := range profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Marshal returns the JSON of volume in the schema of the profile, keeping
+// the order of the fields of KataVirtualVolume
+func (p Profile) Marshal(volume *KataVirtualVolume) ([]byte, error) {
+	data, err := json.Marshal(volume)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to marshal volume configuration")
+	}
+	if len(p.Rename) == 0 && len(p.Omit) == 0 {
+		return data, nil
+	}
+
+	omit := map[string]bool{}
+	for _, path := range p.Omit {
+		omit[path] = true
+	}
+	return p.rewrite(data, "", func(path string) (string, bool) {
+		if omit[path] {
+			return "", false
+		}
+		if name, ok := p.Rename[path]; ok {
+			return name, true
+		}
+		return path[strings.LastIndex(path, ".")+1:], true
+	})
+}
+
+// Unmarshal decodes JSON in the schema of the profile into a volume
+func (p Profile) Unmarshal(data []byte) (*KataVirtualVolume, error) {
+	if len(p.Rename) > 0 {
+		// Renamed fields are looked up by their path in the profile
+		original := map[string]string{}
+		for path := range p.Rename {
+			original[p.profilePath(path)] = path[strings.LastIndex(path, ".")+1:]
+		}
+		var err error
+		data, err = p.rewrite(data, "", func(path string) (string, bool) {
+			if name, ok := original[path]; ok {
+				return name, true
+			}
+			return path[strings.LastIndex(path, ".")+1:], true
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var volume KataVirtualVolume
+	if err := json.Unmarshal(data, &volume); err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal volume configuration")
+	}
+	return &volume, nil
+}
+
+// rewrite returns the JSON object data with its fields named by name, which
+// gets their path and returns false to drop them. Nested objects are only
+// rewritten when the profile changes one of their fields, so that the keys
+// of maps such as the image pull metadata are left alone.
+func (p Profile) rewrite(data []byte, prefix string, name func(path string) (string, bool)) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if t, err := dec.Token(); err != nil || t != json.Delim('{') {
+		return data, nil
+	}
+
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for dec.More() {
+		t, err := dec.Token()
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid volume configuration")
+		}
+		key := t.(string)
+		var value json.RawMessage
+		if err := dec.Decode(&value); err != nil {
+			return nil, errors.Wrap(err, "invalid volume configuration")
+		}
+
+		path := prefix + key
+		newKey, keep := name(path)
+		if !keep {
+			continue
+		}
+		if p.changesBelow(path) {
+			if value, err = p.rewrite(value, path+".", name); err != nil {
+				return nil, err
+			}
+		}
+
+		if buf.Len() > 1 {
+			buf.WriteByte(',')
+		}
+		keyJSON, _ := json.Marshal(newKey)
+		buf.Write(keyJSON)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// changesBelow reports whether the profile renames or omits a field nested
+// in the field at path
+func (p Profile) changesBelow(path string) bool {
+	prefix := path + "."
+	for _, omitted := range p.Omit {
+		if strings.HasPrefix(omitted, prefix) {
+			return true
+		}
+	}
+	for renamed := range p.Rename {
+		// Paths are in the profile when decoding
+		if strings.HasPrefix(renamed, prefix) || strings.HasPrefix(p.profilePath(renamed), prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// profilePath returns the path of a field in the profile
+func (p Profile) profilePath(path string) string {
+	elems := strings.Split(path, ".")
+	renamed := make([]string, len(elems))
+	for i, e := range elems {
+		renamed[i] = e
+		if name, ok := p.Rename[strings.Join(elems[:i+1], ".")]; ok {
+			renamed[i] = name
+		}
+	}
+	return strings.Join(renamed, ".")
+}
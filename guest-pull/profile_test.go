@@ -0,0 +1,121 @@
+package guestpull
+
+import (
+	"context"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var update = flag.Bool("update", false, "update the golden files of the profiles")
+
+// goldenVolume sets every field of KataVirtualVolume, so that the golden
+// files show the whole schema of each profile
+func goldenVolume() *KataVirtualVolume {
+	return &KataVirtualVolume{
+		VolumeType: KataVirtualVolumeImageGuestPullType,
+		Source:     "docker.io/library/busybox:latest",
+		FSType:     "overlay",
+		Options:    []string{"lowerdir=/a", "ro"},
+		ImagePull: &ImagePullVolume{
+			Metadata: map[string]string{
+				VolumeKindMetadataKey: VolumeKindImage,
+				"image.name":          "busybox",
+			},
+		},
+	}
+}
+
+func TestProfilesGolden(t *testing.T) {
+	for _, name := range ProfileNames() {
+		t.Run(name, func(t *testing.T) {
+			p, err := LookupProfile(name)
+			require.NoError(t, err)
+
+			data, err := p.Marshal(goldenVolume())
+			require.NoError(t, err)
+
+			path := filepath.Join("testdata", "profiles", name+".json")
+			if *update {
+				require.NoError(t, os.WriteFile(path, append(data, '\n'), 0644))
+			}
+			golden, err := os.ReadFile(path)
+			require.NoError(t, err, "run go test -update to create the golden file")
+			assert.Equal(t, string(golden), string(data)+"\n")
+
+			volume, err := p.Unmarshal(data)
+			require.NoError(t, err)
+			assert.Equal(t, goldenVolume(), volume)
+		})
+	}
+}
+
+func TestProfileRewrite(t *testing.T) {
+	p := Profile{
+		Name: "test",
+		Rename: map[string]string{
+			"volume_type":         "type",
+			"image_pull":          "pull",
+			"image_pull.metadata": "annotations",
+		},
+		Omit: []string{"fs_type"},
+	}
+
+	data, err := p.Marshal(goldenVolume())
+	require.NoError(t, err)
+	assert.JSONEq(t, `{
+		"type": "image_guest_pull",
+		"source": "docker.io/library/busybox:latest",
+		"options": ["lowerdir=/a", "ro"],
+		"pull": {"annotations": {"io.katacontainers.volume.kind": "image", "image.name": "busybox"}}
+	}`, string(data))
+
+	volume, err := p.Unmarshal(data)
+	require.NoError(t, err)
+	expected := goldenVolume()
+	expected.FSType = ""
+	assert.Equal(t, expected, volume)
+}
+
+func TestLookupProfile(t *testing.T) {
+	p, err := LookupProfile("")
+	require.NoError(t, err)
+	assert.Equal(t, DefaultProfile, p.Name)
+
+	_, err = LookupProfile("kata-2.x")
+	assert.Error(t, err)
+	assert.Equal(t, []string{ProfileKata3, ProfileKataMain}, ProfileNames())
+}
+
+func TestDecodeVolumeOptionProfiles(t *testing.T) {
+	// A profile naming fields differently from the default one
+	profiles["test"] = Profile{
+		Name:   "test",
+		Rename: map[string]string{"image_pull": "pull"},
+	}
+	t.Cleanup(func() { delete(profiles, "test") })
+
+	for _, profile := range []string{DefaultProfile, "test"} {
+		for _, name := range EncoderNames() {
+			t.Run(profile+"/"+name, func(t *testing.T) {
+				e, err := NewEncoder(name, profile)
+				require.NoError(t, err)
+				options, err := e.Encode(context.Background(), goldenVolume())
+				require.NoError(t, err)
+
+				var volume *KataVirtualVolume
+				for _, option := range options {
+					if IsVolumeOption(option) {
+						volume, err = DecodeVolumeOption(option)
+						require.NoError(t, err)
+					}
+				}
+				assert.Equal(t, goldenVolume(), volume)
+			})
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package logging
+
+import (
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// rotatingFile appends to a file, renaming it to <path>.1 and starting a new
+// one when it grows past maxSize
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+func openRotatingFile(path string, maxSize int64, maxBackups int) (*rotatingFile, error) {
+	r := &rotatingFile{
+		path:       path,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+	}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Write implements io.Writer, rotating the file before p would make it grow
+// past its maximum size
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.f == nil {
+		return 0, errors.New("log file is closed")
+	}
+
+	if r.maxSize > 0 && r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// Close closes the file
+func (r *rotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.f == nil {
+		return nil
+	}
+	err := r.f.Close()
+	r.f = nil
+	return err
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return errors.Wrapf(err, "failed to open log file %s", r.path)
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return errors.Wrapf(err, "failed to stat log file %s", r.path)
+	}
+
+	r.f = f
+	r.size = st.Size()
+	return nil
+}
+
+// rotate shifts the rotated files, dropping those beyond the backups to
+// keep, and starts a new file
+func (r *rotatingFile) rotate() error {
+	if err := r.f.Close(); err != nil {
+		return errors.Wrapf(err, "failed to close log file %s", r.path)
+	}
+	r.f = nil
+
+	if r.maxBackups == 0 {
+		if err := os.Remove(r.path); err != nil && !os.IsNotExist(err) {
+			return errors.Wrapf(err, "failed to remove log file %s", r.path)
+		}
+		return r.open()
+	}
+
+	if err := os.Remove(backupPath(r.path, r.maxBackups)); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "failed to remove oldest log file")
+	}
+	for i := r.maxBackups - 1; i >= 1; i-- {
+		if err := os.Rename(backupPath(r.path, i), backupPath(r.path, i+1)); err != nil && !os.IsNotExist(err) {
+			return errors.Wrap(err, "failed to rotate log file")
+		}
+	}
+	// Another process appending to the same file may have rotated it already
+	if err := os.Rename(r.path, backupPath(r.path, 1)); err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "failed to rotate log file %s", r.path)
+	}
+
+	return r.open()
+}
+
+func backupPath(path string, i int) string {
+	return fmt.Sprintf("%s.%d", path, i)
+}
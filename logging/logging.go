@@ -0,0 +1,108 @@
+// Package logging sets up the logs of the snapshotter and its mount helper:
+// their level, which can change while they run, their format and the file
+// they are written to.
+package logging
+
+import (
+	"io"
+	"os"
+	"sync"
+
+	"github.com/containerd/log"
+	"github.com/docker/go-units"
+	"github.com/pkg/errors"
+)
+
+// Options configure the logs
+type Options struct {
+	// Level is the initial level, such as "info"
+	Level string
+
+	// Format is "json" or "text"
+	Format string
+
+	// File is the file logs are appended to instead of stderr, if set
+	File string
+
+	// Stderr keeps writing logs to stderr along with File
+	Stderr bool
+
+	// MaxSize is the size, such as "100MiB", past which File is rotated to
+	// <file>.1. Empty disables rotation.
+	MaxSize string
+
+	// MaxBackups is the number of rotated files kept
+	MaxBackups int
+}
+
+var (
+	mu sync.Mutex
+	// baseLevel is the level set by Setup, which CycleLevel returns to
+	baseLevel = log.InfoLevel
+)
+
+// Setup applies opts to the global logger. The returned closer closes the
+// log file, if any.
+func Setup(opts Options) (io.Closer, error) {
+	switch log.OutputFormat(opts.Format) {
+	case log.JSONFormat, log.TextFormat:
+	default:
+		return nil, errors.Errorf("invalid log format %q, expected %q or %q", opts.Format, log.JSONFormat, log.TextFormat)
+	}
+	if err := log.SetFormat(log.OutputFormat(opts.Format)); err != nil {
+		return nil, errors.Wrap(err, "failed to set log format")
+	}
+
+	if err := SetLevel(opts.Level); err != nil {
+		return nil, err
+	}
+	mu.Lock()
+	baseLevel = log.GetLevel()
+	mu.Unlock()
+
+	if opts.File == "" {
+		return io.NopCloser(nil), nil
+	}
+	if opts.MaxBackups < 0 {
+		return nil, errors.Errorf("invalid number of log backups %d, must not be negative", opts.MaxBackups)
+	}
+	var maxSize int64
+	if opts.MaxSize != "" {
+		var err error
+		if maxSize, err = units.RAMInBytes(opts.MaxSize); err != nil || maxSize < 0 {
+			return nil, errors.Errorf("invalid log file size %q", opts.MaxSize)
+		}
+	}
+	f, err := openRotatingFile(opts.File, maxSize, opts.MaxBackups)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Stderr {
+		log.L.Logger.SetOutput(io.MultiWriter(os.Stderr, f))
+	} else {
+		log.L.Logger.SetOutput(f)
+	}
+	return f, nil
+}
+
+// SetLevel sets the level of the global logger
+func SetLevel(level string) error {
+	if err := log.SetLevel(level); err != nil {
+		return errors.Wrapf(err, "invalid log level %q", level)
+	}
+	return nil
+}
+
+// CycleLevel makes the global logger one level more verbose, going back to
+// the level set by Setup past trace, and returns the new level
+func CycleLevel() log.Level {
+	mu.Lock()
+	defer mu.Unlock()
+
+	level := log.GetLevel() + 1
+	if level > log.TraceLevel {
+		level = baseLevel
+	}
+	log.L.Logger.SetLevel(level)
+	return level
+}
@@ -0,0 +1,73 @@
+package logging
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/containerd/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCycleLevel(t *testing.T) {
+	closer, err := Setup(Options{Level: "info", Format: "text"})
+	require.NoError(t, err)
+	defer closer.Close()
+
+	assert.Equal(t, log.DebugLevel, CycleLevel())
+	assert.Equal(t, log.TraceLevel, CycleLevel())
+	assert.Equal(t, log.InfoLevel, CycleLevel())
+
+	require.NoError(t, SetLevel("warn"))
+	assert.Equal(t, log.InfoLevel, CycleLevel())
+	assert.Error(t, SetLevel("verbose"))
+}
+
+func TestSetupInvalid(t *testing.T) {
+	_, err := Setup(Options{Level: "info", Format: "logfmt"})
+	assert.Error(t, err)
+	_, err = Setup(Options{Level: "loud", Format: "json"})
+	assert.Error(t, err)
+	_, err = Setup(Options{Level: "info", Format: "json", File: filepath.Join(t.TempDir(), "log"), MaxSize: "big"})
+	assert.Error(t, err)
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshotter.log")
+	f, err := openRotatingFile(path, 10, 2)
+	require.NoError(t, err)
+	defer f.Close()
+
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		_, err := f.Write([]byte(line))
+		require.NoError(t, err)
+	}
+
+	for file, content := range map[string]string{
+		path:        "fourth\n",
+		path + ".1": "third\n",
+		path + ".2": "second\n",
+	} {
+		data, err := os.ReadFile(file)
+		require.NoError(t, err)
+		assert.Equal(t, content, string(data), file)
+	}
+	_, err = os.Stat(path + ".3")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestSetupFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshotter.log")
+	closer, err := Setup(Options{Level: "info", Format: "json", File: path})
+	require.NoError(t, err)
+	defer log.L.Logger.SetOutput(os.Stderr)
+
+	log.L.Info("to the file")
+	require.NoError(t, closer.Close())
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.True(t, strings.Contains(string(data), `"msg":"to the file"`), string(data))
+}
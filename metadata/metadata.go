@@ -0,0 +1,171 @@
+// Package metadata maintains the bolt database holding the snapshot metadata.
+//
+// The snapshots themselves are stored by the containerd snapshot storage in
+// its own buckets. This package records the schema version of the database in
+// a bucket of the snapshotter, so that buckets added later can be migrated
+// into existing databases, and provides the backup and compaction used by the
+// maintenance commands.
+package metadata
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/containerd/errdefs"
+	"github.com/pkg/errors"
+	bolt "go.etcd.io/bbolt"
+)
+
+// File is the name of the database in the root directory
+const File = "metadata.db"
+
+// SchemaVersion is the schema version written by this snapshotter
+const SchemaVersion = 1
+
+// DefaultLockTimeout is how long opening the database waits for another
+// process to release it
+const DefaultLockTimeout = 5 * time.Second
+
+var (
+	bucketKeyGuestPull = []byte("guestpull")
+	keySchemaVersion   = []byte("schema-version")
+)
+
+// migrations[i] upgrades the schema from version i to i+1
+var migrations = []func(tx *bolt.Tx) error{
+	// Version 1 introduces the guestpull bucket
+	func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(bucketKeyGuestPull)
+		return err
+	},
+}
+
+// Path returns the path of the database in root
+func Path(root string) string {
+	return filepath.Join(root, File)
+}
+
+// Open opens the database at path, failing with an error satisfying
+// errdefs.IsUnavailable if another process holds it for longer than timeout
+func Open(path string, timeout time.Duration, readOnly bool) (*bolt.DB, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: timeout, ReadOnly: readOnly})
+	if err != nil {
+		if errors.Is(err, bolt.ErrTimeout) {
+			return nil, errors.Wrapf(errdefs.ErrUnavailable,
+				"metadata store %s is in use by another process, is the snapshotter running?", path)
+		}
+		return nil, errors.Wrapf(err, "failed to open metadata store %s", path)
+	}
+	return db, nil
+}
+
+// Version returns the schema version of the database, 0 for databases
+// created before the schema was versioned
+func Version(tx *bolt.Tx) int {
+	bkt := tx.Bucket(bucketKeyGuestPull)
+	if bkt == nil {
+		return 0
+	}
+	v, _ := binary.Uvarint(bkt.Get(keySchemaVersion))
+	return int(v)
+}
+
+// Migrate upgrades the schema of db to SchemaVersion and returns the version
+// it had. It refuses databases written by a newer snapshotter.
+func Migrate(db *bolt.DB) (int, error) {
+	var from int
+	err := db.Update(func(tx *bolt.Tx) error {
+		from = Version(tx)
+		if from > SchemaVersion {
+			return errors.Wrapf(errdefs.ErrFailedPrecondition,
+				"metadata schema version %d is newer than the supported version %d", from, SchemaVersion)
+		}
+		if from == SchemaVersion {
+			return nil
+		}
+
+		for v := from; v < SchemaVersion; v++ {
+			if err := migrations[v](tx); err != nil {
+				return errors.Wrapf(err, "failed to migrate metadata schema from version %d", v)
+			}
+		}
+
+		buf := make([]byte, binary.MaxVarintLen64)
+		n := binary.PutUvarint(buf, SchemaVersion)
+		return tx.Bucket(bucketKeyGuestPull).Put(keySchemaVersion, buf[:n])
+	})
+	return from, err
+}
+
+// Backup writes a consistent copy of the database seen by tx to w
+func Backup(tx *bolt.Tx, w io.Writer) (int64, error) {
+	n, err := tx.WriteTo(w)
+	return n, errors.Wrap(err, "failed to copy metadata store")
+}
+
+// WriteFile atomically replaces the file at path with the content written by
+// fn, so that an interrupted write never leaves a partial file behind
+func WriteFile(path string, fn func(w io.Writer) error) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-")
+	if err != nil {
+		return errors.Wrapf(err, "failed to create %s", path)
+	}
+	defer os.Remove(f.Name())
+
+	if err := fn(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return errors.Wrapf(err, "failed to sync %s", f.Name())
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return errors.Wrapf(os.Rename(f.Name(), path), "failed to rename %s", f.Name())
+}
+
+// Compact rewrites the database at path without its free pages. The database
+// must not be in use.
+func Compact(path string, timeout time.Duration) (before, after int64, err error) {
+	src, err := Open(path, timeout, true)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer src.Close()
+
+	st, err := os.Stat(path)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	tmp := path + ".compact"
+	os.Remove(tmp)
+	dst, err := bolt.Open(tmp, 0600, nil)
+	if err != nil {
+		return 0, 0, errors.Wrapf(err, "failed to create %s", tmp)
+	}
+	defer os.Remove(tmp)
+
+	if err := bolt.Compact(dst, src, 64<<20); err != nil {
+		dst.Close()
+		return 0, 0, errors.Wrap(err, "failed to compact metadata store")
+	}
+	if err := dst.Close(); err != nil {
+		return 0, 0, err
+	}
+
+	cst, err := os.Stat(tmp)
+	if err != nil {
+		return 0, 0, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return 0, 0, fmt.Errorf("failed to replace %s: %w", path, err)
+	}
+	return st.Size(), cst.Size(), nil
+}
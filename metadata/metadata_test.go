@@ -0,0 +1,98 @@
+package metadata
+
+import (
+	"encoding/binary"
+	"io"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/containerd/errdefs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestMigrate(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), File), time.Second, false)
+	require.NoError(t, err)
+	defer db.Close()
+
+	from, err := Migrate(db)
+	require.NoError(t, err)
+	assert.Equal(t, 0, from)
+
+	from, err = Migrate(db)
+	require.NoError(t, err)
+	assert.Equal(t, SchemaVersion, from)
+
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		buf := make([]byte, binary.MaxVarintLen64)
+		n := binary.PutUvarint(buf, SchemaVersion+1)
+		return tx.Bucket(bucketKeyGuestPull).Put(keySchemaVersion, buf[:n])
+	}))
+	_, err = Migrate(db)
+	assert.True(t, errdefs.IsFailedPrecondition(err), "expected failed precondition, got %v", err)
+}
+
+func TestOpenLockTimeout(t *testing.T) {
+	path := filepath.Join(t.TempDir(), File)
+	db, err := Open(path, time.Second, false)
+	require.NoError(t, err)
+	defer db.Close()
+
+	start := time.Now()
+	_, err = Open(path, 50*time.Millisecond, false)
+	assert.True(t, errdefs.IsUnavailable(err), "expected unavailable, got %v", err)
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func TestBackupAndCompact(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, File)
+
+	db, err := Open(path, time.Second, false)
+	require.NoError(t, err)
+	_, err = Migrate(db)
+	require.NoError(t, err)
+	// Leave free pages behind
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		bkt, err := tx.CreateBucket([]byte("scratch"))
+		if err != nil {
+			return err
+		}
+		return bkt.Put([]byte("data"), make([]byte, 1<<20))
+	}))
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		return tx.DeleteBucket([]byte("scratch"))
+	}))
+
+	backup := filepath.Join(dir, "backup.db")
+	require.NoError(t, db.View(func(tx *bolt.Tx) error {
+		return WriteFile(backup, func(w io.Writer) error {
+			_, err := Backup(tx, w)
+			return err
+		})
+	}))
+	require.NoError(t, db.Close())
+
+	bdb, err := Open(backup, time.Second, true)
+	require.NoError(t, err)
+	require.NoError(t, bdb.View(func(tx *bolt.Tx) error {
+		assert.Equal(t, SchemaVersion, Version(tx))
+		return nil
+	}))
+	require.NoError(t, bdb.Close())
+
+	before, after, err := Compact(path, time.Second)
+	require.NoError(t, err)
+	assert.Less(t, after, before)
+
+	db, err = Open(path, time.Second, true)
+	require.NoError(t, err)
+	defer db.Close()
+	require.NoError(t, db.View(func(tx *bolt.Tx) error {
+		assert.Equal(t, SchemaVersion, Version(tx))
+		return nil
+	}))
+}
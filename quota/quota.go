@@ -0,0 +1,344 @@
+// Package quota enforces disk quotas on directories with the project quotas
+// of XFS and ext4 filesystems.
+//
+// A directory is assigned a project id that is inherited by everything created
+// below it, and the block limit of that project is set through quotactl(2).
+// The filesystem must be mounted with project quota accounting enabled, for
+// example "prjquota" for both XFS and ext4.
+package quota
+
+import (
+	"os"
+	"slices"
+	"sync"
+	"syscall"
+	"unsafe"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// Kernel interfaces that golang.org/x/sys/unix does not define,
+// see linux/fs.h and linux/quota.h
+const (
+	fsIocFsGetXattr = 0x801c581f
+	fsIocFsSetXattr = 0x401c5820
+
+	fsXflagProjInherit = 0x200
+
+	qGetQuota = 0x800007
+	qSetQuota = 0x800008
+	prjQuota  = 2
+
+	qifBlimits = 1
+
+	// qifBlockSize is the unit of the block limits of if_dqblk
+	qifBlockSize = 1024
+)
+
+// fsxattr mirrors struct fsxattr
+type fsxattr struct {
+	xflags     uint32
+	extsize    uint32
+	nextents   uint32
+	projid     uint32
+	cowextsize uint32
+	pad        [8]byte
+}
+
+// ifDqblk mirrors struct if_dqblk
+type ifDqblk struct {
+	bhardlimit uint64
+	bsoftlimit uint64
+	curspace   uint64
+	ihardlimit uint64
+	isoftlimit uint64
+	curinodes  uint64
+	btime      uint64
+	itime      uint64
+	valid      uint32
+	_          uint32
+}
+
+// Quota is the limit and the current usage of a directory
+type Quota struct {
+	// Size is the limit in bytes
+	Size uint64
+	// Used is the space in bytes consumed below the directory
+	Used int64
+	// Inodes is the number of inodes below the directory
+	Inodes int64
+}
+
+// Control assigns project ids and limits to directories of one filesystem
+type Control struct {
+	backingFsBlockDev string
+
+	mu            sync.Mutex
+	minProjectID  uint32
+	nextProjectID uint32
+	// freeProjectIDs are the ids below nextProjectID that no directory has,
+	// handed out again before new ones
+	freeProjectIDs []uint32
+}
+
+// NewControl prepares quota control for the filesystem holding basePath,
+// creating at backingFsBlockDev the block device node quotactl(2) addresses
+// it with. The node must be on the same filesystem, outside of the
+// directories mounted in containers. Project ids assigned to the existing
+// directories are not reused. It fails when the filesystem doesn't support
+// project quotas or they are not enabled.
+func NewControl(basePath, backingFsBlockDev string, existing []string) (*Control, error) {
+	if err := makeBackingFsDev(basePath, backingFsBlockDev); err != nil {
+		return nil, err
+	}
+
+	baseID, err := getProjectID(basePath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get project id of %s", basePath)
+	}
+
+	q := &Control{
+		backingFsBlockDev: backingFsBlockDev,
+		minProjectID:      baseID + 1,
+		nextProjectID:     baseID + 1,
+	}
+
+	if err := q.probe(); err != nil {
+		return nil, errors.Wrapf(err, "project quotas are not enabled on the filesystem of %s", basePath)
+	}
+
+	used := map[uint32]bool{}
+	for _, path := range existing {
+		id, err := getProjectID(path)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to get project id of %s", path)
+		}
+		if id < q.minProjectID {
+			continue
+		}
+		used[id] = true
+		if id >= q.nextProjectID {
+			q.nextProjectID = id + 1
+		}
+	}
+	for id := q.minProjectID; id < q.nextProjectID; id++ {
+		if !used[id] {
+			q.freeProjectIDs = append(q.freeProjectIDs, id)
+		}
+	}
+
+	return q, nil
+}
+
+// InUse reports whether any of paths has a project id other than that of
+// basePath, as assigned by a Control of the filesystem of basePath
+func InUse(basePath string, paths []string) (bool, error) {
+	baseID, err := getProjectID(basePath)
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to get project id of %s", basePath)
+	}
+	for _, path := range paths {
+		id, err := getProjectID(path)
+		if err != nil {
+			return false, errors.Wrapf(err, "failed to get project id of %s", path)
+		}
+		if id > baseID {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// probe checks that project quotas are enabled. XFS has no quota record for
+// a project id before a limit is set and fails with ENOENT then, which is
+// fine, while filesystems without project quotas enabled fail with ESRCH.
+func (q *Control) probe() error {
+	if _, err := q.getQuota(q.minProjectID); err != nil && !errors.Is(err, unix.ENOENT) {
+		return err
+	}
+	return nil
+}
+
+// SetQuota limits the space used below targetPath to size bytes, assigning
+// a new project id to targetPath if it doesn't have one yet
+func (q *Control) SetQuota(targetPath string, size uint64) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	id, err := getProjectID(targetPath)
+	if err != nil {
+		return errors.Wrapf(err, "failed to get project id of %s", targetPath)
+	}
+
+	if id < q.minProjectID {
+		id = q.allocProjectID()
+		if err := setProjectID(targetPath, id); err != nil {
+			q.releaseProjectID(id)
+			return errors.Wrapf(err, "failed to set project id of %s", targetPath)
+		}
+	}
+
+	if err := q.setLimit(id, size); err != nil {
+		return errors.Wrapf(err, "failed to set quota of %s", targetPath)
+	}
+
+	return nil
+}
+
+// ReleaseQuota removes the limit of targetPath, which is about to be removed,
+// and makes its project id available to other directories
+func (q *Control) ReleaseQuota(targetPath string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	id, err := getProjectID(targetPath)
+	if err != nil {
+		return errors.Wrapf(err, "failed to get project id of %s", targetPath)
+	}
+	if id < q.minProjectID {
+		return nil
+	}
+
+	if err := q.setLimit(id, 0); err != nil {
+		return errors.Wrapf(err, "failed to remove quota of %s", targetPath)
+	}
+	q.releaseProjectID(id)
+	return nil
+}
+
+// allocProjectID returns the lowest free project id
+func (q *Control) allocProjectID() uint32 {
+	if len(q.freeProjectIDs) > 0 {
+		id := q.freeProjectIDs[0]
+		q.freeProjectIDs = q.freeProjectIDs[1:]
+		return id
+	}
+	id := q.nextProjectID
+	q.nextProjectID++
+	return id
+}
+
+// releaseProjectID makes id available again
+func (q *Control) releaseProjectID(id uint32) {
+	i, found := slices.BinarySearch(q.freeProjectIDs, id)
+	if !found {
+		q.freeProjectIDs = slices.Insert(q.freeProjectIDs, i, id)
+	}
+}
+
+// setLimit sets the block limit of project id to size bytes, 0 for none
+func (q *Control) setLimit(id uint32, size uint64) error {
+	d := ifDqblk{
+		bhardlimit: (size + qifBlockSize - 1) / qifBlockSize,
+		valid:      qifBlimits,
+	}
+	d.bsoftlimit = d.bhardlimit
+	return q.quotactl(qSetQuota, id, &d)
+}
+
+// GetQuota returns the quota of targetPath, and false if it has none
+func (q *Control) GetQuota(targetPath string) (Quota, bool, error) {
+	id, err := getProjectID(targetPath)
+	if err != nil {
+		return Quota{}, false, errors.Wrapf(err, "failed to get project id of %s", targetPath)
+	}
+	if id < q.minProjectID {
+		return Quota{}, false, nil
+	}
+
+	d, err := q.getQuota(id)
+	if err != nil {
+		return Quota{}, false, errors.Wrapf(err, "failed to get quota of %s", targetPath)
+	}
+
+	return Quota{
+		Size:   d.bhardlimit * qifBlockSize,
+		Used:   int64(d.curspace),
+		Inodes: int64(d.curinodes),
+	}, true, nil
+}
+
+func (q *Control) getQuota(id uint32) (ifDqblk, error) {
+	var d ifDqblk
+	err := q.quotactl(qGetQuota, id, &d)
+	return d, err
+}
+
+func (q *Control) quotactl(cmd int, id uint32, d *ifDqblk) error {
+	return quotactl(cmd, q.backingFsBlockDev, id, d)
+}
+
+// quotactl calls quotactl(2) on the project quotas of the filesystem of the
+// block device node backingFsBlockDev, replaced in tests
+var quotactl = func(cmd int, backingFsBlockDev string, id uint32, d *ifDqblk) error {
+	dev, err := unix.BytePtrFromString(backingFsBlockDev)
+	if err != nil {
+		return err
+	}
+
+	_, _, errno := unix.Syscall6(unix.SYS_QUOTACTL, uintptr(cmd<<8|prjQuota),
+		uintptr(unsafe.Pointer(dev)), uintptr(id), uintptr(unsafe.Pointer(d)), 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// makeBackingFsDev creates at backingFsBlockDev a block device node for the
+// filesystem holding basePath, which quotactl(2) needs to address it
+func makeBackingFsDev(basePath, backingFsBlockDev string) error {
+	st, err := os.Stat(basePath)
+	if err != nil {
+		return errors.Wrapf(err, "failed to stat %s", basePath)
+	}
+
+	if err := unix.Unlink(backingFsBlockDev); err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "failed to remove %s", backingFsBlockDev)
+	}
+
+	dev := st.Sys().(*syscall.Stat_t).Dev
+	if err := unix.Mknod(backingFsBlockDev, unix.S_IFBLK|0600, int(dev)); err != nil {
+		return errors.Wrapf(err, "failed to create %s", backingFsBlockDev)
+	}
+
+	return nil
+}
+
+func getProjectID(path string) (uint32, error) {
+	attr, err := getFsxattr(path)
+	if err != nil {
+		return 0, err
+	}
+	return attr.projid, nil
+}
+
+func setProjectID(path string, id uint32) error {
+	attr, err := getFsxattr(path)
+	if err != nil {
+		return err
+	}
+	attr.projid = id
+	attr.xflags |= fsXflagProjInherit
+	return fsxattrIoctl(path, fsIocFsSetXattr, &attr)
+}
+
+func getFsxattr(path string) (fsxattr, error) {
+	var attr fsxattr
+	err := fsxattrIoctl(path, fsIocFsGetXattr, &attr)
+	return attr, err
+}
+
+func fsxattrIoctl(path string, req uintptr, attr *fsxattr) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, dir.Fd(), req, uintptr(unsafe.Pointer(attr)))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,163 @@
+package quota
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestNewControlWithoutProjectQuota(t *testing.T) {
+	// Temporary directories live on filesystems without project quotas enabled
+	dir := t.TempDir()
+	_, err := NewControl(dir, filepath.Join(dir, "backingFsBlockDev"), nil)
+	assert.Error(t, err)
+}
+
+// fakeQuotactl replaces quotactl(2) with fn until the test ends
+func fakeQuotactl(t *testing.T, fn func(cmd int, id uint32, d *ifDqblk) error) {
+	prev := quotactl
+	quotactl = func(cmd int, _ string, id uint32, d *ifDqblk) error {
+		return fn(cmd, id, d)
+	}
+	t.Cleanup(func() { quotactl = prev })
+}
+
+func TestProbe(t *testing.T) {
+	q := &Control{minProjectID: 1, nextProjectID: 1}
+
+	// XFS has no record of a project id without a limit
+	fakeQuotactl(t, func(int, uint32, *ifDqblk) error { return unix.ENOENT })
+	assert.NoError(t, q.probe())
+
+	fakeQuotactl(t, func(int, uint32, *ifDqblk) error { return nil })
+	assert.NoError(t, q.probe())
+
+	// Filesystems without project quotas enabled
+	fakeQuotactl(t, func(int, uint32, *ifDqblk) error { return unix.ESRCH })
+	assert.ErrorIs(t, q.probe(), unix.ESRCH)
+}
+
+func TestProjectIDs(t *testing.T) {
+	q := &Control{minProjectID: 10, nextProjectID: 10}
+	assert.Equal(t, uint32(10), q.allocProjectID())
+	assert.Equal(t, uint32(11), q.allocProjectID())
+	assert.Equal(t, uint32(12), q.allocProjectID())
+
+	// Released ids are handed out again, lowest first
+	q.releaseProjectID(12)
+	q.releaseProjectID(11)
+	q.releaseProjectID(11)
+	assert.Equal(t, []uint32{11, 12}, q.freeProjectIDs)
+	assert.Equal(t, uint32(11), q.allocProjectID())
+	assert.Equal(t, uint32(12), q.allocProjectID())
+	assert.Equal(t, uint32(13), q.allocProjectID())
+}
+
+// mountXFS mounts a loopback XFS image with project quotas enabled
+func mountXFS(t *testing.T) string {
+	t.Helper()
+	if os.Getuid() != 0 {
+		t.Skip("mounting a loopback filesystem requires root")
+	}
+	if _, err := exec.LookPath("mkfs.xfs"); err != nil {
+		t.Skip("mkfs.xfs is not available")
+	}
+
+	dir := t.TempDir()
+	image := filepath.Join(dir, "xfs.img")
+	mnt := filepath.Join(dir, "mnt")
+	require.NoError(t, os.Mkdir(mnt, 0700))
+
+	// XFS refuses filesystems smaller than 300MiB
+	require.NoError(t, exec.Command("truncate", "-s", "320M", image).Run())
+	if out, err := exec.Command("mkfs.xfs", "-q", image).CombinedOutput(); err != nil {
+		t.Fatalf("mkfs.xfs: %v: %s", err, out)
+	}
+	if out, err := exec.Command("mount", "-o", "loop,prjquota", image, mnt).CombinedOutput(); err != nil {
+		t.Skipf("failed to mount XFS with project quotas: %v: %s", err, out)
+	}
+	t.Cleanup(func() {
+		if err := unix.Unmount(mnt, unix.MNT_DETACH); err != nil {
+			t.Logf("failed to unmount %s: %v", mnt, err)
+		}
+	})
+
+	return mnt
+}
+
+func TestSetQuota(t *testing.T) {
+	base := mountXFS(t)
+
+	upper := filepath.Join(base, "1", "fs")
+	require.NoError(t, os.MkdirAll(upper, 0755))
+
+	dev := filepath.Join(base, "backingFsBlockDev")
+	q, err := NewControl(base, dev, nil)
+	require.NoError(t, err)
+	require.NoError(t, q.SetQuota(upper, 1<<20))
+
+	quota, ok, err := q.GetQuota(upper)
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, uint64(1<<20), quota.Size)
+
+	err = os.WriteFile(filepath.Join(upper, "file"), make([]byte, 2<<20), 0644)
+	assert.True(t, errors.Is(err, unix.EDQUOT), "expected EDQUOT, got %v", err)
+
+	quota, _, err = q.GetQuota(upper)
+	require.NoError(t, err)
+	assert.LessOrEqual(t, quota.Used, int64(1<<20))
+
+	// Directories created below inherit the project
+	nested := filepath.Join(upper, "nested")
+	require.NoError(t, os.Mkdir(nested, 0755))
+	_, ok, err = q.GetQuota(nested)
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	// A new control doesn't hand out the project ids in use again
+	other := filepath.Join(base, "2", "fs")
+	require.NoError(t, os.MkdirAll(other, 0755))
+	q, err = NewControl(base, dev, []string{upper})
+	require.NoError(t, err)
+	require.NoError(t, q.SetQuota(other, 1<<20))
+
+	upperID, err := getProjectID(upper)
+	require.NoError(t, err)
+	otherID, err := getProjectID(other)
+	require.NoError(t, err)
+	assert.NotEqual(t, upperID, otherID)
+
+	// The id of a released directory goes to the next one
+	require.NoError(t, q.ReleaseQuota(upper))
+	require.NoError(t, os.RemoveAll(filepath.Dir(upper)))
+	next := filepath.Join(base, "3", "fs")
+	require.NoError(t, os.MkdirAll(next, 0755))
+	require.NoError(t, q.SetQuota(next, 1<<20))
+	nextID, err := getProjectID(next)
+	require.NoError(t, err)
+	assert.Equal(t, upperID, nextID)
+}
+
+func TestInUse(t *testing.T) {
+	dir := t.TempDir()
+	sub := filepath.Join(dir, "fs")
+	require.NoError(t, os.Mkdir(sub, 0700))
+
+	// Directories inherit the project id of their parent until they get one
+	inUse, err := InUse(dir, []string{sub})
+	if errors.Is(err, unix.ENOTTY) || errors.Is(err, unix.EOPNOTSUPP) {
+		t.Skipf("filesystem of %s doesn't support project ids: %v", dir, err)
+	}
+	require.NoError(t, err)
+	assert.False(t, inUse)
+
+	_, err = InUse(dir, []string{filepath.Join(dir, "missing")})
+	assert.Error(t, err)
+}
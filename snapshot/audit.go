@@ -0,0 +1,97 @@
+package snapshot
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+
+	"github.com/containerd/containerd/v2/core/mount"
+	"github.com/containerd/containerd/v2/pkg/namespaces"
+	snpkg "github.com/containerd/containerd/v2/pkg/snapshotters"
+	"github.com/containerd/errdefs"
+	"github.com/containerd/log"
+
+	"github.com/ChengyuZhu6/guest-pull-snapshotter/audit"
+	guestpull "github.com/ChengyuZhu6/guest-pull-snapshotter/guest-pull"
+)
+
+// WithAuditLog records whether the snapshot of every Prepare, View, Mounts
+// and Remove is left to the guest to pull, mounted on the host or refused
+func WithAuditLog(l *audit.Logger) Opt {
+	return func(config *SnapshotterConfig) {
+		config.auditLog = l
+	}
+}
+
+// auditDecision records the outcome of an operation on key, whose snapshot
+// carries labels and is returned with mounts
+func (o *snapshotter) auditDecision(ctx context.Context, operation, key, parent string, labels map[string]string, mounts []mount.Mount, err error) {
+	if o.auditLog == nil {
+		return
+	}
+
+	var parentLabels map[string]string
+	if parent != "" {
+		if _, info, _, err := o.getSnapshotInfo(ctx, parent); err == nil {
+			parentLabels = info.Labels
+		}
+	}
+
+	r := audit.Record{
+		Operation:  operation,
+		Key:        key,
+		Parent:     parent,
+		ImageRef:   imageRef(labels, parentLabels),
+		VolumeHash: volumeHash(mounts),
+	}
+	r.Namespace, _ = namespaces.Namespace(ctx)
+
+	_, target := labels[targetSnapshotLabel]
+	switch {
+	case target && errdefs.IsAlreadyExists(err):
+		// A committed target is reported as already existing
+		r.Decision = audit.DecisionGuestPull
+	case err != nil:
+		r.Decision = audit.DecisionRefused
+		r.Error = err.Error()
+	case operation == audit.OperationRemove:
+		r.Decision = audit.DecisionRemoved
+	case IsGuestPullMode(labels):
+		r.Decision = audit.DecisionGuestPull
+	case r.VolumeHash != "" && IsGuestPullMode(parentLabels):
+		// Containers carry no label of their own, the volume passed for them
+		// has the guest pull the layers below
+		r.Decision = audit.DecisionGuestPull
+	default:
+		r.Decision = audit.DecisionHost
+	}
+
+	if err := o.auditLog.Log(r); err != nil {
+		log.G(ctx).WithError(err).Error("failed to write audit record")
+	}
+}
+
+// imageRef returns the image reference of a snapshot, which containers only
+// carry in the labels of the layers below them
+func imageRef(labels, parentLabels map[string]string) string {
+	if ref, ok := labels[snpkg.TargetRefLabel]; ok {
+		return ref
+	}
+	return parentLabels[snpkg.TargetRefLabel]
+}
+
+// volumeHash returns the SHA-256 hash of the encoded volume in mounts, empty
+// if there is none
+func volumeHash(mounts []mount.Mount) string {
+	for _, m := range mounts {
+		for _, opt := range m.Options {
+			if guestpull.IsVolumeOption(opt) {
+				_, encoded, _ := strings.Cut(opt, "=")
+				sum := sha256.Sum256([]byte(encoded))
+				return hex.EncodeToString(sum[:])
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,85 @@
+package snapshot
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containerd/containerd/v2/core/snapshots"
+	"github.com/containerd/containerd/v2/pkg/namespaces"
+	snpkg "github.com/containerd/containerd/v2/pkg/snapshotters"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ChengyuZhu6/guest-pull-snapshotter/audit"
+	"github.com/ChengyuZhu6/guest-pull-snapshotter/config"
+)
+
+func TestAuditDecisions(t *testing.T) {
+	ctx := namespaces.WithNamespace(context.Background(), "k8s.io")
+	path := filepath.Join(t.TempDir(), "audit.log")
+
+	auditLog, err := audit.Open(config.AuditConfig{Path: path})
+	require.NoError(t, err)
+	defer auditLog.Close()
+
+	sn, err := NewSnapshotter(ctx, WithRootDirectory(t.TempDir()), WithAuditLog(auditLog))
+	require.NoError(t, err)
+	defer sn.Close()
+
+	const ref = "registry.example.com/app:v1"
+	_, err = sn.Prepare(ctx, "extract", "", snapshots.WithLabels(map[string]string{
+		targetSnapshotLabel:  "layer",
+		snpkg.TargetRefLabel: ref,
+	}))
+	require.Error(t, err)
+	mounts, err := sn.Prepare(ctx, "container", "layer")
+	require.NoError(t, err)
+	_, err = sn.Mounts(ctx, "missing")
+	require.Error(t, err)
+	require.NoError(t, sn.Remove(ctx, "container"))
+
+	// Layers unpacked on the host
+	_, err = sn.Prepare(ctx, "unpack", "")
+	require.NoError(t, err)
+	require.NoError(t, sn.Commit(ctx, "host-layer", "unpack"))
+	_, err = sn.Prepare(ctx, "host-container", "host-layer")
+	require.NoError(t, err)
+
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+
+	var records []audit.Record
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var r audit.Record
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &r))
+		records = append(records, r)
+	}
+	require.Len(t, records, 6)
+
+	expected := []struct {
+		operation, key, decision, imageRef string
+	}{
+		{audit.OperationPrepare, "extract", audit.DecisionGuestPull, ref},
+		{audit.OperationPrepare, "container", audit.DecisionGuestPull, ref},
+		{audit.OperationMounts, "missing", audit.DecisionRefused, ""},
+		{audit.OperationRemove, "container", audit.DecisionRemoved, ref},
+		{audit.OperationPrepare, "unpack", audit.DecisionHost, ""},
+		{audit.OperationPrepare, "host-container", audit.DecisionHost, ""},
+	}
+	for i, e := range expected {
+		assert.Equal(t, "k8s.io", records[i].Namespace)
+		assert.Equal(t, e.operation, records[i].Operation)
+		assert.Equal(t, e.key, records[i].Key)
+		assert.Equal(t, e.decision, records[i].Decision)
+		assert.Equal(t, e.imageRef, records[i].ImageRef)
+	}
+	assert.Equal(t, volumeHash(mounts), records[1].VolumeHash)
+	assert.NotEmpty(t, records[1].VolumeHash)
+	assert.NotEmpty(t, records[2].Error)
+}
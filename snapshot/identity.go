@@ -0,0 +1,216 @@
+package snapshot
+
+import (
+	"archive/tar"
+	"context"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/containerd/containerd/v2/core/content"
+	"github.com/containerd/containerd/v2/pkg/archive/compression"
+	snpkg "github.com/containerd/containerd/v2/pkg/snapshotters"
+	"github.com/containerd/errdefs"
+	"github.com/containerd/log"
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+// identityFiles are the files containerd reads from the rootfs to resolve
+// user and group names, relative to the rootfs
+var identityFiles = []string{"etc/passwd", "etc/group"}
+
+// IdentitySource provides the identity files of the image a guest pulled
+// layer belongs to, keyed by their path relative to the rootfs. It returns
+// an error satisfying errdefs.IsNotFound if it has none for the image.
+type IdentitySource interface {
+	IdentityFiles(ctx context.Context, labels map[string]string) (map[string][]byte, error)
+}
+
+// WithIdentityStub places the identity files of guest pulled images in the
+// upper directory of their top layer on the host, so that containerd can
+// resolve user names from the mounted rootfs while the rest of the image
+// stays off the host. Sources are tried in order.
+func WithIdentityStub(sources ...IdentitySource) Opt {
+	return func(config *SnapshotterConfig) {
+		config.identitySources = append(config.identitySources, sources...)
+	}
+}
+
+// isTopLayer reports whether the labels of a guest pulled layer describe the
+// last layer of its image. The image layers label lists the layer and those
+// above it.
+func isTopLayer(labels map[string]string) bool {
+	layer, ok := labels[snpkg.TargetLayerDigestLabel]
+	return ok && labels[snpkg.TargetImageLayersLabel] == layer
+}
+
+// writeIdentityStub writes the identity files of the image into the upper
+// directory of its top layer
+func (o *snapshotter) writeIdentityStub(ctx context.Context, id string, labels map[string]string) error {
+	for _, source := range o.identitySources {
+		files, err := source.IdentityFiles(ctx, labels)
+		if err != nil {
+			if errdefs.IsNotFound(err) {
+				continue
+			}
+			return err
+		}
+
+		upperPath, err := o.ensureUpperPath(id)
+		if err != nil {
+			return err
+		}
+		for name, data := range files {
+			target := filepath.Join(upperPath, name)
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return errors.Wrapf(err, "failed to create directory for %s", name)
+			}
+			if err := os.WriteFile(target, data, 0644); err != nil {
+				return errors.Wrapf(err, "failed to write %s", name)
+			}
+		}
+
+		log.G(ctx).WithField("ref", labels[snpkg.TargetRefLabel]).Debug("placed identity stub")
+		return nil
+	}
+
+	return errors.Wrapf(errdefs.ErrNotFound, "no identity files for image %s", labels[snpkg.TargetRefLabel])
+}
+
+// localIdentitySource reads stand-in identity files from a local directory
+type localIdentitySource struct {
+	dir string
+}
+
+// NewLocalIdentitySource returns a source reading the identity files of an
+// image from <dir>/<algorithm>/<hex>/ of its manifest digest, falling back
+// to the files directly in dir
+func NewLocalIdentitySource(dir string) IdentitySource {
+	return &localIdentitySource{dir: dir}
+}
+
+func (s *localIdentitySource) IdentityFiles(ctx context.Context, labels map[string]string) (map[string][]byte, error) {
+	dirs := []string{s.dir}
+	if dgst, err := digest.Parse(labels[snpkg.TargetManifestDigestLabel]); err == nil {
+		dirs = append([]string{filepath.Join(s.dir, dgst.Algorithm().String(), dgst.Encoded())}, dirs...)
+	}
+
+	for _, dir := range dirs {
+		files := map[string][]byte{}
+		for _, name := range identityFiles {
+			data, err := os.ReadFile(filepath.Join(dir, name))
+			if err != nil {
+				if os.IsNotExist(err) {
+					continue
+				}
+				return nil, errors.Wrapf(err, "failed to read stand-in %s", name)
+			}
+			files[name] = data
+		}
+		if len(files) > 0 {
+			return files, nil
+		}
+	}
+
+	return nil, errors.Wrapf(errdefs.ErrNotFound, "no stand-in identity files in %s", s.dir)
+}
+
+// contentIdentitySource extracts the identity files from the image layers in
+// the containerd content store
+type contentIdentitySource struct {
+	store content.Provider
+}
+
+// NewContentIdentitySource returns a source extracting the identity files
+// from the layers of an image in the containerd content store. Only the
+// layers above the topmost copy of each file need to be present, which with
+// guest pull is only the case for images also pulled on the host, so that
+// the local source is the one to rely on. The layers are decompressed in full
+// while the top layer is prepared.
+func NewContentIdentitySource(store content.Provider) IdentitySource {
+	return &contentIdentitySource{store: store}
+}
+
+func (s *contentIdentitySource) IdentityFiles(ctx context.Context, labels map[string]string) (map[string][]byte, error) {
+	manifest, err := readManifest(ctx, s.store, labels)
+	if err != nil {
+		return nil, err
+	}
+
+	files := map[string][]byte{}
+	// Files resolved to their topmost copy or whiteout
+	resolved := map[string]bool{}
+
+	for i := len(manifest.Layers) - 1; i >= 0 && len(resolved) < len(identityFiles); i-- {
+		ra, err := s.store.ReaderAt(contentContext(ctx), manifest.Layers[i])
+		if err != nil {
+			return nil, errors.Wrapf(err, "layer %s is not in the content store", manifest.Layers[i].Digest)
+		}
+		err = extractIdentityFiles(io.NewSectionReader(ra, 0, ra.Size()), files, resolved)
+		ra.Close()
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read layer %s", manifest.Layers[i].Digest)
+		}
+	}
+
+	if len(files) == 0 {
+		return nil, errors.Wrap(errdefs.ErrNotFound, "image has no identity files")
+	}
+	return files, nil
+}
+
+// extractIdentityFiles reads the identity files not resolved yet from a layer
+// tarball, honouring the whiteouts of the layer
+func extractIdentityFiles(r io.Reader, files map[string][]byte, resolved map[string]bool) error {
+	ds, err := compression.DecompressStream(r)
+	if err != nil {
+		return err
+	}
+	defer ds.Close()
+
+	// Files hidden by whiteouts of this layer, which only apply to lower layers
+	hidden := map[string]bool{}
+
+	tr := tar.NewReader(ds)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		name := strings.TrimPrefix(path.Clean("/"+hdr.Name), "/")
+		dir, base := path.Split(name)
+		for _, f := range identityFiles {
+			if resolved[f] {
+				continue
+			}
+			switch {
+			case name == f && hdr.Typeflag == tar.TypeReg:
+				data, err := io.ReadAll(tr)
+				if err != nil {
+					return err
+				}
+				files[f] = data
+				resolved[f] = true
+			case base == ".wh..wh..opq" && strings.HasPrefix(f, dir):
+				hidden[f] = true
+			case strings.HasPrefix(base, ".wh."):
+				target := dir + strings.TrimPrefix(base, ".wh.")
+				if f == target || strings.HasPrefix(f, target+"/") {
+					hidden[f] = true
+				}
+			}
+		}
+	}
+
+	for f := range hidden {
+		resolved[f] = true
+	}
+	return nil
+}
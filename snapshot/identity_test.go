@@ -0,0 +1,171 @@
+package snapshot
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containerd/containerd/v2/core/content"
+	"github.com/containerd/containerd/v2/core/snapshots"
+	snpkg "github.com/containerd/containerd/v2/pkg/snapshotters"
+	"github.com/containerd/containerd/v2/plugins/content/local"
+	"github.com/containerd/errdefs"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeLayer writes a gzip compressed layer with the given files to store
+func writeLayer(t *testing.T, store content.Store, files map[string]string) ocispec.Descriptor {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for name, data := range files {
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), Typeflag: tar.TypeReg}))
+		_, err := tw.Write([]byte(data))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	require.NoError(t, gz.Close())
+
+	desc := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageLayerGzip, Digest: digest.FromBytes(buf.Bytes()), Size: int64(buf.Len())}
+	require.NoError(t, content.WriteBlob(context.Background(), store, desc.Digest.String(), bytes.NewReader(buf.Bytes()), desc))
+	return desc
+}
+
+// writeManifest writes a manifest with the given layers to store
+func writeManifest(t *testing.T, store content.Store, layers ...ocispec.Descriptor) ocispec.Descriptor {
+	t.Helper()
+	data, err := json.Marshal(ocispec.Manifest{MediaType: ocispec.MediaTypeImageManifest, Layers: layers})
+	require.NoError(t, err)
+	desc := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest, Digest: digest.FromBytes(data), Size: int64(len(data))}
+	require.NoError(t, content.WriteBlob(context.Background(), store, desc.Digest.String(), bytes.NewReader(data), desc))
+	return desc
+}
+
+func TestContentIdentitySource(t *testing.T) {
+	ctx := context.Background()
+	store, err := local.NewStore(t.TempDir())
+	require.NoError(t, err)
+
+	base := writeLayer(t, store, map[string]string{"etc/passwd": "root:x:0:0::/root:/bin/sh\n", "etc/group": "root:x:0:\n"})
+	app := writeLayer(t, store, map[string]string{"./etc/passwd": "app:x:1000:1000::/home/app:/bin/sh\n", "usr/bin/app": "binary"})
+	deleted := writeLayer(t, store, map[string]string{"etc/.wh.group": ""})
+
+	testCases := []struct {
+		name     string
+		layers   []ocispec.Descriptor
+		expected map[string][]byte
+	}{
+		{
+			name:   "topmost copy wins",
+			layers: []ocispec.Descriptor{base, app},
+			expected: map[string][]byte{
+				"etc/passwd": []byte("app:x:1000:1000::/home/app:/bin/sh\n"),
+				"etc/group":  []byte("root:x:0:\n"),
+			},
+		},
+		{
+			name:   "whiteout hides lower copies",
+			layers: []ocispec.Descriptor{base, app, deleted},
+			expected: map[string][]byte{
+				"etc/passwd": []byte("app:x:1000:1000::/home/app:/bin/sh\n"),
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			manifest := writeManifest(t, store, tc.layers...)
+			files, err := NewContentIdentitySource(store).IdentityFiles(ctx, map[string]string{
+				snpkg.TargetManifestDigestLabel: manifest.Digest.String(),
+			})
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, files)
+		})
+	}
+
+	manifest := writeManifest(t, store, writeLayer(t, store, map[string]string{"bin/sh": "binary"}))
+	_, err = NewContentIdentitySource(store).IdentityFiles(ctx, map[string]string{
+		snpkg.TargetManifestDigestLabel: manifest.Digest.String(),
+	})
+	assert.True(t, errdefs.IsNotFound(err), "expected not found, got %v", err)
+}
+
+func TestPrepareTopLayerWithIdentityStub(t *testing.T) {
+	ctx := context.Background()
+
+	standIn := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(standIn, "etc"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(standIn, "etc", "passwd"), []byte("app:x:1000:1000::/:/bin/sh\n"), 0644))
+
+	sn, err := NewSnapshotter(ctx, WithRootDirectory(t.TempDir()), WithIdentityStub(NewLocalIdentitySource(standIn)))
+	require.NoError(t, err)
+	defer sn.Close()
+
+	prepareLayer := func(key, target, layer, layers string) string {
+		_, err := sn.Prepare(ctx, key, "", snapshots.WithLabels(map[string]string{
+			targetSnapshotLabel:          target,
+			snpkg.TargetLayerDigestLabel: layer,
+			snpkg.TargetImageLayersLabel: layers,
+		}))
+		require.True(t, errdefs.IsAlreadyExists(err))
+		id, _, _, err := sn.(*snapshotter).getSnapshotInfo(ctx, target)
+		require.NoError(t, err)
+		return sn.(*snapshotter).upperPath(id)
+	}
+
+	lower := prepareLayer("extract-lower", "lower", "sha256:a", "sha256:a,sha256:b")
+	assert.NoFileExists(t, filepath.Join(lower, "etc", "passwd"))
+
+	top := prepareLayer("extract-top", "top", "sha256:b", "sha256:b")
+	data, err := os.ReadFile(filepath.Join(top, "etc", "passwd"))
+	require.NoError(t, err)
+	assert.Equal(t, "app:x:1000:1000::/:/bin/sh\n", string(data))
+	assert.NoFileExists(t, filepath.Join(top, "etc", "group"))
+}
+
+func TestIdentityStubWithoutLayersOnHost(t *testing.T) {
+	ctx := context.Background()
+	store, err := local.NewStore(t.TempDir())
+	require.NoError(t, err)
+
+	// containerd fetches the manifest of guest pulled images but not their
+	// layers
+	layer := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageLayerGzip, Digest: digest.FromString("layer"), Size: 5}
+	manifest := writeManifest(t, store, layer)
+	labels := map[string]string{
+		targetSnapshotLabel:             "top",
+		snpkg.TargetLayerDigestLabel:    layer.Digest.String(),
+		snpkg.TargetImageLayersLabel:    layer.Digest.String(),
+		snpkg.TargetManifestDigestLabel: manifest.Digest.String(),
+	}
+
+	_, err = NewContentIdentitySource(store).IdentityFiles(ctx, labels)
+	assert.True(t, errdefs.IsNotFound(err), "expected not found, got %v", err)
+
+	// The local source provides the files then
+	standIn := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(standIn, "etc"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(standIn, "etc", "passwd"), []byte("app:x:1000:1000::/:/bin/sh\n"), 0644))
+
+	sn, err := NewSnapshotter(ctx, WithRootDirectory(t.TempDir()),
+		WithIdentityStub(NewContentIdentitySource(store), NewLocalIdentitySource(standIn)))
+	require.NoError(t, err)
+	defer sn.Close()
+
+	_, err = sn.Prepare(ctx, "extract-top", "", snapshots.WithLabels(labels))
+	require.True(t, errdefs.IsAlreadyExists(err))
+	id, _, _, err := sn.(*snapshotter).getSnapshotInfo(ctx, "top")
+	require.NoError(t, err)
+	data, err := os.ReadFile(filepath.Join(sn.(*snapshotter).upperPath(id), "etc", "passwd"))
+	require.NoError(t, err)
+	assert.Equal(t, "app:x:1000:1000::/:/bin/sh\n", string(data))
+}
@@ -0,0 +1,48 @@
+package snapshot
+
+import (
+	"fmt"
+
+	"github.com/containerd/containerd/v2/core/snapshots"
+	"github.com/pkg/errors"
+)
+
+// idMappingLabels are the labels containerd sets on the snapshots of
+// user-namespaced containers, forwarded to the guest with the Kata volume
+var idMappingLabels = []string{
+	snapshots.LabelSnapshotUIDMapping,
+	snapshots.LabelSnapshotGIDMapping,
+}
+
+// hostID parses an id mapping label of the form "<ctrID>:<hostID>:<length>"
+// and returns the host id that container id 0 is mapped to
+func hostID(mapping string) (int, error) {
+	var ctrID, hostID, length int
+	if _, err := fmt.Sscanf(mapping, "%d:%d:%d", &ctrID, &hostID, &length); err != nil {
+		return -1, errors.Wrapf(err, "invalid mapping %q", mapping)
+	}
+	if ctrID < 0 || hostID < 0 || length <= 0 {
+		return -1, errors.Errorf("invalid mapping %q", mapping)
+	}
+	if ctrID != 0 {
+		return -1, errors.Errorf("invalid mapping %q: only container id 0 can be mapped", mapping)
+	}
+	return hostID, nil
+}
+
+// mappedOwner returns the host uid and gid that own the root of a snapshot
+// with the given labels, or -1 for ids that are not mapped
+func mappedOwner(labels map[string]string) (uid, gid int, err error) {
+	uid, gid = -1, -1
+	if v, ok := labels[snapshots.LabelSnapshotUIDMapping]; ok {
+		if uid, err = hostID(v); err != nil {
+			return -1, -1, errors.Wrap(err, "failed to parse UID mapping")
+		}
+	}
+	if v, ok := labels[snapshots.LabelSnapshotGIDMapping]; ok {
+		if gid, err = hostID(v); err != nil {
+			return -1, -1, errors.Wrap(err, "failed to parse GID mapping")
+		}
+	}
+	return uid, gid, nil
+}
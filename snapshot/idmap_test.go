@@ -0,0 +1,126 @@
+package snapshot
+
+import (
+	"context"
+	"os"
+	"syscall"
+	"testing"
+
+	guestpull "github.com/ChengyuZhu6/guest-pull-snapshotter/guest-pull"
+	"github.com/containerd/containerd/v2/core/snapshots"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHostID(t *testing.T) {
+	testCases := []struct {
+		mapping  string
+		expected int
+		wantErr  bool
+	}{
+		{mapping: "0:65536:65536", expected: 65536},
+		{mapping: "1:65536:65536", wantErr: true},
+		{mapping: "0:-1:65536", wantErr: true},
+		{mapping: "0:65536:0", wantErr: true},
+		{mapping: "invalid", wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.mapping, func(t *testing.T) {
+			id, err := hostID(tc.mapping)
+			if tc.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, id)
+		})
+	}
+}
+
+func TestPrepareWithIDMapping(t *testing.T) {
+	ctx := context.Background()
+	sn, err := NewSnapshotter(ctx, WithRootDirectory(t.TempDir()))
+	require.NoError(t, err)
+	defer sn.Close()
+
+	labels := map[string]string{
+		snapshots.LabelSnapshotUIDMapping: "0:65536:65536",
+		snapshots.LabelSnapshotGIDMapping: "0:65537:65536",
+		"other":                           "label",
+	}
+	mounts, err := sn.Prepare(ctx, "container", "", snapshots.WithLabels(labels))
+	require.NoError(t, err)
+	require.Len(t, mounts, 1)
+
+	volume := decodeMountVolume(t, mounts)
+	assert.Equal(t, map[string]string{
+		guestpull.VolumeKindMetadataKey:   guestpull.VolumeKindRootfs,
+		snapshots.LabelSnapshotUIDMapping: "0:65536:65536",
+		snapshots.LabelSnapshotGIDMapping: "0:65537:65536",
+	}, volume.ImagePull.Metadata)
+
+	if os.Getuid() != 0 {
+		t.Skip("chowning the upper directory requires root")
+	}
+	id, _, _, err := sn.(*snapshotter).getSnapshotInfo(ctx, "container")
+	require.NoError(t, err)
+	st, err := os.Stat(sn.(*snapshotter).upperPath(id))
+	require.NoError(t, err)
+	assert.Equal(t, uint32(65536), st.Sys().(*syscall.Stat_t).Uid)
+	assert.Equal(t, uint32(65537), st.Sys().(*syscall.Stat_t).Gid)
+}
+
+func TestPrepareWithOneIDMapping(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("chowning the upper directory requires root")
+	}
+	ctx := context.Background()
+	sn, err := NewSnapshotter(ctx, WithRootDirectory(t.TempDir()))
+	require.NoError(t, err)
+	defer sn.Close()
+	o := sn.(*snapshotter)
+
+	_, err = sn.Prepare(ctx, "layer-active", "")
+	require.NoError(t, err)
+	require.NoError(t, sn.Commit(ctx, "layer", "layer-active"))
+	parentID, _, _, err := o.getSnapshotInfo(ctx, "layer")
+	require.NoError(t, err)
+	require.NoError(t, os.Lchown(o.upperPath(parentID), 1000, 1001))
+
+	// The mapped uid is kept and the gid inherited from the parent
+	_, err = sn.Prepare(ctx, "uid-only", "layer", snapshots.WithLabels(map[string]string{
+		snapshots.LabelSnapshotUIDMapping: "0:65536:65536",
+	}))
+	require.NoError(t, err)
+	id, _, _, err := o.getSnapshotInfo(ctx, "uid-only")
+	require.NoError(t, err)
+	st, err := os.Stat(o.upperPath(id))
+	require.NoError(t, err)
+	assert.Equal(t, uint32(65536), st.Sys().(*syscall.Stat_t).Uid)
+	assert.Equal(t, uint32(1001), st.Sys().(*syscall.Stat_t).Gid)
+
+	// Without a parent, the id that isn't mapped is left unchanged
+	_, err = sn.Prepare(ctx, "gid-only", "", snapshots.WithLabels(map[string]string{
+		snapshots.LabelSnapshotGIDMapping: "0:65537:65536",
+	}))
+	require.NoError(t, err)
+	id, _, _, err = o.getSnapshotInfo(ctx, "gid-only")
+	require.NoError(t, err)
+	st, err = os.Stat(o.upperPath(id))
+	require.NoError(t, err)
+	assert.Equal(t, uint32(0), st.Sys().(*syscall.Stat_t).Uid)
+	assert.Equal(t, uint32(65537), st.Sys().(*syscall.Stat_t).Gid)
+}
+
+func TestPrepareWithInvalidIDMapping(t *testing.T) {
+	ctx := context.Background()
+	sn, err := NewSnapshotter(ctx, WithRootDirectory(t.TempDir()))
+	require.NoError(t, err)
+	defer sn.Close()
+
+	_, err = sn.Prepare(ctx, "container", "", snapshots.WithLabels(map[string]string{
+		snapshots.LabelSnapshotUIDMapping: "1:65536:65536",
+	}))
+	assert.Error(t, err)
+}
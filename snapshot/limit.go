@@ -0,0 +1,235 @@
+package snapshot
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/containerd/containerd/v2/core/snapshots"
+	"github.com/containerd/errdefs"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/sync/semaphore"
+)
+
+// Operations walking snapshot directories, whose concurrency can be limited
+const (
+	OperationCommit = "commit"
+	OperationUsage  = "usage"
+)
+
+// WithConcurrencyLimit runs at most n disk usage walks of operation at once,
+// queueing the other calls. 0 means no limit.
+func WithConcurrencyLimit(operation string, n int) Opt {
+	return func(config *SnapshotterConfig) {
+		if config.concurrencyLimits == nil {
+			config.concurrencyLimits = map[string]int{}
+		}
+		config.concurrencyLimits[operation] = n
+	}
+}
+
+// WithQueueTimeout fails calls queued by a concurrency limit for longer than
+// d with an error satisfying errdefs.IsUnavailable. Calls are always bound by
+// the deadline of their context.
+func WithQueueTimeout(d time.Duration) Opt {
+	return func(config *SnapshotterConfig) {
+		config.queueTimeout = d
+	}
+}
+
+// WithUsageCacheTTL reuses the disk usage of active snapshots for d, so that
+// the stats collection of the CRI doesn't walk their tree on every call
+func WithUsageCacheTTL(d time.Duration) Opt {
+	return func(config *SnapshotterConfig) {
+		config.usageCacheTTL = d
+	}
+}
+
+// WithMetrics registers the metrics of the snapshotter with r
+func WithMetrics(r prometheus.Registerer) Opt {
+	return func(config *SnapshotterConfig) {
+		config.metrics = r
+	}
+}
+
+// limiter bounds the number of concurrent calls of an operation
+type limiter struct {
+	sem     *semaphore.Weighted
+	timeout time.Duration
+
+	// queued is the number of calls waiting for a slot
+	queued atomic.Int64
+	// running is the number of calls holding a slot
+	running atomic.Int64
+}
+
+// newLimiters returns the limiters of the operations configured by config
+func newLimiters(config SnapshotterConfig) map[string]*limiter {
+	return map[string]*limiter{
+		OperationCommit: newLimiter(config.concurrencyLimits[OperationCommit], config.queueTimeout),
+		OperationUsage:  newLimiter(config.concurrencyLimits[OperationUsage], config.queueTimeout),
+	}
+}
+
+// limiter returns the limiter of operation. Calls holding a slot of a limiter
+// replaced by a reload release it to that limiter.
+func (o *snapshotter) limiter(operation string) *limiter {
+	o.limitsMu.RLock()
+	defer o.limitsMu.RUnlock()
+	return o.limiters[operation]
+}
+
+func newLimiter(n int, timeout time.Duration) *limiter {
+	l := &limiter{timeout: timeout}
+	if n > 0 {
+		l.sem = semaphore.NewWeighted(int64(n))
+	}
+	return l
+}
+
+// acquire waits for a slot and returns the function releasing it
+func (l *limiter) acquire(ctx context.Context) (func(), error) {
+	if l.sem != nil && !l.sem.TryAcquire(1) {
+		l.queued.Add(1)
+		err := l.wait(ctx)
+		l.queued.Add(-1)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	l.running.Add(1)
+	return func() {
+		l.running.Add(-1)
+		if l.sem != nil {
+			l.sem.Release(1)
+		}
+	}, nil
+}
+
+func (l *limiter) wait(ctx context.Context) error {
+	waitCtx := ctx
+	if l.timeout > 0 {
+		var cancel context.CancelFunc
+		waitCtx, cancel = context.WithTimeout(ctx, l.timeout)
+		defer cancel()
+	}
+
+	if err := l.sem.Acquire(waitCtx, 1); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return errors.Wrapf(errdefs.ErrUnavailable, "no slot freed up within %s", l.timeout)
+	}
+	return nil
+}
+
+// usageCache holds the disk usage of active snapshots for a while
+type usageCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[string]usageCacheEntry
+	hits    atomic.Int64
+}
+
+type usageCacheEntry struct {
+	usage   snapshots.Usage
+	expires time.Time
+}
+
+func newUsageCache(ttl time.Duration) *usageCache {
+	return &usageCache{ttl: ttl, entries: map[string]usageCacheEntry{}}
+}
+
+func (c *usageCache) get(id string) (snapshots.Usage, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.ttl <= 0 {
+		return snapshots.Usage{}, false
+	}
+
+	e, ok := c.entries[id]
+	if !ok || time.Now().After(e.expires) {
+		return snapshots.Usage{}, false
+	}
+	c.hits.Add(1)
+	return e.usage, true
+}
+
+func (c *usageCache) put(id string, usage snapshots.Usage) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.ttl <= 0 {
+		return
+	}
+
+	now := time.Now()
+	for k, e := range c.entries {
+		if now.After(e.expires) {
+			delete(c.entries, k)
+		}
+	}
+	c.entries[id] = usageCacheEntry{usage: usage, expires: now.Add(c.ttl)}
+}
+
+// setTTL changes how long usages are kept, dropping those kept so far
+func (c *usageCache) setTTL(ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ttl = ttl
+	clear(c.entries)
+}
+
+// forget drops the usage of a snapshot that was committed or removed
+func (c *usageCache) forget(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, id)
+}
+
+// registerMetrics registers the queue depth and the number of running calls
+// of the limited operations and the hits of the usage cache with r
+func (o *snapshotter) registerMetrics(r prometheus.Registerer) error {
+	queued := prometheus.NewDesc("guest_pull_snapshotter_queued_operations",
+		"Number of calls waiting for a concurrency slot", []string{"operation"}, nil)
+	running := prometheus.NewDesc("guest_pull_snapshotter_running_operations",
+		"Number of calls holding a concurrency slot", []string{"operation"}, nil)
+
+	collectors := []prometheus.Collector{
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "guest_pull_snapshotter_usage_cache_hits_total",
+			Help: "Number of Usage calls answered from the usage cache",
+		}, func() float64 { return float64(o.usageCache.hits.Load()) }),
+		&limiterCollector{snapshotter: o, queued: queued, running: running},
+	}
+	for _, c := range collectors {
+		if err := r.Register(c); err != nil {
+			return errors.Wrap(err, "failed to register metrics")
+		}
+	}
+	return nil
+}
+
+// limiterCollector reports the state of the limiters of a snapshotter
+type limiterCollector struct {
+	snapshotter *snapshotter
+	queued      *prometheus.Desc
+	running     *prometheus.Desc
+}
+
+func (c *limiterCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.queued
+	ch <- c.running
+}
+
+func (c *limiterCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, operation := range []string{OperationCommit, OperationUsage} {
+		l := c.snapshotter.limiter(operation)
+		ch <- prometheus.MustNewConstMetric(c.queued, prometheus.GaugeValue, float64(l.queued.Load()), operation)
+		ch <- prometheus.MustNewConstMetric(c.running, prometheus.GaugeValue, float64(l.running.Load()), operation)
+	}
+}
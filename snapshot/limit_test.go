@@ -0,0 +1,120 @@
+package snapshot
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/v2/core/snapshots"
+	"github.com/containerd/errdefs"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLimiter(t *testing.T) {
+	l := newLimiter(1, 50*time.Millisecond)
+
+	release, err := l.acquire(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), l.running.Load())
+
+	_, err = l.acquire(context.Background())
+	assert.True(t, errdefs.IsUnavailable(err), "expected unavailable, got %v", err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = l.acquire(ctx)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, int64(0), l.queued.Load())
+
+	release()
+	assert.Equal(t, int64(0), l.running.Load())
+}
+
+func TestLimiterQueue(t *testing.T) {
+	l := newLimiter(1, 0)
+
+	release, err := l.acquire(context.Background())
+	require.NoError(t, err)
+
+	acquired := make(chan struct{})
+	go func() {
+		defer close(acquired)
+		if release, err := l.acquire(context.Background()); err == nil {
+			release()
+		}
+	}()
+
+	require.Eventually(t, func() bool { return l.queued.Load() == 1 }, time.Second, time.Millisecond)
+	release()
+	<-acquired
+	assert.Equal(t, int64(0), l.queued.Load())
+	assert.Equal(t, int64(0), l.running.Load())
+}
+
+func TestUsageCache(t *testing.T) {
+	ctx := context.Background()
+	registry := prometheus.NewRegistry()
+
+	sn, err := NewSnapshotter(ctx, WithRootDirectory(t.TempDir()),
+		WithUsageCacheTTL(time.Hour), WithConcurrencyLimit(OperationUsage, 1), WithMetrics(registry))
+	require.NoError(t, err)
+	defer sn.Close()
+
+	_, err = sn.Prepare(ctx, "container", "")
+	require.NoError(t, err)
+	before, err := sn.Usage(ctx, "container")
+	require.NoError(t, err)
+
+	id, _, _, err := sn.(*snapshotter).getSnapshotInfo(ctx, "container")
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(sn.(*snapshotter).upperPath(id), "data"), make([]byte, 1<<20), 0644))
+
+	cached, err := sn.Usage(ctx, "container")
+	require.NoError(t, err)
+	assert.Equal(t, before, cached)
+
+	// Committing drops the cached usage
+	require.NoError(t, sn.Commit(ctx, "committed", "container"))
+	committed, err := sn.Usage(ctx, "committed")
+	require.NoError(t, err)
+	assert.Greater(t, committed.Size, before.Size)
+
+	count, err := testutil.GatherAndCount(registry, "guest_pull_snapshotter_queued_operations")
+	require.NoError(t, err)
+	assert.Equal(t, 2, count)
+	assert.Equal(t, int64(1), sn.(*snapshotter).usageCache.hits.Load())
+}
+
+func TestReload(t *testing.T) {
+	ctx := context.Background()
+	sn, err := NewSnapshotter(ctx, WithRootDirectory(t.TempDir()),
+		WithUsageCacheTTL(time.Hour), WithConcurrencyLimit(OperationCommit, 1))
+	require.NoError(t, err)
+	defer sn.Close()
+	o := sn.(*snapshotter)
+
+	old := o.limiter(OperationCommit)
+	release, err := old.acquire(ctx)
+	require.NoError(t, err)
+	o.usageCache.put("1", snapshots.Usage{Size: 1})
+
+	o.Reload(ctx, WithConcurrencyLimit(OperationCommit, 2), WithQueueTimeout(time.Second), WithDefaultQuota(1<<30))
+
+	// The slot held before the reload is released to the old limiter
+	assert.NotSame(t, old, o.limiter(OperationCommit))
+	assert.Equal(t, int64(0), o.limiter(OperationCommit).running.Load())
+	release()
+	assert.Equal(t, int64(0), old.running.Load())
+
+	// Without a TTL the cache is disabled
+	_, ok := o.usageCache.get("1")
+	assert.False(t, ok)
+	size, err := o.quotaSize(snapshots.KindActive, nil)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1<<30), size)
+}
@@ -0,0 +1,45 @@
+package snapshot
+
+import "sync"
+
+// keyLocker serialises the operations on one snapshot key while letting
+// operations on other keys run concurrently
+type keyLocker struct {
+	mu    sync.Mutex
+	locks map[string]*keyLock
+}
+
+type keyLock struct {
+	sync.Mutex
+	// waiters counts the holder and the callers waiting for the lock, the
+	// lock is dropped from the map when it reaches 0
+	waiters int
+}
+
+func newKeyLocker() *keyLocker {
+	return &keyLocker{locks: map[string]*keyLock{}}
+}
+
+// lock locks key and returns the function unlocking it
+func (l *keyLocker) lock(key string) func() {
+	l.mu.Lock()
+	kl, ok := l.locks[key]
+	if !ok {
+		kl = &keyLock{}
+		l.locks[key] = kl
+	}
+	kl.waiters++
+	l.mu.Unlock()
+
+	kl.Lock()
+	return func() {
+		kl.Unlock()
+
+		l.mu.Lock()
+		kl.waiters--
+		if kl.waiters == 0 {
+			delete(l.locks, key)
+		}
+		l.mu.Unlock()
+	}
+}
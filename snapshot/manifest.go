@@ -0,0 +1,44 @@
+package snapshot
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/containerd/containerd/v2/core/content"
+	"github.com/containerd/containerd/v2/pkg/namespaces"
+	snpkg "github.com/containerd/containerd/v2/pkg/snapshotters"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// contentContext prepares ctx for calls to the containerd content store.
+// Requests from containerd carry the namespace in the incoming metadata, the
+// content store needs it in the outgoing one.
+func contentContext(ctx context.Context) context.Context {
+	if ns, ok := namespaces.Namespace(ctx); ok {
+		ctx = namespaces.WithNamespace(ctx, ns)
+	}
+	return ctx
+}
+
+// readManifest reads the manifest of the image a layer is pulled for from the
+// content store, as named by the labels of the layer snapshot
+func readManifest(ctx context.Context, store content.Provider, labels map[string]string) (ocispec.Manifest, error) {
+	manifestDigest, err := digest.Parse(labels[snpkg.TargetManifestDigestLabel])
+	if err != nil {
+		return ocispec.Manifest{}, errors.Wrapf(err, "invalid label %s", snpkg.TargetManifestDigestLabel)
+	}
+
+	data, err := content.ReadBlob(contentContext(ctx), store, ocispec.Descriptor{Digest: manifestDigest})
+	if err != nil {
+		return ocispec.Manifest{}, errors.Wrapf(err, "failed to read manifest %s", manifestDigest)
+	}
+
+	var manifest ocispec.Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return ocispec.Manifest{}, errors.Wrapf(err, "failed to unmarshal manifest %s", manifestDigest)
+	}
+
+	return manifest, nil
+}
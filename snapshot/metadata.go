@@ -0,0 +1,122 @@
+package snapshot
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/containerd/containerd/v2/core/snapshots/storage"
+	"github.com/containerd/errdefs"
+	"github.com/containerd/log"
+	"github.com/pkg/errors"
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/ChengyuZhu6/guest-pull-snapshotter/metadata"
+)
+
+// MetadataStore is implemented by the snapshotter to inspect and copy its
+// metadata store while serving requests, as other processes can't open it
+type MetadataStore interface {
+	// BackupMetadata writes a consistent copy of the metadata store to w,
+	// passing its size to size before writing it
+	BackupMetadata(ctx context.Context, w io.Writer, size func(int64)) (int64, error)
+	// MetadataVersion returns the schema version of the metadata store
+	MetadataVersion(ctx context.Context) (int, error)
+}
+
+var _ MetadataStore = &snapshotter{}
+
+// WithLockTimeout sets how long opening the metadata store waits for another
+// process holding it, by default metadata.DefaultLockTimeout
+func WithLockTimeout(d time.Duration) Opt {
+	return func(config *SnapshotterConfig) {
+		config.lockTimeout = d
+	}
+}
+
+// prepareMetadata checks that no other process uses the metadata store in
+// root and migrates its schema
+func prepareMetadata(ctx context.Context, root string, lockTimeout time.Duration) error {
+	db, err := metadata.Open(metadata.Path(root), lockTimeout, false)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	from, err := metadata.Migrate(db)
+	if err != nil {
+		return err
+	}
+	if from != metadata.SchemaVersion {
+		log.G(ctx).Infof("migrated metadata schema from version %d to %d", from, metadata.SchemaVersion)
+	}
+	return nil
+}
+
+// openMetaStore opens the metadata store at path. storage.MetaStore waits for
+// the lock of the store without timeout, so another process taking it after
+// the check of prepareMetadata would block the start forever; the store is
+// left to close in the background instead once lockTimeout has passed.
+func openMetaStore(ctx context.Context, path string, lockTimeout time.Duration) (*storage.MetaStore, error) {
+	ms, err := storage.NewMetaStore(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create metadata store")
+	}
+
+	// The store is opened on the first transaction
+	opened := make(chan error, 1)
+	go func() {
+		opened <- ms.WithTransaction(context.WithoutCancel(ctx), false, func(context.Context) error { return nil })
+	}()
+
+	timer := time.NewTimer(lockTimeout)
+	defer timer.Stop()
+
+	select {
+	case err := <-opened:
+		if err != nil {
+			ms.Close()
+			return nil, errors.Wrap(err, "failed to open metadata store")
+		}
+		return ms, nil
+	case <-timer.C:
+		go func() {
+			<-opened
+			ms.Close()
+		}()
+		return nil, errors.Wrapf(errdefs.ErrUnavailable,
+			"metadata store %s is in use by another process, is the snapshotter running?", path)
+	}
+}
+
+// withBoltTransaction runs fn in a read-only transaction of the metadata store
+func (o *snapshotter) withBoltTransaction(ctx context.Context, fn func(tx *bolt.Tx) error) error {
+	_, t, err := o.ms.TransactionContext(ctx, false)
+	if err != nil {
+		return err
+	}
+	defer t.Rollback()
+
+	tx, ok := t.(*bolt.Tx)
+	if !ok {
+		return errors.Errorf("unexpected metadata transaction %T", t)
+	}
+	return fn(tx)
+}
+
+func (o *snapshotter) BackupMetadata(ctx context.Context, w io.Writer, size func(int64)) (n int64, err error) {
+	err = o.withBoltTransaction(ctx, func(tx *bolt.Tx) error {
+		size(tx.Size())
+		n, err = metadata.Backup(tx, w)
+		return err
+	})
+	return n, err
+}
+
+func (o *snapshotter) MetadataVersion(ctx context.Context) (version int, err error) {
+	err = o.withBoltTransaction(ctx, func(tx *bolt.Tx) error {
+		version = metadata.Version(tx)
+		return nil
+	})
+	return version, err
+}
@@ -0,0 +1,69 @@
+package snapshot
+
+import (
+	"strings"
+
+	"github.com/ChengyuZhu6/guest-pull-snapshotter/config"
+)
+
+// WithMountHelper sets the name of the mount helper binary, which makes the
+// mounts of type "fuse.<name>". The Kata shim patched for guest pull only
+// recognizes helpers whose name starts with "guest-pull-overlayfs".
+func WithMountHelper(name string) Opt {
+	return func(config *SnapshotterConfig) {
+		config.mountHelper = name
+	}
+}
+
+// WithMountType sets the type of the mounts, replacing the one made from the
+// mount helper, such as "fuse3.guest-pull-overlayfs"
+func WithMountType(t string) Opt {
+	return func(config *SnapshotterConfig) {
+		config.mountType = t
+	}
+}
+
+// WithMountSource sets the source of the mounts, which tells the mounts of
+// several snapshotters apart in the mount table
+func WithMountSource(source string) Opt {
+	return func(config *SnapshotterConfig) {
+		config.mountSource = source
+	}
+}
+
+// resolvedMountType returns the type of the mounts, made from the mount helper
+// unless set
+func (c *SnapshotterConfig) resolvedMountType() string {
+	if c.mountType != "" {
+		return c.mountType
+	}
+	return MountType(c.mountHelper)
+}
+
+// resolvedMountSource returns the source of the mounts
+func (c *SnapshotterConfig) resolvedMountSource() string {
+	if c.mountSource != "" {
+		return c.mountSource
+	}
+	return config.DefaultMountSource
+}
+
+// MountType returns the type of the mounts of helper when no type is set,
+// such as "fuse.guest-pull-overlayfs"
+func MountType(helper string) string {
+	if helper == "" {
+		helper = config.DefaultMountHelper
+	}
+	return "fuse." + helper
+}
+
+// MountHelper returns the helper binary containerd runs for mounts of type t,
+// empty if it doesn't run one
+func MountHelper(t string) string {
+	for _, prefix := range []string{"fuse.", "fuse3."} {
+		if strings.HasPrefix(t, prefix) {
+			return strings.TrimPrefix(t, prefix)
+		}
+	}
+	return ""
+}
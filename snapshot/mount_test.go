@@ -0,0 +1,51 @@
+package snapshot
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMountTypeAndSource(t *testing.T) {
+	ctx := context.Background()
+	for _, tc := range []struct {
+		name           string
+		opts           []Opt
+		expectedType   string
+		expectedSource string
+	}{
+		{name: "default", expectedType: "fuse.guest-pull-overlayfs", expectedSource: "overlay"},
+		{
+			name:           "helper",
+			opts:           []Opt{WithMountHelper("guest-pull-overlayfs-verity"), WithMountSource("verity")},
+			expectedType:   "fuse.guest-pull-overlayfs-verity",
+			expectedSource: "verity",
+		},
+		{
+			name:           "type",
+			opts:           []Opt{WithMountHelper("ignored"), WithMountType("fuse3.guest-pull-overlayfs")},
+			expectedType:   "fuse3.guest-pull-overlayfs",
+			expectedSource: "overlay",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			sn, err := NewSnapshotter(ctx, append([]Opt{WithRootDirectory(t.TempDir())}, tc.opts...)...)
+			require.NoError(t, err)
+			defer sn.Close()
+
+			mounts, err := sn.Prepare(ctx, "container", "")
+			require.NoError(t, err)
+			require.Len(t, mounts, 1)
+			assert.Equal(t, tc.expectedType, mounts[0].Type)
+			assert.Equal(t, tc.expectedSource, mounts[0].Source)
+		})
+	}
+}
+
+func TestMountHelper(t *testing.T) {
+	assert.Equal(t, "guest-pull-overlayfs", MountHelper(MountType("")))
+	assert.Equal(t, "guest-pull-overlayfs-verity", MountHelper("fuse3.guest-pull-overlayfs-verity"))
+	assert.Equal(t, "", MountHelper("overlay"))
+}
@@ -0,0 +1,165 @@
+package snapshot
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+
+	"github.com/ChengyuZhu6/guest-pull-snapshotter/config"
+	"github.com/ChengyuZhu6/guest-pull-snapshotter/quota"
+	"github.com/containerd/containerd/v2/core/snapshots"
+	"github.com/containerd/errdefs"
+	"github.com/containerd/log"
+	"github.com/pkg/errors"
+)
+
+// quotaLabel sets the disk quota of a writable layer, such as "10GiB",
+// overriding the default quota
+const quotaLabel = "containerd.io/snapshot/guestpull.quota"
+
+// WithDefaultQuota limits the writable layer of every container mounted on
+// the host to size bytes, unless the snapshot carries a quota label
+func WithDefaultQuota(size uint64) Opt {
+	return func(config *SnapshotterConfig) {
+		config.defaultQuota = size
+	}
+}
+
+// quotaSize returns the quota requested for a new snapshot, 0 if it has none.
+// Only the writable layers of containers mounted on the host get quotas, as
+// guest pulled layers never hold data on the host.
+func (o *snapshotter) quotaSize(kind snapshots.Kind, labels map[string]string) (uint64, error) {
+	if kind != snapshots.KindActive || IsGuestPullMode(labels) {
+		return 0, nil
+	}
+	if _, ok := labels[targetSnapshotLabel]; ok {
+		return 0, nil
+	}
+
+	if v, ok := labels[quotaLabel]; ok {
+		size, err := config.ParseSize(v)
+		if err != nil {
+			return 0, errors.Wrapf(errdefs.ErrInvalidArgument, "label %s: %v", quotaLabel, err)
+		}
+		return size, nil
+	}
+
+	return o.defaultQuota.Load(), nil
+}
+
+// projectIDsInUse reports whether upper directories have quotas, replaced in
+// tests
+var projectIDsInUse = quota.InUse
+
+// initQuota sets up the quota control when the snapshotter starts with a
+// default quota or with upper directories that have quotas, so that the usage
+// of those directories is read from their quotas and their project ids are
+// released on removal before any new snapshot gets a quota
+func (o *snapshotter) initQuota(ctx context.Context) {
+	o.checkDefaultQuota(ctx)
+
+	snapshotsDir := filepath.Join(o.root, "snapshots")
+	existing, err := filepath.Glob(filepath.Join(snapshotsDir, "*", "fs"))
+	if err != nil || len(existing) == 0 {
+		return
+	}
+	inUse, err := projectIDsInUse(snapshotsDir, existing)
+	if err != nil {
+		log.G(ctx).WithError(err).Debug("failed to look for disk quotas of snapshots")
+		return
+	}
+	if inUse {
+		if _, err := o.quotaControl(); err != nil {
+			log.G(ctx).WithError(err).Warn("snapshots have disk quotas that can't be read or released")
+		}
+	}
+}
+
+// checkDefaultQuota warns if the default quota is set but can't be enforced
+func (o *snapshotter) checkDefaultQuota(ctx context.Context) {
+	if o.defaultQuota.Load() > 0 {
+		if _, err := o.quotaControl(); err != nil {
+			log.G(ctx).WithError(err).Warn("default disk quota can't be enforced, preparing writable layers will fail")
+		}
+	}
+}
+
+// backingFsBlockDev is the block device node of the filesystem of the root
+// directory that quotactl(2) addresses. It lives in the root directory, as
+// the snapshots directory is the lower directory of the mounts of snapshots
+// without parent.
+const backingFsBlockDev = "backingFsBlockDev"
+
+// quotaControl returns the quota control of the snapshots directory, which is
+// set up the first time a quota is requested
+func (o *snapshotter) quotaControl() (*quota.Control, error) {
+	o.quotaMu.Lock()
+	defer o.quotaMu.Unlock()
+
+	if o.quota == nil && o.quotaErr == nil {
+		snapshotsDir := filepath.Join(o.root, "snapshots")
+		existing, err := filepath.Glob(filepath.Join(snapshotsDir, "*", "fs"))
+		if err != nil {
+			o.quotaErr = err
+		} else {
+			o.quota, o.quotaErr = quota.NewControl(snapshotsDir, filepath.Join(o.root, backingFsBlockDev), existing)
+		}
+	}
+
+	if o.quotaErr != nil {
+		return nil, errors.Wrapf(errdefs.ErrNotImplemented,
+			"disk quota requested but the filesystem of %s doesn't support project quotas: %v", o.root, o.quotaErr)
+	}
+	return o.quota, nil
+}
+
+// setQuota limits the size of the upper directory at path
+func (o *snapshotter) setQuota(ctx context.Context, path string, size uint64) error {
+	q, err := o.quotaControl()
+	if err != nil {
+		return err
+	}
+
+	if err := q.SetQuota(path, size); err != nil {
+		return err
+	}
+
+	log.G(ctx).WithField("path", path).Debugf("set disk quota of %d bytes", size)
+	return nil
+}
+
+// releaseQuota frees the quota of the upper directory at path before it is
+// removed, so that its project id goes to another snapshot
+func (o *snapshotter) releaseQuota(path string) error {
+	o.quotaMu.Lock()
+	control := o.quota
+	o.quotaMu.Unlock()
+	if control == nil {
+		return nil
+	}
+	if _, err := os.Lstat(path); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	return control.ReleaseQuota(path)
+}
+
+// quotaUsage returns the usage of the upper directory at path as accounted by
+// its quota, and false if the directory has no quota
+func (o *snapshotter) quotaUsage(path string) (snapshots.Usage, bool, error) {
+	o.quotaMu.Lock()
+	control := o.quota
+	o.quotaMu.Unlock()
+	if control == nil {
+		return snapshots.Usage{}, false, nil
+	}
+
+	q, ok, err := control.GetQuota(path)
+	if err != nil || !ok {
+		return snapshots.Usage{}, false, err
+	}
+
+	return snapshots.Usage{Size: q.Used, Inodes: q.Inodes}, true, nil
+}
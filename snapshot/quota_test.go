@@ -0,0 +1,81 @@
+package snapshot
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containerd/containerd/v2/core/snapshots"
+	"github.com/containerd/errdefs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrepareQuotaUnsupported(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	// A node left among the snapshots by an earlier release is removed
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "snapshots"), 0700))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "snapshots", backingFsBlockDev), nil, 0600))
+
+	// Temporary directories live on filesystems without project quotas enabled
+	sn, err := NewSnapshotter(ctx, WithRootDirectory(root))
+	require.NoError(t, err)
+	defer sn.Close()
+
+	_, err = sn.Prepare(ctx, "container", "", snapshots.WithLabels(map[string]string{
+		quotaLabel: "1GiB",
+	}))
+	assert.True(t, errdefs.IsNotImplemented(err), "expected not implemented, got %v", err)
+
+	_, err = sn.Prepare(ctx, "invalid", "", snapshots.WithLabels(map[string]string{
+		quotaLabel: "lots",
+	}))
+	assert.True(t, errdefs.IsInvalidArgument(err), "expected invalid argument, got %v", err)
+
+	// Snapshots without quota are unaffected
+	_, err = sn.Prepare(ctx, "no-quota", "")
+	assert.NoError(t, err)
+
+	// The block device node never shows in the mounts of snapshots
+	_, err = os.Lstat(filepath.Join(root, "snapshots", backingFsBlockDev))
+	assert.True(t, os.IsNotExist(err), "expected no node among the snapshots, got %v", err)
+}
+
+func TestQuotaControlOnRestart(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+
+	sn, err := NewSnapshotter(ctx, WithRootDirectory(root))
+	require.NoError(t, err)
+	_, err = sn.Prepare(ctx, "container", "")
+	require.NoError(t, err)
+	require.NoError(t, sn.Close())
+
+	var checked []string
+	inUse := false
+	prev := projectIDsInUse
+	projectIDsInUse = func(basePath string, paths []string) (bool, error) {
+		checked = append(checked, paths...)
+		return inUse, nil
+	}
+	t.Cleanup(func() { projectIDsInUse = prev })
+
+	// Without quotas among the snapshots the control waits for the first one
+	sn, err = NewSnapshotter(ctx, WithRootDirectory(root))
+	require.NoError(t, err)
+	o := sn.(*snapshotter)
+	assert.Nil(t, o.quota)
+	assert.NoError(t, o.quotaErr)
+	require.NoError(t, sn.Close())
+
+	// Snapshots with quotas set it up right away, here failing as temporary
+	// directories live on filesystems without project quotas enabled
+	inUse = true
+	sn, err = NewSnapshotter(ctx, WithRootDirectory(root))
+	require.NoError(t, err)
+	defer sn.Close()
+	assert.Error(t, sn.(*snapshotter).quotaErr)
+	assert.Len(t, checked, 2)
+}
@@ -0,0 +1,42 @@
+package snapshot
+
+import (
+	"context"
+
+	"github.com/containerd/log"
+)
+
+// Reloadable is implemented by snapshotters whose concurrency limits, usage
+// cache and default quota can change while they run
+type Reloadable interface {
+	// Reload applies the concurrency limits, queue timeout, usage cache TTL
+	// and default quota set by opts, ignoring their other settings. Calls
+	// already queued or running keep the limits they started with.
+	Reload(ctx context.Context, opts ...Opt)
+}
+
+var _ Reloadable = &snapshotter{}
+
+func (o *snapshotter) Reload(ctx context.Context, opts ...Opt) {
+	var config SnapshotterConfig
+	for _, opt := range opts {
+		opt(&config)
+	}
+
+	o.limitsMu.Lock()
+	o.limiters = newLimiters(config)
+	o.limitsMu.Unlock()
+
+	o.usageCache.setTTL(config.usageCacheTTL)
+
+	o.defaultQuota.Store(config.defaultQuota)
+	o.checkDefaultQuota(ctx)
+
+	log.G(ctx).WithFields(log.Fields{
+		"commit_concurrency": config.concurrencyLimits[OperationCommit],
+		"usage_concurrency":  config.concurrencyLimits[OperationUsage],
+		"queue_timeout":      config.queueTimeout,
+		"usage_cache_ttl":    config.usageCacheTTL,
+		"default_quota":      config.defaultQuota,
+	}).Info("reloaded snapshotter limits")
+}
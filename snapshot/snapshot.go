@@ -6,9 +6,16 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 
+	"github.com/ChengyuZhu6/guest-pull-snapshotter/audit"
 	guestpull "github.com/ChengyuZhu6/guest-pull-snapshotter/guest-pull"
+	"github.com/ChengyuZhu6/guest-pull-snapshotter/metadata"
+	"github.com/ChengyuZhu6/guest-pull-snapshotter/quota"
+	"github.com/containerd/containerd/v2/core/content"
 	"github.com/containerd/containerd/v2/core/mount"
 	"github.com/containerd/containerd/v2/core/snapshots"
 	"github.com/containerd/containerd/v2/core/snapshots/storage"
@@ -16,6 +23,10 @@ import (
 	"github.com/containerd/errdefs"
 	"github.com/containerd/log"
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/sync/singleflight"
 )
 
 // Label constants for snapshotter
@@ -27,9 +38,35 @@ const (
 	guestPullLabel = "containerd.io/snapshot/guestpull"
 )
 
+// Metadata store operations, replaced in tests to simulate failures
+var (
+	createSnapshotRecord = storage.CreateSnapshot
+	commitActive         = storage.CommitActive
+	removeSnapshot       = storage.Remove
+)
+
 // SnapshotterConfig is used to configure the remote snapshotter instance
 type SnapshotterConfig struct {
-	root string
+	root         string
+	rootless     bool
+	defaultQuota uint64
+	layerUsage   LayerUsage
+	contentStore content.Provider
+
+	identitySources []IdentitySource
+	auditLog        *audit.Logger
+
+	concurrencyLimits map[string]int
+	queueTimeout      time.Duration
+	usageCacheTTL     time.Duration
+	metrics           prometheus.Registerer
+	lockTimeout       time.Duration
+
+	mountHelper string
+	mountType   string
+	mountSource string
+
+	volumeEncoder guestpull.Encoder
 }
 
 // Opt is an option to configure the guest pull snapshotter
@@ -42,10 +79,48 @@ func WithRootDirectory(path string) Opt {
 	}
 }
 
+// WithRootless configures the snapshotter for a containerd that runs without
+// root privileges, where snapshot directories can't be chowned
+func WithRootless() Opt {
+	return func(config *SnapshotterConfig) {
+		config.rootless = true
+	}
+}
+
 // snapshotter implements the containerd snapshotter interface
 type snapshotter struct {
-	root string
-	ms   *storage.MetaStore
+	root         string
+	rootless     bool
+	defaultQuota atomic.Uint64
+	layerUsage   LayerUsage
+	contentStore content.Provider
+	ms           *storage.MetaStore
+
+	identitySources []IdentitySource
+	auditLog        *audit.Logger
+
+	// mountType and mountSource are those of the mounts returned to
+	// containerd
+	mountType   string
+	mountSource string
+
+	// volumeEncoder passes the volume describing a snapshot to the runtime
+	volumeEncoder guestpull.Encoder
+
+	quotaMu  sync.Mutex
+	quota    *quota.Control
+	quotaErr error
+
+	// locks serialises the operations on each snapshot key
+	locks *keyLocker
+	// targets coalesces concurrent Prepare calls for the same target
+	targets singleflight.Group
+
+	// limiters bound the disk usage walks of each operation, they are
+	// replaced on reload
+	limitsMu   sync.RWMutex
+	limiters   map[string]*limiter
+	usageCache *usageCache
 }
 
 // NewSnapshotter creates a new snapshotter instance
@@ -65,23 +140,60 @@ func NewSnapshotter(ctx context.Context, opts ...Opt) (snapshots.Snapshotter, er
 			return nil, errors.Wrapf(err, "failed to create directory: %s", dir)
 		}
 	}
+	// Earlier releases created the block device node of quotas among the
+	// snapshots, where it shows in the mounts of snapshots without parent
+	if err := os.Remove(filepath.Join(snapshotsDir, backingFsBlockDev)); err != nil && !os.IsNotExist(err) {
+		return nil, errors.Wrap(err, "failed to remove block device node from snapshots directory")
+	}
+
+	lockTimeout := config.lockTimeout
+	if lockTimeout == 0 {
+		lockTimeout = metadata.DefaultLockTimeout
+	}
+	if err := prepareMetadata(ctx, config.root, lockTimeout); err != nil {
+		return nil, err
+	}
 
-	ms, err := storage.NewMetaStore(filepath.Join(config.root, "metadata.db"))
+	ms, err := openMetaStore(ctx, metadata.Path(config.root), lockTimeout)
 	if err != nil {
-		return nil, errors.Wrap(err, "failed to create metadata store")
+		return nil, err
 	}
 
-	return &snapshotter{
-		root: config.root,
-		ms:   ms,
-	}, nil
+	o := &snapshotter{
+		root:         config.root,
+		rootless:     config.rootless,
+		layerUsage:   config.layerUsage,
+		contentStore: config.contentStore,
+		ms:           ms,
+
+		identitySources: config.identitySources,
+		auditLog:        config.auditLog,
+		mountType:       config.resolvedMountType(),
+		mountSource:     config.resolvedMountSource(),
+		volumeEncoder:   config.resolvedVolumeEncoder(),
+		locks:           newKeyLocker(),
+		limiters:        newLimiters(config),
+		usageCache:      newUsageCache(config.usageCacheTTL),
+	}
+	o.defaultQuota.Store(config.defaultQuota)
+
+	if config.metrics != nil {
+		if err := o.registerMetrics(config.metrics); err != nil {
+			ms.Close()
+			return nil, err
+		}
+	}
+
+	o.initQuota(ctx)
+
+	return o, nil
 }
 
 func (o *snapshotter) Close() error {
 	return o.ms.Close()
 }
 
-func (o *snapshotter) Prepare(ctx context.Context, key, parent string, opts ...snapshots.Opt) ([]mount.Mount, error) {
+func (o *snapshotter) Prepare(ctx context.Context, key, parent string, opts ...snapshots.Opt) (_ []mount.Mount, err error) {
 	log.G(ctx).Debugf("Prepare snapshot with key %s, parent %s, opts %v", key, parent, opts)
 
 	var base snapshots.Info
@@ -91,37 +203,129 @@ func (o *snapshotter) Prepare(ctx context.Context, key, parent string, opts ...s
 		}
 	}
 
+	var mounts []mount.Mount
+	defer func() { o.auditDecision(ctx, audit.OperationPrepare, key, parent, base.Labels, mounts, err) }()
+
+	// The key of a layer is locked by the commit, which can outlive the call
+	if target, ok := base.Labels[targetSnapshotLabel]; ok {
+		return nil, o.prepareTarget(ctx, target, key, parent, opts)
+	}
+
+	defer o.locks.lock(key)()
+
 	info, s, err := o.createSnapshot(ctx, snapshots.KindActive, key, parent, opts)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to create snapshot")
 	}
 
-	if info.Labels == nil {
-		info.Labels = make(map[string]string)
+	if !IsGuestPullMode(info.Labels) {
+		mounts, err = o.mountGuestPull(ctx, s, "", false, info.Labels)
+		return mounts, err
 	}
 
-	if target, ok := info.Labels[targetSnapshotLabel]; ok {
-		info.Labels[guestPullLabel] = "true"
+	pID, _, _, pErr := o.getSnapshotInfo(ctx, key)
+	if pErr != nil {
+		return nil, errors.Wrapf(pErr, "failed to get parent snapshot info, parent key=%q", parent)
+	}
+	mounts, err = o.mountGuestPull(ctx, s, pID, true, info.Labels)
+	return mounts, err
+}
 
-		err := o.Commit(ctx, target, key, append(opts, snapshots.WithLabels(info.Labels))...)
-		if err == nil || errdefs.IsAlreadyExists(err) {
-			return nil, errors.Wrapf(errdefs.ErrAlreadyExists, "target snapshot %q", target)
+// prepareTarget commits a layer the guest pulls to its target. It returns an
+// error satisfying errdefs.IsAlreadyExists once the target is committed, and
+// any other error with an errdefs type after removing the active snapshot.
+// Concurrent calls for the same target, as made when several pods of an image
+// start at once, are coalesced: the callers that arrive while a call is in
+// flight wait for it and get its result without creating a snapshot of their
+// own.
+func (o *snapshotter) prepareTarget(ctx context.Context, target, key, parent string, opts []snapshots.Opt) error {
+	// The shared call outlives the caller that started it, so that a caller
+	// giving up doesn't fail the others
+	sharedCtx := context.WithoutCancel(ctx)
+	ch := o.targets.DoChan(target, func() (interface{}, error) {
+		// The key stays locked until its snapshot is committed or removed,
+		// even once the caller gave up
+		defer o.locks.lock(key)()
+		return nil, o.commitTarget(sharedCtx, target, key, parent, opts)
+	})
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case res := <-ch:
+		if res.Shared {
+			log.G(ctx).WithField("target", target).Debugf("coalesced prepare of %s", key)
 		}
-		return nil, nil
+		return res.Err
 	}
+}
 
-	if !IsGuestPullMode(info.Labels) {
-		return o.mountGuestPull(ctx, s, "", false)
+// commitTarget creates the active snapshot key of a guest pulled layer and
+// commits it to target
+func (o *snapshotter) commitTarget(ctx context.Context, target, key, parent string, opts []snapshots.Opt) error {
+	if _, _, _, err := o.getSnapshotInfo(ctx, target); err == nil {
+		return errors.Wrapf(errdefs.ErrAlreadyExists, "target snapshot %q", target)
 	}
 
-	pID, _, _, pErr := o.getSnapshotInfo(ctx, key)
-	if pErr != nil {
-		return nil, errors.Wrapf(pErr, "failed to get parent snapshot info, parent key=%q", parent)
+	info, s, err := o.createSnapshot(ctx, snapshots.KindActive, key, parent, opts)
+	if err != nil {
+		return typedError(errors.Wrap(err, "failed to create snapshot"))
+	}
+
+	info.Labels[guestPullLabel] = "true"
+	for k, v := range o.layerSizeLabels(ctx, info.Labels) {
+		info.Labels[k] = v
+	}
+	if len(o.identitySources) > 0 && isTopLayer(info.Labels) {
+		if err := o.writeIdentityStub(ctx, s.ID, info.Labels); err != nil {
+			log.G(ctx).WithError(err).Warn("failed to place identity stub, user names of the image can't be resolved")
+		}
+	}
+
+	// The active snapshot is removed when the commit fails, including when
+	// the target was committed by another caller in the meantime
+	if err := o.commit(ctx, target, key, append(opts, snapshots.WithLabels(info.Labels))...); err != nil {
+		if rerr := o.rollbackActive(context.WithoutCancel(ctx), key); rerr != nil {
+			log.G(ctx).WithError(rerr).Errorf("failed to roll back active snapshot %s", key)
+			// Whatever the commit error, the active snapshot is left behind
+			return errors.Wrapf(errdefs.ErrInternal, "failed to commit target snapshot %q: %v, and to roll back %s: %v",
+				target, err, key, rerr)
+		}
+		if !errdefs.IsAlreadyExists(err) {
+			return typedError(errors.Wrapf(err, "failed to commit target snapshot %q", target))
+		}
+	}
+
+	return errors.Wrapf(errdefs.ErrAlreadyExists, "target snapshot %q", target)
+}
+
+// rollbackActive removes the active snapshot key and its directory
+func (o *snapshotter) rollbackActive(ctx context.Context, key string) error {
+	var id string
+	err := o.withTransaction(ctx, true, func(ctx context.Context) error {
+		var err error
+		id, _, err = removeSnapshot(ctx, key)
+		return errors.Wrap(err, "failed to remove snapshot")
+	})
+	if err != nil {
+		return err
 	}
-	return o.mountGuestPull(ctx, s, pID, true)
+	return o.cleanupSnapshotDirectory(filepath.Join(o.root, "snapshots", id))
 }
 
-func (o *snapshotter) withTransaction(ctx context.Context, writable bool, fn func(ctx context.Context) error) error {
+// typedError returns err with an errdefs type, errors without one, such as
+// those of the metadata store, are internal
+func typedError(err error) error {
+	if errdefs.Resolve(err) != errdefs.ErrUnknown {
+		return err
+	}
+	return fmt.Errorf("%w: %w", errdefs.ErrInternal, err)
+}
+
+func (o *snapshotter) withTransaction(ctx context.Context, writable bool, fn func(ctx context.Context) error) (err error) {
+	ctx, span := tracer.Start(ctx, "snapshot.transaction", trace.WithAttributes(attribute.Bool("writable", writable)))
+	defer func() { endSpan(span, err) }()
+
 	ctx, t, err := o.ms.TransactionContext(ctx, writable)
 	if err != nil {
 		return errors.Wrap(err, "failed to start transaction")
@@ -157,18 +361,32 @@ func (o *snapshotter) withTransaction(ctx context.Context, writable bool, fn fun
 func (o *snapshotter) Commit(ctx context.Context, name, key string, opts ...snapshots.Opt) error {
 	log.G(ctx).Debugf("Commit snapshot with key %s to %s", key, name)
 
+	defer o.locks.lock(key)()
+	return o.commit(ctx, name, key, opts...)
+}
+
+func (o *snapshotter) commit(ctx context.Context, name, key string, opts ...snapshots.Opt) error {
+	// The slot is taken before the write transaction, which would otherwise
+	// hold up all writers while queued
+	release, err := o.limiter(OperationCommit).acquire(ctx)
+	if err != nil {
+		return errors.Wrap(err, "failed to wait for a commit slot")
+	}
+	defer release()
+
 	return o.withTransaction(ctx, true, func(ctx context.Context) error {
 		id, _, _, err := storage.GetInfo(ctx, key)
 		if err != nil {
 			return errors.Wrap(err, "failed to get snapshot info")
 		}
+		o.usageCache.forget(id)
 
-		du, err := fs.DiskUsage(ctx, o.upperPath(id))
+		usage, err := o.diskUsage(ctx, id)
 		if err != nil {
-			return errors.Wrap(err, "failed to calculate disk usage")
+			return err
 		}
 
-		if _, err = storage.CommitActive(ctx, key, name, snapshots.Usage(du), opts...); err != nil {
+		if _, err = commitActive(ctx, key, name, usage, opts...); err != nil {
 			return errors.Wrapf(err, "commit active snapshot %s", key)
 		}
 
@@ -176,10 +394,15 @@ func (o *snapshotter) Commit(ctx context.Context, name, key string, opts ...snap
 	})
 }
 
-func (o *snapshotter) Mounts(ctx context.Context, key string) ([]mount.Mount, error) {
+func (o *snapshotter) Mounts(ctx context.Context, key string) (mounts []mount.Mount, err error) {
 	log.G(ctx).Debugf("Mounts for snapshot %s", key)
 
-	id, info, _, err := o.getSnapshotInfo(ctx, key)
+	defer o.locks.lock(key)()
+
+	var info snapshots.Info
+	defer func() { o.auditDecision(ctx, audit.OperationMounts, key, info.Parent, info.Labels, mounts, err) }()
+
+	_, info, _, err = o.getSnapshotInfo(ctx, key)
 	if err != nil {
 		return nil, errors.Wrapf(err, "failed to get snapshot info for %q", key)
 	}
@@ -190,15 +413,13 @@ func (o *snapshotter) Mounts(ctx context.Context, key string) ([]mount.Mount, er
 	}
 
 	if !IsGuestPullMode(info.Labels) {
-		return o.mountGuestPull(ctx, *snap, "", false)
+		return o.mountGuestPull(ctx, *snap, "", false, info.Labels)
 	}
 
 	var snapshotID string
 
 	switch info.Kind {
-	case snapshots.KindView:
-		snapshotID = id
-	case snapshots.KindActive:
+	case snapshots.KindView, snapshots.KindActive:
 		if info.Parent != "" {
 			pID, _, _, err := o.getSnapshotInfo(ctx, info.Parent)
 			if err != nil {
@@ -208,17 +429,77 @@ func (o *snapshotter) Mounts(ctx context.Context, key string) ([]mount.Mount, er
 		}
 	}
 
-	return o.mountGuestPull(ctx, *snap, snapshotID, true)
+	return o.mountGuestPull(ctx, *snap, snapshotID, true, info.Labels)
 
 }
 
 func (o *snapshotter) Remove(ctx context.Context, key string) error {
 	log.G(ctx).Debugf("Remove snapshot %s", key)
 
-	return o.withTransaction(ctx, true, func(ctx context.Context) error {
-		_, _, err := storage.Remove(ctx, key)
-		return errors.Wrap(err, "failed to remove snapshot")
+	defer o.locks.lock(key)()
+
+	// The labels of the snapshot are gone once it is removed
+	var info snapshots.Info
+	if o.auditLog != nil {
+		_, info, _, _ = o.getSnapshotInfo(ctx, key)
+	}
+
+	var id string
+	err := o.withTransaction(ctx, true, func(ctx context.Context) error {
+		var err error
+		id, _, err = removeSnapshot(ctx, key)
+		if err != nil {
+			return errors.Wrap(err, "failed to remove snapshot")
+		}
+		o.usageCache.forget(id)
+		return nil
 	})
+	o.auditDecision(ctx, audit.OperationRemove, key, info.Parent, info.Labels, nil, err)
+	if err != nil {
+		return err
+	}
+
+	// A directory that can't be removed now is removed by Cleanup
+	if err := o.cleanupSnapshotDirectory(filepath.Join(o.root, "snapshots", id)); err != nil {
+		log.G(ctx).WithError(err).WithField("key", key).Warn("failed to remove snapshot directory")
+	}
+	return nil
+}
+
+// Cleanup removes the snapshot directories without snapshot in the metadata
+// store, left behind by removals that failed or were interrupted
+func (o *snapshotter) Cleanup(ctx context.Context) error {
+	log.G(ctx).Debug("Cleanup snapshot directories")
+
+	snapshotDir := filepath.Join(o.root, "snapshots")
+	var dirs []string
+	// The write transaction keeps snapshots from being created meanwhile
+	err := o.withTransaction(ctx, true, func(ctx context.Context) error {
+		ids, err := storage.IDMap(ctx)
+		if err != nil {
+			return errors.Wrap(err, "failed to list snapshot ids")
+		}
+		entries, err := os.ReadDir(snapshotDir)
+		if err != nil {
+			return errors.Wrap(err, "failed to read snapshots directory")
+		}
+		for _, e := range entries {
+			if _, ok := ids[e.Name()]; !ok {
+				dirs = append(dirs, filepath.Join(snapshotDir, e.Name()))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, dir := range dirs {
+		if err := o.cleanupSnapshotDirectory(dir); err != nil {
+			log.G(ctx).WithError(err).WithField("path", dir).Warn("failed to remove orphaned snapshot directory")
+		}
+	}
+	return nil
 }
 
 func (o *snapshotter) Stat(ctx context.Context, key string) (snapshots.Info, error) {
@@ -257,30 +538,51 @@ func (o *snapshotter) Usage(ctx context.Context, key string) (snapshots.Usage, e
 	}
 
 	if info.Kind == snapshots.KindActive {
-		du, err := fs.DiskUsage(ctx, o.upperPath(id))
+		if qu, ok, err := o.quotaUsage(o.upperPath(id)); err != nil {
+			return snapshots.Usage{}, errors.Wrap(err, "failed to get quota usage")
+		} else if ok {
+			return qu, nil
+		}
+
+		usage, err = o.activeUsage(ctx, id)
 		if err != nil {
-			return snapshots.Usage{}, errors.Wrap(err, "failed to calculate disk usage")
+			return snapshots.Usage{}, err
 		}
-		usage = snapshots.Usage(du)
+	}
+
+	if lu, ok := o.guestPullLayerUsage(info, usage); ok {
+		return lu, nil
 	}
 
 	return usage, nil
 }
 
-func (o *snapshotter) View(ctx context.Context, key, parent string, opts ...snapshots.Opt) ([]mount.Mount, error) {
+func (o *snapshotter) View(ctx context.Context, key, parent string, opts ...snapshots.Opt) (mounts []mount.Mount, err error) {
 	log.G(ctx).Debugf("View snapshot with key %s, parent %s", key, parent)
 
-	pID, _, _, err := o.getSnapshotInfo(ctx, parent)
+	defer o.locks.lock(key)()
+
+	var labels map[string]string
+	defer func() { o.auditDecision(ctx, audit.OperationView, key, parent, labels, mounts, err) }()
+
+	pID, pInfo, _, err := o.getSnapshotInfo(ctx, parent)
 	if err != nil {
 		return nil, errors.Wrapf(err, "get snapshot %s info", parent)
 	}
 
-	_, s, err := o.createSnapshot(ctx, snapshots.KindView, key, parent, opts)
+	// A view of a guest pulled image is an image volume, which the guest
+	// pulls and mounts read-only instead of the host
+	if IsGuestPullMode(pInfo.Labels) {
+		opts = append(opts, snapshots.WithLabels(imageVolumeLabels(pInfo.Labels)))
+	}
+
+	info, s, err := o.createSnapshot(ctx, snapshots.KindView, key, parent, opts)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to create view snapshot")
 	}
+	labels = info.Labels
 
-	return o.mountGuestPull(ctx, s, pID, true)
+	return o.mountGuestPull(ctx, s, pID, true, info.Labels)
 }
 
 func (o *snapshotter) createSnapshot(ctx context.Context, kind snapshots.Kind, key, parent string, opts []snapshots.Opt) (info *snapshots.Info, _ storage.Snapshot, err error) {
@@ -301,7 +603,23 @@ func (o *snapshotter) createSnapshot(ctx context.Context, kind snapshots.Kind, k
 		base.Labels = map[string]string{}
 	}
 
-	err = o.withTransaction(ctx, true, func(ctx context.Context) error {
+	// Layers the guest pulls never hold data on the host, their snapshots are
+	// only recorded and get directories when a consumer on the host needs them
+	if _, ok := base.Labels[targetSnapshotLabel]; ok && kind == snapshots.KindActive {
+		err = o.withTransaction(ctx, true, func(ctx context.Context) (err error) {
+			s, err = createSnapshotRecord(ctx, kind, key, parent, opts...)
+			return errors.Wrap(err, "failed to create snapshot in metadata store")
+		})
+		if err != nil {
+			return &base, storage.Snapshot{}, err
+		}
+		return &base, s, nil
+	}
+
+	err = o.withTransaction(ctx, true, func(ctx context.Context) (err error) {
+		ctx, span := tracer.Start(ctx, "snapshot.setup_directory")
+		defer func() { endSpan(span, err) }()
+
 		snapshotDir := filepath.Join(o.root, "snapshots")
 		td, err = o.prepareDirectory(snapshotDir, kind)
 		if err != nil {
@@ -316,12 +634,12 @@ func (o *snapshotter) createSnapshot(ctx context.Context, kind snapshots.Kind, k
 			}
 		}()
 
-		s, err = storage.CreateSnapshot(ctx, kind, key, parent, opts...)
+		s, err = createSnapshotRecord(ctx, kind, key, parent, opts...)
 		if err != nil {
 			return errors.Wrap(err, "failed to create snapshot in metadata store")
 		}
 
-		if err := o.setupSnapshotDirectory(td, s); err != nil {
+		if err := o.setupSnapshotDirectory(ctx, td, s, base.Labels); err != nil {
 			return errors.Wrap(err, "failed to setup snapshot directory")
 		}
 
@@ -334,10 +652,12 @@ func (o *snapshotter) createSnapshot(ctx context.Context, kind snapshots.Kind, k
 		return nil
 	})
 
-	if err != nil && path != "" {
-		if err1 := o.cleanupSnapshotDirectory(path); err1 != nil {
-			log.G(ctx).WithError(err1).WithField("path", path).Error("failed to reclaim snapshot directory")
-			err = fmt.Errorf("failed to remove path: %v: %w", err1, err)
+	if err != nil {
+		if path != "" {
+			if err1 := o.cleanupSnapshotDirectory(path); err1 != nil {
+				log.G(ctx).WithError(err1).WithField("path", path).Error("failed to reclaim snapshot directory")
+				err = fmt.Errorf("failed to remove path: %v: %w", err1, err)
+			}
 		}
 		return &base, storage.Snapshot{}, err
 	}
@@ -345,20 +665,48 @@ func (o *snapshotter) createSnapshot(ctx context.Context, kind snapshots.Kind, k
 	return &base, s, nil
 }
 
-func (o *snapshotter) setupSnapshotDirectory(td string, s storage.Snapshot) error {
-	if len(s.ParentIDs) > 0 {
+func (o *snapshotter) setupSnapshotDirectory(ctx context.Context, td string, s storage.Snapshot, labels map[string]string) error {
+	size, err := o.quotaSize(s.Kind, labels)
+	if err != nil {
+		return err
+	}
+	if size > 0 {
+		if err := o.setQuota(ctx, filepath.Join(td, "fs"), size); err != nil {
+			return err
+		}
+	}
+
+	uid, gid, err := mappedOwner(labels)
+	if err != nil {
+		return err
+	}
+
+	// The ids that are not mapped are inherited from the parent. A parent
+	// only recorded in the metadata store would be owned by the snapshotter,
+	// as the new directory already is.
+	if (uid == -1 || gid == -1) && len(s.ParentIDs) > 0 {
 		st, err := os.Stat(o.upperPath(s.ParentIDs[0]))
-		if err != nil {
-			if !os.IsNotExist(err) {
-				return errors.Wrap(err, "failed to stat parent")
+		if err != nil && !os.IsNotExist(err) {
+			return errors.Wrap(err, "failed to stat parent")
+		}
+
+		if err == nil {
+			stat := st.Sys().(*syscall.Stat_t)
+			if uid == -1 {
+				uid = int(stat.Uid)
+			}
+			if gid == -1 {
+				gid = int(stat.Gid)
 			}
-			return os.MkdirAll(o.upperPath(s.ParentIDs[0]), 0755)
 		}
+	}
 
-		stat := st.Sys().(*syscall.Stat_t)
-		return os.Lchown(filepath.Join(td, "fs"), int(stat.Uid), int(stat.Gid))
+	if o.rootless || (uid == -1 && gid == -1) {
+		return nil
 	}
-	return nil
+
+	// Lchown leaves an id of -1 unchanged
+	return os.Lchown(filepath.Join(td, "fs"), uid, gid)
 }
 
 func (o *snapshotter) prepareDirectory(snapshotDir string, kind snapshots.Kind) (string, error) {
@@ -380,7 +728,12 @@ func (o *snapshotter) prepareDirectory(snapshotDir string, kind snapshots.Kind)
 	return td, nil
 }
 
+// cleanupSnapshotDirectory removes the directory of a snapshot, releasing
+// the quota of its upper directory first
 func (o *snapshotter) cleanupSnapshotDirectory(dir string) error {
+	if err := o.releaseQuota(filepath.Join(dir, "fs")); err != nil {
+		return errors.Wrapf(err, "failed to release quota of %q", dir)
+	}
 	return errors.Wrapf(os.RemoveAll(dir), "failed to remove directory %q", dir)
 }
 
@@ -408,7 +761,7 @@ func (o *snapshotter) getSnapshot(ctx context.Context, key string) (*storage.Sna
 	return &snapshot, nil
 }
 
-func (o *snapshotter) mountGuestPull(ctx context.Context, s storage.Snapshot, id string, flag bool) ([]mount.Mount, error) {
+func (o *snapshotter) mountGuestPull(ctx context.Context, s storage.Snapshot, id string, flag bool, labels map[string]string) ([]mount.Mount, error) {
 	var overlayOptions []string
 
 	if s.Kind == snapshots.KindActive {
@@ -418,24 +771,42 @@ func (o *snapshotter) mountGuestPull(ctx context.Context, s storage.Snapshot, id
 		)
 	}
 
-	var lowerPaths []string
-	if flag && s.Kind == snapshots.KindView {
-		if lowerPath, err := o.lowerPath(id); err == nil {
-			lowerPaths = append(lowerPaths, lowerPath)
-		} else {
-			log.L.WithError(err).Warnf("failed to get lower path for %s", id)
-		}
-	} else if len(s.ParentIDs) == 0 {
-		lowerPaths = append(lowerPaths, filepath.Join(o.root, "snapshots"))
+	if isImageVolume(s.Kind, labels) {
+		overlayOptions = append(overlayOptions, "ro")
+	}
+
+	var lowerIDs []string
+	if flag && s.Kind == snapshots.KindView && id != "" {
+		lowerIDs = []string{id}
 	} else {
-		for _, id := range s.ParentIDs {
-			lowerPaths = append(lowerPaths, o.upperPath(id))
+		lowerIDs = s.ParentIDs
+	}
+
+	// Guest pulled layers are only recorded in the metadata store. The mount
+	// helper creates their directories when it mounts on the host, while the
+	// kernel mounts other types right away.
+	if MountHelper(o.mountType) == "" {
+		for _, id := range lowerIDs {
+			if _, err := o.ensureUpperPath(id); err != nil {
+				return nil, err
+			}
 		}
 	}
-	
+
+	var lowerPaths []string
+	if len(lowerIDs) == 0 {
+		lowerPaths = append(lowerPaths, filepath.Join(o.root, "snapshots"))
+	}
+	for _, id := range lowerIDs {
+		lowerPaths = append(lowerPaths, o.lowerPath(id))
+	}
+
 	overlayOptions = append(overlayOptions, fmt.Sprintf("lowerdir=%s", strings.Join(lowerPaths, ":")))
 
-	guestOptions, err := guestpull.PrepareGuestPullMounts(ctx, "", overlayOptions, map[string]string{})
+	ctx, span := tracer.Start(ctx, "snapshot.encode_volume", trace.WithAttributes(attribute.String("id", s.ID)))
+	source, metadata := guestPullVolume(ctx, s.Kind, labels)
+	guestOptions, err := o.volumeEncoder.Encode(ctx, guestpull.NewGuestPullVolume(source, overlayOptions, metadata))
+	endSpan(span, err)
 	if err != nil {
 		return nil, errors.Wrapf(err, "failed to prepare guest pull mounts for snapshot %s", s.ID)
 	}
@@ -446,8 +817,8 @@ func (o *snapshotter) mountGuestPull(ctx context.Context, s storage.Snapshot, id
 
 	return []mount.Mount{
 		{
-			Type:    "fuse.guest-pull-overlayfs",
-			Source:  "overlay",
+			Type:    o.mountType,
+			Source:  o.mountSource,
 			Options: overlayOptions,
 		},
 	}, nil
@@ -457,12 +828,67 @@ func (o *snapshotter) upperPath(id string) string {
 	return filepath.Join(o.root, "snapshots", id, "fs")
 }
 
+// ensureUpperPath returns the upper directory of snapshot id, creating the
+// directories of snapshots that were only recorded in the metadata store
+func (o *snapshotter) ensureUpperPath(id string) (string, error) {
+	upperPath := o.upperPath(id)
+	for _, dir := range []struct {
+		path string
+		perm os.FileMode
+	}{
+		{filepath.Dir(upperPath), 0700},
+		{upperPath, 0755},
+	} {
+		if err := os.Mkdir(dir.path, dir.perm); err != nil && !os.IsExist(err) {
+			return "", errors.Wrapf(err, "failed to create snapshot directory %s", dir.path)
+		}
+	}
+	return upperPath, nil
+}
+
+// activeUsage returns the disk usage of active snapshot id, from the usage
+// cache if it holds a recent one
+func (o *snapshotter) activeUsage(ctx context.Context, id string) (snapshots.Usage, error) {
+	if usage, ok := o.usageCache.get(id); ok {
+		return usage, nil
+	}
+
+	release, err := o.limiter(OperationUsage).acquire(ctx)
+	if err != nil {
+		return snapshots.Usage{}, errors.Wrap(err, "failed to wait for a usage slot")
+	}
+	defer release()
+
+	usage, err := o.diskUsage(ctx, id)
+	if err != nil {
+		return snapshots.Usage{}, err
+	}
+	o.usageCache.put(id, usage)
+	return usage, nil
+}
+
+// diskUsage returns the disk usage of the upper directory of snapshot id,
+// which is nothing for snapshots without directories
+func (o *snapshotter) diskUsage(ctx context.Context, id string) (_ snapshots.Usage, err error) {
+	ctx, span := tracer.Start(ctx, "snapshot.disk_usage", trace.WithAttributes(attribute.String("id", id)))
+	defer func() { endSpan(span, err) }()
+
+	du, err := fs.DiskUsage(ctx, o.upperPath(id))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return snapshots.Usage{}, nil
+		}
+		return snapshots.Usage{}, errors.Wrap(err, "failed to calculate disk usage")
+	}
+	return snapshots.Usage(du), nil
+}
+
 func (o *snapshotter) workPath(id string) string {
 	return filepath.Join(o.root, "snapshots", id, "work")
 }
 
-func (o *snapshotter) lowerPath(id string) (string, error) {
-	return filepath.Join(o.root, "snapshots", id, "fs"), nil
+func (o *snapshotter) lowerPath(id string) string {
+	return o.upperPath(id)
 }
 
 func IsGuestPullMode(labels map[string]string) bool {
@@ -0,0 +1,411 @@
+package snapshot
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ChengyuZhu6/guest-pull-snapshotter/metadata"
+	"github.com/containerd/containerd/v2/core/snapshots"
+	"github.com/containerd/containerd/v2/core/snapshots/storage"
+	"github.com/containerd/errdefs"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestConcurrentPrepareOfTarget(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+
+	sn, err := NewSnapshotter(ctx, WithRootDirectory(root))
+	require.NoError(t, err)
+	defer sn.Close()
+
+	const callers = 16
+	errs := make([]error, callers)
+	var wg sync.WaitGroup
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = sn.Prepare(ctx, fmt.Sprintf("extract-%d", i), "",
+				snapshots.WithLabels(map[string]string{targetSnapshotLabel: "layer"}))
+		}(i)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		assert.True(t, errdefs.IsAlreadyExists(err), "expected already exists, got %v", err)
+	}
+
+	var names []string
+	require.NoError(t, sn.Walk(ctx, func(_ context.Context, info snapshots.Info) error {
+		names = append(names, info.Name)
+		return nil
+	}))
+	assert.Equal(t, []string{"layer"}, names)
+
+	dirs, err := os.ReadDir(filepath.Join(root, "snapshots"))
+	require.NoError(t, err)
+	assert.Empty(t, dirs)
+}
+
+func TestPrepareTargetCallerCanceled(t *testing.T) {
+	ctx := context.Background()
+	started, release := make(chan struct{}, 1), make(chan struct{})
+	commitActive = func(ctx context.Context, key, name string, usage snapshots.Usage, opts ...snapshots.Opt) (string, error) {
+		started <- struct{}{}
+		<-release
+		// Steps such as reading the content store end with the context
+		if err := ctx.Err(); err != nil {
+			return "", err
+		}
+		return storage.CommitActive(ctx, key, name, usage, opts...)
+	}
+	defer func() { commitActive = storage.CommitActive }()
+
+	sn, err := NewSnapshotter(ctx, WithRootDirectory(t.TempDir()))
+	require.NoError(t, err)
+	defer sn.Close()
+	labels := snapshots.WithLabels(map[string]string{targetSnapshotLabel: "layer"})
+
+	firstCtx, cancel := context.WithCancel(ctx)
+	first := make(chan error, 1)
+	go func() {
+		_, err := sn.Prepare(firstCtx, "extract-1", "", labels)
+		first <- err
+	}()
+	<-started
+
+	second := make(chan error, 1)
+	go func() {
+		_, err := sn.Prepare(ctx, "extract-2", "", labels)
+		second <- err
+	}()
+
+	// The caller that started the commit gives up, the other one still gets
+	// the committed target
+	cancel()
+	assert.ErrorIs(t, <-first, context.Canceled)
+	close(release)
+	err = <-second
+	assert.True(t, errdefs.IsAlreadyExists(err), "expected already exists, got %v", err)
+
+	info, err := sn.Stat(ctx, "layer")
+	require.NoError(t, err)
+	assert.Equal(t, snapshots.KindCommitted, info.Kind)
+}
+
+func TestPrepareTargetCanceledKeyLocked(t *testing.T) {
+	ctx := context.Background()
+	started, release := make(chan struct{}, 1), make(chan struct{})
+	commitActive = func(ctx context.Context, key, name string, usage snapshots.Usage, opts ...snapshots.Opt) (string, error) {
+		started <- struct{}{}
+		<-release
+		return storage.CommitActive(ctx, key, name, usage, opts...)
+	}
+	defer func() { commitActive = storage.CommitActive }()
+
+	sn, err := NewSnapshotter(ctx, WithRootDirectory(t.TempDir()))
+	require.NoError(t, err)
+	defer sn.Close()
+
+	firstCtx, cancel := context.WithCancel(ctx)
+	first := make(chan error, 1)
+	go func() {
+		_, err := sn.Prepare(firstCtx, "extract", "", snapshots.WithLabels(map[string]string{targetSnapshotLabel: "layer"}))
+		first <- err
+	}()
+	<-started
+	cancel()
+	assert.ErrorIs(t, <-first, context.Canceled)
+
+	// The commit still running in the background holds the key
+	removed := make(chan error, 1)
+	go func() { removed <- sn.Remove(ctx, "extract") }()
+	select {
+	case err := <-removed:
+		t.Fatalf("key removed while its commit runs: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(release)
+	err = <-removed
+	assert.True(t, errdefs.IsNotFound(err), "expected not found, got %v", err)
+	info, err := sn.Stat(ctx, "layer")
+	require.NoError(t, err)
+	assert.Equal(t, snapshots.KindCommitted, info.Kind)
+}
+
+func TestPrepareTargetFailures(t *testing.T) {
+	errBolt := errors.New("simulated bolt failure")
+	failCreate := func(context.Context, snapshots.Kind, string, string, ...snapshots.Opt) (storage.Snapshot, error) {
+		return storage.Snapshot{}, errBolt
+	}
+	failCommit := func(err error) func(context.Context, string, string, snapshots.Usage, ...snapshots.Opt) (string, error) {
+		return func(context.Context, string, string, snapshots.Usage, ...snapshots.Opt) (string, error) {
+			return "", err
+		}
+	}
+	failRemove := func(context.Context, string) (string, snapshots.Kind, error) {
+		return "", snapshots.KindUnknown, errBolt
+	}
+
+	testCases := []struct {
+		name   string
+		parent string
+		create func(context.Context, snapshots.Kind, string, string, ...snapshots.Opt) (storage.Snapshot, error)
+		commit func(context.Context, string, string, snapshots.Usage, ...snapshots.Opt) (string, error)
+		remove func(context.Context, string) (string, snapshots.Kind, error)
+		// check the error of Prepare
+		check func(error) bool
+		// whether the active snapshot is left behind
+		leaked bool
+	}{
+		{
+			name:  "committed",
+			check: errdefs.IsAlreadyExists,
+		},
+		{
+			name:   "missing parent",
+			parent: "missing",
+			check:  errdefs.IsNotFound,
+		},
+		{
+			name:   "create fails",
+			create: failCreate,
+			check:  errdefs.IsInternal,
+		},
+		{
+			name:   "commit fails",
+			commit: failCommit(errBolt),
+			check:  errdefs.IsInternal,
+		},
+		{
+			name:   "target committed concurrently",
+			commit: failCommit(errdefs.ErrAlreadyExists),
+			check:  errdefs.IsAlreadyExists,
+		},
+		{
+			name:   "commit and rollback fail",
+			commit: failCommit(errBolt),
+			remove: failRemove,
+			check:  errdefs.IsInternal,
+			leaked: true,
+		},
+		{
+			name:   "target committed concurrently and rollback fails",
+			commit: failCommit(errdefs.ErrAlreadyExists),
+			remove: failRemove,
+			check: func(err error) bool {
+				return errdefs.IsInternal(err) && !errdefs.IsAlreadyExists(err)
+			},
+			leaked: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			root := t.TempDir()
+
+			if tc.create != nil {
+				createSnapshotRecord = tc.create
+			}
+			if tc.commit != nil {
+				commitActive = tc.commit
+			}
+			if tc.remove != nil {
+				removeSnapshot = tc.remove
+			}
+			defer func() {
+				createSnapshotRecord = storage.CreateSnapshot
+				commitActive = storage.CommitActive
+				removeSnapshot = storage.Remove
+			}()
+
+			sn, err := NewSnapshotter(ctx, WithRootDirectory(root))
+			require.NoError(t, err)
+			defer sn.Close()
+
+			mounts, err := sn.Prepare(ctx, "extract", tc.parent,
+				snapshots.WithLabels(map[string]string{targetSnapshotLabel: "layer"}))
+			require.Error(t, err)
+			assert.Nil(t, mounts)
+			assert.True(t, tc.check(err), "unexpected error %v", err)
+
+			_, err = sn.Stat(ctx, "extract")
+			if tc.leaked {
+				assert.NoError(t, err)
+				return
+			}
+			assert.True(t, errdefs.IsNotFound(err), "active snapshot left behind: %v", err)
+
+			var kinds []snapshots.Kind
+			// Walk fails on a store that never held a snapshot
+			err = sn.Walk(ctx, func(_ context.Context, info snapshots.Info) error {
+				kinds = append(kinds, info.Kind)
+				return nil
+			})
+			if !errdefs.IsNotFound(err) {
+				require.NoError(t, err)
+			}
+			dirs, err := os.ReadDir(filepath.Join(root, "snapshots"))
+			require.NoError(t, err)
+			assert.Empty(t, dirs)
+			for _, kind := range kinds {
+				assert.Equal(t, snapshots.KindCommitted, kind)
+			}
+		})
+	}
+}
+
+func TestPlaceholderDirectories(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+
+	sn, err := NewSnapshotter(ctx, WithRootDirectory(root))
+	require.NoError(t, err)
+	defer sn.Close()
+
+	_, err = sn.Prepare(ctx, "extract", "", snapshots.WithLabels(map[string]string{targetSnapshotLabel: "layer"}))
+	require.True(t, errdefs.IsAlreadyExists(err))
+
+	usage, err := sn.Usage(ctx, "layer")
+	require.NoError(t, err)
+	assert.Equal(t, snapshots.Usage{}, usage)
+
+	dirs, err := os.ReadDir(filepath.Join(root, "snapshots"))
+	require.NoError(t, err)
+	assert.Empty(t, dirs, "placeholder snapshot has directories")
+
+	// Containers leave them to the mount helper, which only runs on the host
+	mounts, err := sn.Prepare(ctx, "container", "layer")
+	require.NoError(t, err)
+	require.Len(t, mounts, 1)
+	_, err = sn.Mounts(ctx, "container")
+	require.NoError(t, err)
+
+	id, _, _, err := sn.(*snapshotter).getSnapshotInfo(ctx, "layer")
+	require.NoError(t, err)
+	assert.NoDirExists(t, sn.(*snapshotter).upperPath(id))
+	assert.Contains(t, mounts[0].Options, "lowerdir="+sn.(*snapshotter).upperPath(id))
+
+	// The kernel mounts other types, so they get the directories right away
+	sn.(*snapshotter).mountType = "overlay"
+	_, err = sn.Prepare(ctx, "overlay-container", "layer")
+	require.NoError(t, err)
+	assert.DirExists(t, sn.(*snapshotter).upperPath(id))
+}
+
+func TestRemoveAndCleanup(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	sn, err := NewSnapshotter(ctx, WithRootDirectory(root))
+	require.NoError(t, err)
+	defer sn.Close()
+
+	_, err = sn.Prepare(ctx, "container", "")
+	require.NoError(t, err)
+	id, _, _, err := sn.(*snapshotter).getSnapshotInfo(ctx, "container")
+	require.NoError(t, err)
+	dir := filepath.Join(root, "snapshots", id)
+	require.DirExists(t, dir)
+
+	require.NoError(t, sn.Remove(ctx, "container"))
+	assert.NoDirExists(t, dir)
+
+	// Directories without snapshot are removed by Cleanup
+	_, err = sn.Prepare(ctx, "kept", "")
+	require.NoError(t, err)
+	orphan := filepath.Join(root, "snapshots", "orphan")
+	require.NoError(t, os.MkdirAll(filepath.Join(orphan, "fs"), 0755))
+	require.NoError(t, sn.(snapshots.Cleaner).Cleanup(ctx))
+	assert.NoDirExists(t, orphan)
+	keptID, _, _, err := sn.(*snapshotter).getSnapshotInfo(ctx, "kept")
+	require.NoError(t, err)
+	assert.DirExists(t, filepath.Join(root, "snapshots", keptID))
+}
+
+func TestOpenMetaStoreLocked(t *testing.T) {
+	ctx := context.Background()
+	path := metadata.Path(t.TempDir())
+
+	// Another process takes the store after the check of prepareMetadata
+	db, err := metadata.Open(path, time.Second, false)
+	require.NoError(t, err)
+
+	_, err = openMetaStore(ctx, path, 100*time.Millisecond)
+	assert.True(t, errdefs.IsUnavailable(err), "expected unavailable, got %v", err)
+
+	require.NoError(t, db.Close())
+	ms, err := openMetaStore(ctx, path, time.Second)
+	require.NoError(t, err)
+	assert.NoError(t, ms.Close())
+}
+
+func TestSpans(t *testing.T) {
+	ctx := context.Background()
+
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(tp)
+	t.Cleanup(func() {
+		otel.SetTracerProvider(previous)
+		assert.NoError(t, tp.Shutdown(context.Background()))
+	})
+
+	sn, err := NewSnapshotter(ctx, WithRootDirectory(t.TempDir()))
+	require.NoError(t, err)
+	defer sn.Close()
+
+	_, err = sn.Prepare(ctx, "container", "")
+	require.NoError(t, err)
+	require.NoError(t, sn.Commit(ctx, "committed", "container"))
+
+	names := map[string]bool{}
+	for _, span := range recorder.Ended() {
+		names[span.Name()] = true
+	}
+	for _, name := range []string{"snapshot.transaction", "snapshot.setup_directory", "snapshot.encode_volume", "snapshot.disk_usage"} {
+		assert.True(t, names[name], "missing span %s", name)
+	}
+}
+
+func TestKeyLocker(t *testing.T) {
+	l := newKeyLocker()
+
+	unlock := l.lock("a")
+	locked := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		unlock := l.lock("a")
+		close(locked)
+		unlock()
+		close(done)
+	}()
+
+	// Other keys are not held up
+	l.lock("b")()
+
+	select {
+	case <-locked:
+		t.Fatal("key locked twice")
+	default:
+	}
+
+	unlock()
+	<-done
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	assert.Empty(t, l.locks)
+}
@@ -0,0 +1,19 @@
+package snapshot
+
+import (
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer records the spans of the snapshotter with the global tracer provider
+var tracer = otel.Tracer("github.com/ChengyuZhu6/guest-pull-snapshotter/snapshot")
+
+// endSpan ends span, marking it failed if err isn't nil
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,128 @@
+package snapshot
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/containerd/containerd/v2/core/content"
+	"github.com/containerd/containerd/v2/core/snapshots"
+	snpkg "github.com/containerd/containerd/v2/pkg/snapshotters"
+	"github.com/containerd/log"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// Labels recording the size of a guest pulled layer, in bytes. They are set
+// when the layer is committed, unless the caller provided them.
+const (
+	compressedSizeLabel   = "containerd.io/snapshot/guestpull.compressed-size"
+	uncompressedSizeLabel = "containerd.io/snapshot/guestpull.uncompressed-size"
+)
+
+// estargzUncompressedSizeAnnotation is set on the layer descriptors of
+// eStargz images, the only common source of the uncompressed layer size that
+// doesn't need the layer blob
+const estargzUncompressedSizeAnnotation = "io.containers.estargz.uncompressed-size"
+
+// LayerUsage selects the size Usage reports for guest pulled layers
+type LayerUsage string
+
+const (
+	// LayerUsageHost reports the disk usage on the host, which is nothing for
+	// guest pulled layers
+	LayerUsageHost LayerUsage = "host"
+	// LayerUsageCompressed reports the compressed size of the layer blob
+	LayerUsageCompressed LayerUsage = "compressed"
+	// LayerUsageUncompressed reports the uncompressed size of the layer, or
+	// its compressed size if the former isn't known
+	LayerUsageUncompressed LayerUsage = "uncompressed"
+)
+
+// WithLayerUsage selects the size Usage reports for guest pulled layers, so
+// that the image filesystem stats of the kubelet account for images that
+// live in the guest
+func WithLayerUsage(mode LayerUsage) Opt {
+	return func(config *SnapshotterConfig) {
+		config.layerUsage = mode
+	}
+}
+
+// WithContentStore sets the containerd content store used to look up the
+// size of guest pulled layers in the image manifest
+func WithContentStore(store content.Provider) Opt {
+	return func(config *SnapshotterConfig) {
+		config.contentStore = store
+	}
+}
+
+// layerSizeLabels returns the size labels to record on a guest pulled layer
+// that doesn't carry them yet. Layers whose size can't be resolved get none.
+func (o *snapshotter) layerSizeLabels(ctx context.Context, labels map[string]string) map[string]string {
+	sizeLabels := map[string]string{}
+	if _, ok := labels[compressedSizeLabel]; ok || o.contentStore == nil {
+		return sizeLabels
+	}
+
+	layer, err := o.layerDescriptor(ctx, labels)
+	if err != nil {
+		log.G(ctx).WithError(err).Warn("failed to resolve the size of the guest pulled layer")
+		return sizeLabels
+	}
+
+	sizeLabels[compressedSizeLabel] = strconv.FormatInt(layer.Size, 10)
+	if _, ok := labels[uncompressedSizeLabel]; !ok {
+		if v, ok := layer.Annotations[estargzUncompressedSizeAnnotation]; ok {
+			sizeLabels[uncompressedSizeLabel] = v
+		}
+	}
+	return sizeLabels
+}
+
+// layerDescriptor finds the descriptor of the layer being guest pulled in the
+// manifest of its image
+func (o *snapshotter) layerDescriptor(ctx context.Context, labels map[string]string) (ocispec.Descriptor, error) {
+	manifest, err := readManifest(ctx, o.contentStore, labels)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	layerDigest, err := digest.Parse(labels[snpkg.TargetLayerDigestLabel])
+	if err != nil {
+		return ocispec.Descriptor{}, errors.Wrapf(err, "invalid label %s", snpkg.TargetLayerDigestLabel)
+	}
+
+	for _, layer := range manifest.Layers {
+		if layer.Digest == layerDigest {
+			return layer, nil
+		}
+	}
+	return ocispec.Descriptor{}, errors.Errorf("layer %s not found in manifest %s", layerDigest, labels[snpkg.TargetManifestDigestLabel])
+}
+
+// guestPullLayerUsage returns the usage of a committed guest pulled layer
+// according to the configured mode, and false if the host disk usage applies
+func (o *snapshotter) guestPullLayerUsage(info snapshots.Info, usage snapshots.Usage) (snapshots.Usage, bool) {
+	if info.Kind != snapshots.KindCommitted || !IsGuestPullMode(info.Labels) {
+		return usage, false
+	}
+
+	var keys []string
+	switch o.layerUsage {
+	case LayerUsageCompressed:
+		keys = []string{compressedSizeLabel}
+	case LayerUsageUncompressed:
+		keys = []string{uncompressedSizeLabel, compressedSizeLabel}
+	default:
+		return usage, false
+	}
+
+	for _, key := range keys {
+		if v, ok := info.Labels[key]; ok {
+			if size, err := strconv.ParseInt(v, 10, 64); err == nil && size >= 0 {
+				usage.Size = size
+				return usage, true
+			}
+		}
+	}
+	return usage, false
+}
@@ -0,0 +1,68 @@
+package snapshot
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/containerd/containerd/v2/core/content"
+	"github.com/containerd/containerd/v2/core/snapshots"
+	snpkg "github.com/containerd/containerd/v2/pkg/snapshotters"
+	"github.com/containerd/containerd/v2/plugins/content/local"
+	"github.com/containerd/errdefs"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUsageOfGuestPulledLayer(t *testing.T) {
+	ctx := context.Background()
+
+	store, err := local.NewStore(t.TempDir())
+	require.NoError(t, err)
+
+	plain := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageLayerGzip, Digest: digest.FromString("plain"), Size: 1000}
+	estargz := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageLayerGzip, Digest: digest.FromString("estargz"), Size: 2000,
+		Annotations: map[string]string{estargzUncompressedSizeAnnotation: "5000"}}
+	manifest, err := json.Marshal(ocispec.Manifest{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Layers:    []ocispec.Descriptor{plain, estargz},
+	})
+	require.NoError(t, err)
+	manifestDesc := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest, Digest: digest.FromBytes(manifest), Size: int64(len(manifest))}
+	require.NoError(t, content.WriteBlob(ctx, store, "manifest", bytes.NewReader(manifest), manifestDesc))
+
+	testCases := []struct {
+		name     string
+		mode     LayerUsage
+		layer    ocispec.Descriptor
+		expected int64
+	}{
+		{name: "host", mode: LayerUsageHost, layer: estargz},
+		{name: "compressed", mode: LayerUsageCompressed, layer: estargz, expected: 2000},
+		{name: "uncompressed", mode: LayerUsageUncompressed, layer: estargz, expected: 5000},
+		{name: "uncompressed size unknown", mode: LayerUsageUncompressed, layer: plain, expected: 1000},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			sn, err := NewSnapshotter(ctx, WithRootDirectory(t.TempDir()), WithLayerUsage(tc.mode), WithContentStore(store))
+			require.NoError(t, err)
+			defer sn.Close()
+
+			_, err = sn.Prepare(ctx, "extract-layer", "", snapshots.WithLabels(map[string]string{
+				targetSnapshotLabel:             "layer",
+				snpkg.TargetManifestDigestLabel: manifestDesc.Digest.String(),
+				snpkg.TargetLayerDigestLabel:    tc.layer.Digest.String(),
+			}))
+			require.True(t, errdefs.IsAlreadyExists(err), "expected already exists, got %v", err)
+
+			// In host mode, only the empty upper directory is on the host
+			usage, err := sn.Usage(ctx, "layer")
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, usage.Size)
+		})
+	}
+}
@@ -0,0 +1,76 @@
+package snapshot
+
+import (
+	"context"
+
+	guestpull "github.com/ChengyuZhu6/guest-pull-snapshotter/guest-pull"
+	"github.com/containerd/containerd/v2/core/snapshots"
+	snpkg "github.com/containerd/containerd/v2/pkg/snapshotters"
+	"github.com/containerd/log"
+)
+
+// WithVolumeEncoder sets how the volume describing a snapshot to the guest is
+// passed to the runtime, the Kata virtual volume option by default
+func WithVolumeEncoder(e guestpull.Encoder) Opt {
+	return func(config *SnapshotterConfig) {
+		config.volumeEncoder = e
+	}
+}
+
+// resolvedVolumeEncoder returns the volume encoder
+func (c *SnapshotterConfig) resolvedVolumeEncoder() guestpull.Encoder {
+	if c.volumeEncoder != nil {
+		return c.volumeEncoder
+	}
+	return guestpull.KataEncoder{}
+}
+
+// imageVolumeLabels returns the labels a view inherits from a guest pulled
+// parent, so that it is mounted as an image volume pulled in the guest
+func imageVolumeLabels(parentLabels map[string]string) map[string]string {
+	labels := map[string]string{
+		guestPullLabel: "true",
+	}
+	for _, key := range []string{snpkg.TargetRefLabel, snpkg.TargetManifestDigestLabel} {
+		if v, ok := parentLabels[key]; ok {
+			labels[key] = v
+		}
+	}
+	return labels
+}
+
+// isImageVolume reports whether a snapshot is a read-only view of a guest
+// pulled image, such as a Kubernetes image volume
+func isImageVolume(kind snapshots.Kind, labels map[string]string) bool {
+	return kind == snapshots.KindView && IsGuestPullMode(labels)
+}
+
+// guestPullVolume returns the source and the metadata of the Kata virtual
+// volume describing a snapshot to the guest
+func guestPullVolume(ctx context.Context, kind snapshots.Kind, labels map[string]string) (string, map[string]string) {
+	metadata := map[string]string{
+		guestpull.VolumeKindMetadataKey: guestpull.VolumeKindRootfs,
+	}
+	for _, key := range idMappingLabels {
+		if v, ok := labels[key]; ok {
+			metadata[key] = v
+		}
+	}
+
+	if !isImageVolume(kind, labels) {
+		return "", metadata
+	}
+
+	metadata[guestpull.VolumeKindMetadataKey] = guestpull.VolumeKindImage
+	ref, ok := labels[snpkg.TargetRefLabel]
+	if !ok {
+		log.G(ctx).Warnf("image volume has no %q label, the guest can't pull it", snpkg.TargetRefLabel)
+		return "", metadata
+	}
+
+	metadata[guestpull.ImageReferenceMetadataKey] = ref
+	if digest, ok := labels[snpkg.TargetManifestDigestLabel]; ok {
+		metadata[snpkg.TargetManifestDigestLabel] = digest
+	}
+	return ref, metadata
+}
@@ -0,0 +1,85 @@
+package snapshot
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	guestpull "github.com/ChengyuZhu6/guest-pull-snapshotter/guest-pull"
+	"github.com/containerd/containerd/v2/core/mount"
+	"github.com/containerd/containerd/v2/core/snapshots"
+	snpkg "github.com/containerd/containerd/v2/pkg/snapshotters"
+	"github.com/containerd/errdefs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// decodeMountVolume returns the Kata virtual volume carried by mounts
+func decodeMountVolume(t *testing.T, mounts []mount.Mount) *guestpull.KataVirtualVolume {
+	t.Helper()
+	require.Len(t, mounts, 1)
+	for _, opt := range mounts[0].Options {
+		if encoded, ok := strings.CutPrefix(opt, guestpull.KataVirtualVolumeOptionName+"="); ok {
+			volume, err := guestpull.DecodeKataVirtualVolume(encoded)
+			require.NoError(t, err)
+			return volume
+		}
+	}
+	t.Fatalf("no %s option in mounts %v", guestpull.KataVirtualVolumeOptionName, mounts)
+	return nil
+}
+
+func TestViewOfGuestPulledImage(t *testing.T) {
+	ctx := context.Background()
+	sn, err := NewSnapshotter(ctx, WithRootDirectory(t.TempDir()))
+	require.NoError(t, err)
+	defer sn.Close()
+
+	_, err = sn.Prepare(ctx, "extract-layer", "", snapshots.WithLabels(map[string]string{
+		targetSnapshotLabel:             "layer",
+		snpkg.TargetRefLabel:            "docker.io/library/busybox:latest",
+		snpkg.TargetManifestDigestLabel: "sha256:abc",
+	}))
+	require.True(t, errdefs.IsAlreadyExists(err))
+
+	mounts, err := sn.View(ctx, "image-volume", "layer")
+	require.NoError(t, err)
+
+	volume := decodeMountVolume(t, mounts)
+	assert.Equal(t, "docker.io/library/busybox:latest", volume.Source)
+	assert.Contains(t, volume.Options, "ro")
+	assert.Equal(t, map[string]string{
+		guestpull.VolumeKindMetadataKey:     guestpull.VolumeKindImage,
+		guestpull.ImageReferenceMetadataKey: "docker.io/library/busybox:latest",
+		snpkg.TargetManifestDigestLabel:     "sha256:abc",
+	}, volume.ImagePull.Metadata)
+
+	mounts, err = sn.Mounts(ctx, "image-volume")
+	require.NoError(t, err)
+	assert.Equal(t, volume, decodeMountVolume(t, mounts))
+}
+
+func TestWithVolumeEncoder(t *testing.T) {
+	ctx := context.Background()
+	sn, err := NewSnapshotter(ctx, WithRootDirectory(t.TempDir()), WithVolumeEncoder(guestpull.NydusEncoder{}))
+	require.NoError(t, err)
+	defer sn.Close()
+
+	mounts, err := sn.Prepare(ctx, "container", "")
+	require.NoError(t, err)
+	require.Len(t, mounts, 1)
+
+	var volumeOptions []string
+	for _, opt := range mounts[0].Options {
+		if guestpull.IsVolumeOption(opt) {
+			volumeOptions = append(volumeOptions, opt)
+		}
+	}
+	require.Len(t, volumeOptions, 1)
+	assert.True(t, strings.HasPrefix(volumeOptions[0], guestpull.NydusExtraOptionName+"="))
+
+	volume, err := guestpull.DecodeVolumeOption(volumeOptions[0])
+	require.NoError(t, err)
+	assert.Equal(t, guestpull.VolumeKindRootfs, volume.ImagePull.Metadata[guestpull.VolumeKindMetadataKey])
+	assert.NotEmpty(t, volumeHash(mounts))
+}
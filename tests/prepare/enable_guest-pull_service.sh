@@ -2,8 +2,10 @@
 set -e
 
 echo "Enabling guest-pull service"
+sudo cp tests/config/guest-pull-snapshotter.socket /etc/systemd/system/
 sudo cp tests/config/guest-pull-snapshotter.service /etc/systemd/system/
 sudo systemctl daemon-reload
+sudo systemctl enable --now guest-pull-snapshotter.socket
 sudo systemctl enable guest-pull-snapshotter
 sudo systemctl start guest-pull-snapshotter
 sudo systemctl status guest-pull-snapshotter
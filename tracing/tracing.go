@@ -0,0 +1,101 @@
+// Package tracing exports the OpenTelemetry spans of the snapshotter.
+//
+// containerd propagates its trace context over gRPC, so the spans of the
+// snapshotter join the traces of the kubelet and containerd when both export
+// to the same collector.
+package tracing
+
+import (
+	"context"
+	"io"
+	"os"
+
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+
+	"github.com/ChengyuZhu6/guest-pull-snapshotter/config"
+	"github.com/ChengyuZhu6/guest-pull-snapshotter/version"
+)
+
+// ServiceName identifies the snapshotter in the exported traces
+const ServiceName = "containerd-guest-pull-grpc"
+
+// Setup installs the global tracer provider exporting to the configured
+// exporter, and the propagator of the W3C trace context used by containerd.
+// The returned function flushes the pending spans and stops the exporter.
+func Setup(ctx context.Context, cfg config.TracingConfig) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{}, propagation.Baggage{}))
+
+	if cfg.Exporter == config.TracingExporterNone {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, closer, err := newExporter(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL,
+		semconv.ServiceName(ServiceName),
+		semconv.ServiceVersion(version.Version)))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create tracing resource")
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.SamplingRatio))),
+	)
+	otel.SetTracerProvider(provider)
+
+	return func(ctx context.Context) error {
+		err := provider.Shutdown(ctx)
+		if closer != nil {
+			if cerr := closer.Close(); err == nil {
+				err = cerr
+			}
+		}
+		return err
+	}, nil
+}
+
+// newExporter creates the span exporter of cfg, along with the file it writes
+// to if any
+func newExporter(ctx context.Context, cfg config.TracingConfig) (sdktrace.SpanExporter, io.Closer, error) {
+	switch cfg.Exporter {
+	case config.TracingExporterOTLP:
+		opts := []otlptracegrpc.Option{otlptracegrpc.WithEndpoint(cfg.Endpoint)}
+		if cfg.Insecure {
+			opts = append(opts, otlptracegrpc.WithInsecure())
+		}
+		exporter, err := otlptracegrpc.New(ctx, opts...)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "failed to create otlp exporter for %s", cfg.Endpoint)
+		}
+		return exporter, nil, nil
+	case config.TracingExporterStdout:
+		exporter, err := stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+		return exporter, nil, errors.Wrap(err, "failed to create stdout exporter")
+	case config.TracingExporterFile:
+		f, err := os.OpenFile(cfg.File, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "failed to open trace file %s", cfg.File)
+		}
+		exporter, err := stdouttrace.New(stdouttrace.WithWriter(f))
+		if err != nil {
+			f.Close()
+			return nil, nil, errors.Wrap(err, "failed to create file exporter")
+		}
+		return exporter, f, nil
+	default:
+		return nil, nil, errors.Errorf("unknown tracing exporter %q", cfg.Exporter)
+	}
+}
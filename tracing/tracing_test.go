@@ -0,0 +1,35 @@
+package tracing
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+
+	"github.com/ChengyuZhu6/guest-pull-snapshotter/config"
+)
+
+func TestSetupFileExporter(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "spans.json")
+
+	shutdown, err := Setup(ctx, config.TracingConfig{
+		Exporter:      config.TracingExporterFile,
+		File:          path,
+		SamplingRatio: 1,
+	})
+	require.NoError(t, err)
+
+	_, span := otel.Tracer("test").Start(ctx, "test-span")
+	span.End()
+	require.NoError(t, shutdown(ctx))
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), `"Name":"test-span"`)
+	assert.Contains(t, string(data), ServiceName)
+}